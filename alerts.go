@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+)
+
+// alert kinds
+const (
+	// alertChanged is raised when the content of a url under a source
+	// changes hash
+	alertChanged = "changed"
+	// alertGone is raised when a url under a source starts responding
+	// with a 4xx or 5xx status
+	alertGone = "gone"
+	// alertStale is raised when urls under a source haven't been fetched
+	// within the source's stale duration
+	alertStale = "stale"
+)
+
+// alertCheckBatchSize is how many queued url checks are taken at once
+const alertCheckBatchSize = 500
+
+// Alert is something about a source's content that needs a look
+type Alert struct {
+	Id       int64     `json:"id"`
+	Created  time.Time `json:"created"`
+	SourceId string    `json:"sourceId"`
+	// Url the alert is about, empty for alerts about the whole source
+	Url string `json:"url"`
+	// Kind is one of changed, gone or stale
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// DismissedAt is when the alert was dismissed, nil while it's open
+	DismissedAt *time.Time `json:"dismissedAt"`
+	DismissedBy string     `json:"dismissedBy"`
+}
+
+// UnmarshalSQL reads an alert from a row of alertColumns
+func (a *Alert) UnmarshalSQL(row sqlutil.Scannable) error {
+	dismissed := pq.NullTime{}
+	if err := row.Scan(&a.Id, &a.Created, &a.SourceId, &a.Url, &a.Kind, &a.Message, &dismissed, &a.DismissedBy); err != nil {
+		return err
+	}
+	if dismissed.Valid {
+		a.DismissedAt = &dismissed.Time
+	}
+	return nil
+}
+
+// AlertSuppression stops alerts about a source from being raised
+type AlertSuppression struct {
+	Id       int64     `json:"id"`
+	Created  time.Time `json:"created"`
+	SourceId string    `json:"sourceId"`
+	// Url suppressed, empty for every url under the source
+	Url string `json:"url"`
+	// Kind of alert suppressed, empty for every kind
+	Kind string `json:"kind"`
+	// Until is when the suppression ends, nil if it doesn't
+	Until     *time.Time `json:"until"`
+	CreatedBy string     `json:"createdBy"`
+}
+
+// UnmarshalSQL reads a suppression from a row of alertSuppressionColumns
+func (s *AlertSuppression) UnmarshalSQL(row sqlutil.Scannable) error {
+	until := pq.NullTime{}
+	if err := row.Scan(&s.Id, &s.Created, &s.SourceId, &s.Url, &s.Kind, &until, &s.CreatedBy); err != nil {
+		return err
+	}
+	if until.Valid {
+		s.Until = &until.Time
+	}
+	return nil
+}
+
+// AlertSuppressRequest is the body of a request to suppress alerts like one
+// that's been raised
+type AlertSuppressRequest struct {
+	// Until is when to start raising alerts again, leave it out to
+	// suppress them for good
+	Until *time.Time `json:"until"`
+	// AllUrls suppresses alerts of this kind for every url under the source
+	AllUrls bool `json:"allUrls"`
+	// AllKinds suppresses every kind of alert for the url
+	AllKinds bool `json:"allKinds"`
+}
+
+func validateAlertSuppressRequest(req *AlertSuppressRequest) error {
+	v := &apiutil.Validator{}
+	if req.Until != nil && !req.Until.After(time.Now()) {
+		v.Add("until", apiutil.CodeInvalid, "must be in the future")
+	}
+	return v.Err()
+}
+
+// detectAlerts raises alerts & sends them to the configured notifiers every
+// interval until ctx is done
+func detectAlerts(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// only the leader raises alerts, so notifiers don't hear twice
+		if !isDBReady() || !leader.isLeader() {
+			continue
+		}
+		alerts, err := raiseAlerts()
+		if err != nil {
+			log.Infof("error raising alerts: %s", err)
+		}
+		notifyAlerts(newAlertNotifiers(cfg), alerts)
+	}
+}
+
+// raiseAlerts raises alerts for urls queued by the queue_url_alert_check
+// trigger & for sources that have gone stale, returning the new alerts.
+// alerts raised before an error are still returned
+func raiseAlerts() ([]*Alert, error) {
+	raised := []*Alert{}
+	for {
+		alerts, checked, err := raiseUrlAlerts()
+		raised = append(raised, alerts...)
+		if err != nil {
+			return raised, err
+		}
+		if checked < alertCheckBatchSize {
+			break
+		}
+	}
+
+	stale, err := queryAlerts(appDB, qAlertsRaiseStale, "", alertStale, core.StaleDuration.Seconds())
+	raised = append(raised, stale...)
+	if err != nil {
+		return raised, err
+	}
+
+	if len(raised) > 0 {
+		ids := make([]string, len(raised))
+		for i, a := range raised {
+			ids[i] = a.SourceId
+		}
+		if _, err := appDB.Exec(qSourcesAlertSent, pq.Array(ids), time.Now().UTC()); err != nil {
+			return raised, err
+		}
+	}
+	return raised, nil
+}
+
+// raiseUrlAlerts takes a batch of queued url checks & raises alerts for
+// them, returning the alerts & how many checks were taken. checks are only
+// taken off the queue if their alerts are raised
+func raiseUrlAlerts() ([]*Alert, int, error) {
+	type check struct {
+		url, prevHash, hash string
+		prevStatus, status  int
+	}
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(qUrlAlertChecksTake, alertCheckBatchSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	var checks []*check
+	for rows.Next() {
+		c := &check{}
+		if err := rows.Scan(&c.url, &c.prevHash, &c.hash, &c.prevStatus, &c.status); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		checks = append(checks, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	raised := []*Alert{}
+	for _, c := range checks {
+		kind, msg := alertChanged, fmt.Sprintf("content hash changed from %s to %s", c.prevHash, c.hash)
+		if c.status >= 400 && c.prevStatus < 400 {
+			kind, msg = alertGone, fmt.Sprintf("responded with status %d", c.status)
+		}
+		alerts, err := queryAlerts(tx, qAlertsRaiseForUrl, c.url, kind, msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		raised = append(raised, alerts...)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return raised, len(checks), nil
+}
+
+// queryAlerts runs a query that returns alertColumns
+func queryAlerts(db sqlutil.Queryable, query string, args ...interface{}) ([]*Alert, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []*Alert{}
+	for rows.Next() {
+		a := &Alert{}
+		if err := a.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// readAlert reads an alert by id, returning core.ErrNotFound if it doesn't
+// exist
+func readAlert(db sqlutil.Queryable, id int64) (*Alert, error) {
+	a := &Alert{}
+	if err := a.UnmarshalSQL(db.QueryRow(qAlertRead, id)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, core.ErrNotFound
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// readAlertSuppression reads a suppression by id, returning
+// core.ErrNotFound if it doesn't exist
+func readAlertSuppression(db sqlutil.Queryable, id int64) (*AlertSuppression, error) {
+	s := &AlertSuppression{}
+	if err := s.UnmarshalSQL(db.QueryRow(qAlertSuppressionRead, id)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, core.ErrNotFound
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// actorName names the user making a request, or their ip if they're
+// anonymous
+func actorName(r *http.Request) string {
+	if u := requestUser(r); u != nil {
+		return u.Username
+	}
+	return getIP(r)
+}
+
+// alertIdParam parses the id path param of alert routes
+func alertIdParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(apiutil.PathParam(r, "id"), 10, 64)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return 0, false
+	}
+	return id, true
+}
+
+// ListAlertsHandler lists alerts, most recent first
+func ListAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, alertsResource) {
+		return
+	}
+	p := apiutil.PageFromRequest(r)
+	q, err := alertsResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
+	alerts := make([]*Alert, 0, p.Size)
+	err = queryList(appDB, alertsResource, q, p.Limit(), p.Offset(), func(row sqlutil.Scannable) error {
+		a := &Alert{}
+		if err := a.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		alerts = append(alerts, a)
+		return nil
+	})
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, alerts, r, p)
+}
+
+// GetAlertHandler gets an alert
+func GetAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertIdParam(w, r)
+	if !ok {
+		return
+	}
+	a, err := readAlert(appDB, id)
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, a)
+}
+
+// DismissAlertHandler dismisses an alert, responding with it. dismissing
+// an alert that's already dismissed leaves it as it was. admin only
+func DismissAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertIdParam(w, r)
+	if !ok {
+		return
+	}
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	a, err := dismissAlert(tx, r, id)
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, a)
+}
+
+// dismissAlert dismisses an open alert inside tx on behalf of r, recording
+// an audit event
+func dismissAlert(tx *sql.Tx, r *http.Request, id int64) (*Alert, error) {
+	if _, err := tx.Exec(qLockResource, "alerts:"+strconv.FormatInt(id, 10)); err != nil {
+		return nil, err
+	}
+	before, err := readAlert(tx, id)
+	if err != nil || before.DismissedAt != nil {
+		return before, err
+	}
+	if _, err := tx.Exec(qAlertDismiss, id, time.Now().UTC(), actorName(r)); err != nil {
+		return nil, err
+	}
+	after, err := readAlert(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, r, auditUpdate, "alerts", strconv.FormatInt(id, 10), before, after); err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// SuppressAlertHandler stops alerts like one that's been raised from being
+// raised again & dismisses it, responding with the new suppression. admin
+// only
+func SuppressAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertIdParam(w, r)
+	if !ok {
+		return
+	}
+	req := &AlertSuppressRequest{}
+	if !decodeBody(w, r, req) {
+		return
+	}
+	if err := validateAlertSuppressRequest(req); err != nil {
+		writeBodyErr(w, err)
+		return
+	}
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	a, err := dismissAlert(tx, r, id)
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	url, kind := a.Url, a.Kind
+	if req.AllUrls {
+		url = ""
+	}
+	if req.AllKinds {
+		kind = ""
+	}
+	var until interface{}
+	if req.Until != nil {
+		until = req.Until.UTC()
+	}
+	s := &AlertSuppression{}
+	if err := s.UnmarshalSQL(tx.QueryRow(qAlertSuppressionInsert, a.SourceId, url, kind, until, actorName(r))); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordAudit(tx, r, auditCreate, "alertsuppressions", strconv.FormatInt(s.Id, 10), nil, s); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, s)
+}
+
+// ListAlertSuppressionsHandler lists alert suppressions, newest first.
+// admin only
+func ListAlertSuppressionsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := appDB.Query(qAlertSuppressionsList)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	suppressions := []*AlertSuppression{}
+	for rows.Next() {
+		s := &AlertSuppression{}
+		if err := s.UnmarshalSQL(rows); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		suppressions = append(suppressions, s)
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, suppressions)
+}
+
+// DeleteAlertSuppressionHandler removes a suppression so its alerts are
+// raised again, responding with the suppression. admin only
+func DeleteAlertSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertIdParam(w, r)
+	if !ok {
+		return
+	}
+	var current *AlertSuppression
+	read := func() (interface{}, time.Time, error) {
+		s, err := readAlertSuppression(appDB, id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		current = s
+		return s, s.Created, nil
+	}
+	if !conditionalWrite(w, r, "alertsuppressions", strconv.FormatInt(id, 10), read, func(ts txStore) (sql_datastore.Model, error) {
+		_, err := ts.tx.Exec(qAlertSuppressionDelete, id)
+		return nil, err
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, current)
+}
@@ -0,0 +1,89 @@
+package apiutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag makes a strong entity tag from a response body
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// NotModified reports whether a GET request's conditional headers match the
+// current representation, meaning the client should get a 304.
+// If-None-Match takes precedence over If-Modified-Since, as RFC 7232
+// requires. lastModified is ignored if it's zero
+func NotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// http dates have second precision
+		return !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// etagMatches checks an If-None-Match list against etag using weak
+// comparison, which is what GET & HEAD requests call for
+func etagMatches(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return etag != ""
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// IfMatch checks an If-Match header against the current version of a
+// resource. Each entry in the header can be an entity tag, or the resource's
+// updated time as an RFC3339 timestamp. Entity tags use strong comparison,
+// so weak tags never match
+func IfMatch(header, etag string, updated time.Time) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == etag {
+			return true
+		}
+		t, err := time.Parse(time.RFC3339Nano, strings.Trim(candidate, `"`))
+		if err == nil && !updated.IsZero() && t.Truncate(time.Second).Equal(updated.Truncate(time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// LastUpdated reads the "updated" timestamp of a single decoded JSON object,
+// returning the zero time if it doesn't have one. Lists don't get a
+// timestamp: removing an item from a list doesn't update any of the others
+func LastUpdated(v interface{}) time.Time {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return time.Time{}
+	}
+	str, _ := obj["updated"].(string)
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
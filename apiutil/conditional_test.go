@@ -0,0 +1,87 @@
+package apiutil
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := ETag([]byte(`{"data":{}}`))
+	updated := time.Date(2017, 1, 1, 10, 0, 0, 500, time.UTC)
+
+	cases := []struct {
+		inm, ims     string
+		lastModified time.Time
+		expect       bool
+	}{
+		{"", "", updated, false},
+		{etag, "", updated, true},
+		{`"other", ` + etag, "", updated, true},
+		{"W/" + etag, "", updated, true},
+		{"*", "", updated, true},
+		{`"other"`, "", updated, false},
+		// If-None-Match wins
+		{`"other"`, "Sun, 01 Jan 2017 10:00:00 GMT", updated, false},
+		{"", "Sun, 01 Jan 2017 10:00:00 GMT", updated, true},
+		{"", "Sun, 01 Jan 2017 09:59:59 GMT", updated, false},
+		{"", "Sun, 01 Jan 2017 10:00:00 GMT", time.Time{}, false},
+		{"", "yesterday", updated, false},
+	}
+
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.inm != "" {
+			r.Header.Set("If-None-Match", c.inm)
+		}
+		if c.ims != "" {
+			r.Header.Set("If-Modified-Since", c.ims)
+		}
+		if got := NotModified(r, etag, c.lastModified); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestLastUpdated(t *testing.T) {
+	cases := []struct {
+		v      interface{}
+		expect time.Time
+	}{
+		{map[string]interface{}{"updated": "2017-01-01T10:00:00Z"}, time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{map[string]interface{}{"updated": 5}, time.Time{}},
+		{[]interface{}{map[string]interface{}{"updated": "2017-01-01T10:00:00Z"}}, time.Time{}},
+		{nil, time.Time{}},
+	}
+	for i, c := range cases {
+		if got := LastUpdated(c.v); !got.Equal(c.expect) {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	etag := ETag([]byte(`{"data":{}}`))
+	updated := time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		header string
+		expect bool
+	}{
+		{etag, true},
+		{"*", true},
+		{`"other", ` + etag, true},
+		{"W/" + etag, false},
+		{`"other"`, false},
+		{"2017-01-01T10:00:00Z", true},
+		{`"2017-01-01T10:00:00Z"`, true},
+		{"2017-01-01T11:00:00+01:00", true},
+		{"2017-01-01T10:00:01Z", false},
+	}
+
+	for i, c := range cases {
+		if got := IfMatch(c.header, etag, updated); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Change is the before & after value of a changed field
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Diff compares the top level fields of two values as they marshal to JSON,
+// returning the fields that differ. A nil value has no fields, so diffing
+// against nil lists every field of the other value
+func Diff(before, after interface{}) (map[string]*Change, error) {
+	b, err := diffFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := diffFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := map[string]*Change{}
+	for name, val := range b {
+		if !reflect.DeepEqual(val, a[name]) {
+			diff[name] = &Change{Before: val, After: a[name]}
+		}
+	}
+	for name, val := range a {
+		if _, ok := b[name]; !ok && val != nil {
+			diff[name] = &Change{After: val}
+		}
+	}
+	return diff, nil
+}
+
+// diffFields decodes the JSON of v as an object. values that aren't objects
+// are stored under "(root)"
+func diffFields(v interface{}) (map[string]interface{}, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return map[string]interface{}{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	if fields, ok := decoded.(map[string]interface{}); ok {
+		return fields, nil
+	}
+	return map[string]interface{}{"(root)": decoded}, nil
+}
@@ -0,0 +1,43 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	type model struct {
+		Title string            `json:"title"`
+		Count int               `json:"count"`
+		Meta  map[string]string `json:"meta"`
+		Tags  []string          `json:"tags,omitempty"`
+	}
+
+	cases := []struct {
+		before, after interface{}
+		expect        string
+	}{
+		{&model{Title: "a"}, &model{Title: "a"}, `{}`},
+		{&model{Title: "a", Count: 1}, &model{Title: "b", Count: 1}, `{"title":{"before":"a","after":"b"}}`},
+		{&model{Meta: map[string]string{"a": "b"}}, &model{}, `{"meta":{"before":{"a":"b"},"after":null}}`},
+		{&model{}, &model{Tags: []string{"a"}}, `{"tags":{"before":null,"after":["a"]}}`},
+		{nil, &model{Title: "a"}, `{"count":{"before":null,"after":0},"title":{"before":null,"after":"a"}}`},
+		{&model{Count: 2}, (*model)(nil), `{"count":{"before":2,"after":null},"title":{"before":"","after":null}}`},
+		{"a", "b", `{"(root)":{"before":"a","after":"b"}}`},
+	}
+
+	for i, c := range cases {
+		diff, err := Diff(c.before, c.after)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		got, err := json.Marshal(diff)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != c.expect {
+			t.Errorf("case %d mismatch.\nexpected: %s\ngot:      %s", i, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package apiutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fieldset is a parsed fields= param: a tree of the json fields a client
+// wants in a response. Dotted names like primer.title select fields of
+// nested objects. A field that maps to nil is selected whole, a nil
+// Fieldset selects everything
+type Fieldset map[string]Fieldset
+
+// ParseFieldset reads a comma-separated list of field names, returning
+// nil if raw is empty
+func ParseFieldset(raw string) Fieldset {
+	var fs Fieldset
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if fs == nil {
+			fs = Fieldset{}
+		}
+
+		node := fs
+		parts := strings.Split(name, ".")
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				node[part] = nil
+				break
+			}
+			child, ok := node[part]
+			if ok && child == nil {
+				// already selected whole
+				break
+			}
+			if !ok {
+				child = Fieldset{}
+				node[part] = child
+			}
+			node = child
+		}
+	}
+	return fs
+}
+
+// Select trims a decoded JSON value (as produced by json.Unmarshal into an
+// interface{}) to the fields in fs. Arrays have each of their elements
+// trimmed
+func (fs Fieldset) Select(v interface{}) interface{} {
+	if fs == nil {
+		return v
+	}
+	switch t := v.(type) {
+	case []interface{}:
+		for i, item := range t {
+			t[i] = fs.Select(item)
+		}
+		return t
+	case map[string]interface{}:
+		selected := map[string]interface{}{}
+		for name, sub := range fs {
+			if val, ok := t[name]; ok {
+				selected[name] = sub.Select(val)
+			}
+		}
+		return selected
+	default:
+		return v
+	}
+}
+
+// CheckFieldset returns an error naming the first field in fs that isn't
+// a property of schema s. Fields of free-form objects aren't checked
+func (b *SchemaBuilder) CheckFieldset(s *Schema, fs Fieldset) error {
+	return b.checkFieldset(s, fs, "")
+}
+
+func (b *SchemaBuilder) checkFieldset(s *Schema, fs Fieldset, prefix string) error {
+	if fs == nil {
+		return nil
+	}
+	s, err := b.Resolve(s)
+	if err != nil {
+		return err
+	}
+	for s.Type == "array" && s.Items != nil {
+		if s, err = b.Resolve(s.Items); err != nil {
+			return err
+		}
+	}
+	if len(s.Properties) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(fs))
+	for name := range fs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ps, ok := s.Properties[name]
+		if !ok {
+			return fmt.Errorf("unknown field: '%s%s'", prefix, name)
+		}
+		if err := b.checkFieldset(ps, fs[name], prefix+name+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expansions is a parsed expand= param, the set of related resources a
+// client wants embedded in a response
+type Expansions map[string]bool
+
+// ParseExpansions reads a comma-separated list of expansions, each of which
+// must be in allowed. Expanding a nested resource like primer.parent
+// implies expanding its parent, primer
+func ParseExpansions(raw string, allowed []string) (Expansions, error) {
+	exp := Expansions{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ok := false
+		for _, a := range allowed {
+			if a == name {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			if len(allowed) == 0 {
+				return nil, fmt.Errorf("this endpoint doesn't support expand")
+			}
+			return nil, fmt.Errorf("unknown expansion: '%s'. expected one of: %s", name, strings.Join(allowed, ", "))
+		}
+
+		parts := strings.Split(name, ".")
+		for i := range parts {
+			exp[strings.Join(parts[:i+1], ".")] = true
+		}
+	}
+	return exp, nil
+}
+
+// Has reports whether name should be expanded. Has is safe to call on a
+// nil Expansions
+func (e Expansions) Has(name string) bool {
+	return e[name]
+}
+
+// Sub returns the expansions nested under name, with the "name." prefix
+// removed
+func (e Expansions) Sub(name string) Expansions {
+	sub := Expansions{}
+	prefix := name + "."
+	for key := range e {
+		if strings.HasPrefix(key, prefix) {
+			sub[key[len(prefix):]] = true
+		}
+	}
+	return sub
+}
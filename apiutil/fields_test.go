@@ -0,0 +1,109 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFieldsetSelect(t *testing.T) {
+	cases := []struct {
+		fields string
+		in     string
+		expect string
+	}{
+		{"", `{"id":"a","title":"b"}`, `{"id":"a","title":"b"}`},
+		{"id", `{"id":"a","title":"b"}`, `{"id":"a"}`},
+		{"id, title,nope", `[{"id":"a","title":"b","url":"c"},{"id":"d"}]`, `[{"id":"a","title":"b"},{"id":"d"}]`},
+		{"id,primer.title", `{"id":"a","primer":{"id":"b","title":"c"}}`, `{"id":"a","primer":{"title":"c"}}`},
+		{"primer,primer.title", `{"id":"a","primer":{"id":"b","title":"c"}}`, `{"primer":{"id":"b","title":"c"}}`},
+		{"primer.title,primer", `{"id":"a","primer":{"id":"b","title":"c"}}`, `{"primer":{"id":"b","title":"c"}}`},
+		{"sources.url", `{"sources":[{"id":"a","url":"b"}]}`, `{"sources":[{"url":"b"}]}`},
+	}
+
+	for i, c := range cases {
+		var in, expect interface{}
+		if err := json.Unmarshal([]byte(c.in), &in); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(c.expect), &expect); err != nil {
+			t.Fatal(err)
+		}
+		got := ParseFieldset(c.fields).Select(in)
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, expect, got)
+		}
+	}
+}
+
+func TestCheckFieldset(t *testing.T) {
+	type child struct {
+		Title string `json:"title"`
+	}
+	type parent struct {
+		Id       string                 `json:"id"`
+		Child    *child                 `json:"child"`
+		Children []*child               `json:"children"`
+		Meta     map[string]interface{} `json:"meta"`
+	}
+
+	cases := []struct {
+		fields string
+		err    string
+	}{
+		{"", ""},
+		{"id,child", ""},
+		{"child.title,children.title", ""},
+		{"meta.anything", ""},
+		{"nope", "unknown field: 'nope'"},
+		{"id,child.nope", "unknown field: 'child.nope'"},
+		{"children.nope", "unknown field: 'children.nope'"},
+	}
+
+	b := NewSchemaBuilder()
+	s := b.SchemaFor(parent{})
+	for i, c := range cases {
+		err := b.CheckFieldset(&Schema{Type: "array", Items: s}, ParseFieldset(c.fields))
+		if c.err == "" && err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("case %d error mismatch. expected: '%s', got: '%v'", i, c.err, err)
+		}
+	}
+}
+
+func TestParseExpansions(t *testing.T) {
+	allowed := []string{"primer", "primer.parent", "stats"}
+	cases := []struct {
+		raw    string
+		expect Expansions
+		err    string
+	}{
+		{"", Expansions{}, ""},
+		{"stats", Expansions{"stats": true}, ""},
+		{"primer.parent", Expansions{"primer": true, "primer.parent": true}, ""},
+		{"nope", nil, "unknown expansion: 'nope'. expected one of: primer, primer.parent, stats"},
+	}
+
+	for i, c := range cases {
+		got, err := ParseExpansions(c.raw, allowed)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: '%s', got: '%v'", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+
+	sub := Expansions{"primer": true, "primer.parent": true}.Sub("primer")
+	if !reflect.DeepEqual(sub, Expansions{"parent": true}) {
+		t.Errorf("Sub mismatch: %v", sub)
+	}
+}
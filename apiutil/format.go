@@ -0,0 +1,193 @@
+package apiutil
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Format is a response encoding clients can ask for with the Accept header
+// or a format= param
+type Format string
+
+const (
+	FormatJSON   Format = "json"
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+var formatContentTypes = map[Format]string{
+	FormatJSON:   "application/json",
+	FormatCSV:    "text/csv",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+// ContentType is the media type for f
+func (f Format) ContentType() string {
+	return formatContentTypes[f]
+}
+
+// RequestFormat picks the format for a response. A format= param wins,
+// otherwise the first media type in the Accept header that matches a
+// format is used. Defaults to FormatJSON, an unknown format= is an error
+func RequestFormat(r *http.Request) (Format, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatContentTypes[Format(f)]; !ok {
+			return "", fmt.Errorf("unknown format: '%s'. expected one of: json, csv, ndjson", f)
+		}
+		return Format(f), nil
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		for f, ct := range formatContentTypes {
+			if mt == ct {
+				return f, nil
+			}
+		}
+	}
+	return FormatJSON, nil
+}
+
+// FieldNames lists the json field names of struct value v in the order
+// encoding/json writes them
+func FieldNames(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	fields := jsonFields(t)
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// RowWriter streams list results to a client one row at a time, so large
+// lists never have to be held in memory
+type RowWriter interface {
+	// WriteRow encodes a single result
+	WriteRow(v interface{}) error
+	// Flush sends buffered rows to the client
+	Flush() error
+}
+
+// NewRowWriter writes the response header for format f & returns a
+// RowWriter for it. columns sets the csv header, fields trims each row.
+// f must be FormatCSV or FormatNDJSON
+func NewRowWriter(w http.ResponseWriter, f Format, columns []string, fields Fieldset) RowWriter {
+	w.Header().Set("Content-Type", f.ContentType()+"; charset=utf-8")
+	rw := &rowWriter{w: w, fields: fields}
+	if f == FormatCSV {
+		rw.csv = csv.NewWriter(w)
+		rw.columns = columns
+		if fields != nil {
+			rw.columns = nil
+			for _, c := range columns {
+				if _, ok := fields[c]; ok {
+					rw.columns = append(rw.columns, c)
+				}
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	return rw
+}
+
+type rowWriter struct {
+	w       http.ResponseWriter
+	fields  Fieldset
+	csv     *csv.Writer
+	columns []string
+	started bool
+}
+
+func (rw *rowWriter) WriteRow(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var row interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&row); err != nil {
+		return err
+	}
+	row = rw.fields.Select(row)
+
+	if rw.csv == nil {
+		data, err = json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		_, err = rw.w.Write(append(data, '\n'))
+		return err
+	}
+
+	if !rw.started {
+		rw.started = true
+		if err := rw.csv.Write(rw.columns); err != nil {
+			return err
+		}
+	}
+	obj, _ := row.(map[string]interface{})
+	record := make([]string, len(rw.columns))
+	for i, c := range rw.columns {
+		if record[i], err = csvValue(obj[c]); err != nil {
+			return err
+		}
+	}
+	return rw.csv.Write(record)
+}
+
+func (rw *rowWriter) Flush() error {
+	if rw.csv != nil {
+		if !rw.started {
+			// always write a header, even for empty results
+			rw.started = true
+			rw.csv.Write(rw.columns)
+		}
+		rw.csv.Flush()
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// csvValue formats a decoded JSON value for a csv cell. nested objects &
+// arrays are written as JSON. strings that spreadsheets would run as a
+// formula are prefixed with a quote, numbers are left alone
+func csvValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if t != "" && strings.ContainsRune("=+-@\t\r", rune(t[0])) {
+			return "'" + t, nil
+		}
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		if t {
+			return "true", nil
+		}
+		return "false", nil
+	default:
+		data, err := json.Marshal(t)
+		return string(data), err
+	}
+}
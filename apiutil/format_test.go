@@ -0,0 +1,118 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestFormat(t *testing.T) {
+	cases := []struct {
+		query, accept string
+		expect        Format
+		err           string
+	}{
+		{"", "", FormatJSON, ""},
+		{"", "text/csv", FormatCSV, ""},
+		{"", "text/html, application/x-ndjson;q=0.9", FormatNDJSON, ""},
+		{"?format=csv", "application/x-ndjson", FormatCSV, ""},
+		{"?format=json", "text/csv", FormatJSON, ""},
+		{"?format=xml", "", "", "unknown format: 'xml'. expected one of: json, csv, ndjson"},
+	}
+
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/things"+c.query, nil)
+		r.Header.Set("Accept", c.accept)
+		got, err := RequestFormat(r)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: '%s', got: '%v'", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if got != c.expect {
+			t.Errorf("case %d format mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestRowWriter(t *testing.T) {
+	type thing struct {
+		Id      string                 `json:"id"`
+		Created time.Time              `json:"created"`
+		Count   int64                  `json:"count"`
+		Ok      bool                   `json:"ok"`
+		Meta    map[string]interface{} `json:"meta"`
+	}
+	rows := []*thing{
+		{Id: "a", Created: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), Count: 9007199254740993, Ok: true, Meta: map[string]interface{}{"k": "v"}},
+		{Id: "b,c"},
+	}
+
+	cases := []struct {
+		format Format
+		fields string
+		rows   []*thing
+		expect string
+	}{
+		{FormatCSV, "", rows, "id,created,count,ok,meta\n" +
+			"a,2017-01-01T00:00:00Z,9007199254740993,true,\"{\"\"k\"\":\"\"v\"\"}\"\n" +
+			"\"b,c\",0001-01-01T00:00:00Z,0,false,\n"},
+		{FormatCSV, "count,id", rows, "id,count\na,9007199254740993\n\"b,c\",0\n"},
+		{FormatCSV, "", nil, "id,created,count,ok,meta\n"},
+		{FormatNDJSON, "id", rows, "{\"id\":\"a\"}\n{\"id\":\"b,c\"}\n"},
+		{FormatNDJSON, "", nil, ""},
+	}
+
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		rw := NewRowWriter(w, c.format, FieldNames(thing{}), ParseFieldset(c.fields))
+		for _, row := range c.rows {
+			if err := rw.WriteRow(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Body.String(); got != c.expect {
+			t.Errorf("case %d body mismatch. expected:\n%s\ngot:\n%s", i, c.expect, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != c.format.ContentType()+"; charset=utf-8" {
+			t.Errorf("case %d content type mismatch: %s", i, got)
+		}
+	}
+}
+
+func TestCSVValue(t *testing.T) {
+	cases := []struct {
+		v      interface{}
+		expect string
+	}{
+		{"plain", "plain"},
+		{"", ""},
+		{"=SUM(A1:A2)", "'=SUM(A1:A2)"},
+		{"+1", "'+1"},
+		{"-1+2", "'-1+2"},
+		{"@cmd", "'@cmd"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+		{"a=b", "a=b"},
+		{json.Number("-1"), "-1"},
+		{nil, ""},
+	}
+	for i, c := range cases {
+		got, err := csvValue(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.expect {
+			t.Errorf("case %d mismatch. expected: %q, got: %q", i, c.expect, got)
+		}
+	}
+}
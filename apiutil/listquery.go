@@ -0,0 +1,247 @@
+package apiutil
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType determines how filter values are parsed
+type FieldType int
+
+const (
+	FieldString FieldType = iota
+	FieldInt
+	FieldBool
+	FieldTime
+	FieldUUID
+)
+
+// String gives the OpenAPI type name for a FieldType
+func (t FieldType) String() string {
+	switch t {
+	case FieldInt:
+		return "integer"
+	case FieldBool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// Field is a whitelisted field clients can filter and/or sort a list by
+type Field struct {
+	// Name is the field name used in query strings, matching the json name
+	Name string
+	// Column is the sql expression the field maps to
+	Column string
+	Type   FieldType
+	// Sortable fields can be used in sort=
+	Sortable bool
+	// Filterable fields can be used as filters
+	Filterable bool
+	// Condition, if set, replaces "Column = $n" when filtering with an sql
+	// condition. the placeholder {} is replaced with the parameter, only
+	// equality filters are allowed
+	Condition string
+}
+
+// operators in the order they're matched, longest first
+var filterOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// Filter is a single parsed filter expression like created>=2017-01-01
+type Filter struct {
+	Field *Field
+	Op    string
+	Value interface{}
+}
+
+// Sort is a single sort field, Desc if prefixed with "-"
+type Sort struct {
+	Field *Field
+	Desc  bool
+}
+
+// ListQuery is the parsed filter & sort portion of a list request
+type ListQuery struct {
+	Filters []*Filter
+	Sort    []*Sort
+}
+
+// ListQueryError is returned for invalid list queries, & should be reported
+// to clients as a 400 Bad Request
+type ListQueryError struct {
+	Message string
+}
+
+func (e *ListQueryError) Error() string {
+	return e.Message
+}
+
+func listQueryErrorf(format string, args ...interface{}) error {
+	return &ListQueryError{Message: fmt.Sprintf(format, args...)}
+}
+
+// ReservedParams are query params that are never treated as filters
+var ReservedParams = map[string]bool{
+	"page":     true,
+	"pageSize": true,
+	"sort":     true,
+	"fields":   true,
+	"expand":   true,
+	"format":   true,
+	// api_token authenticates requests, see requestAddUser
+	"api_token": true,
+}
+
+// ParseListQuery reads filters & sort order from a raw query string.
+// Every non-reserved param is a filter, & must name a filterable field.
+// Filters take the form name=value, or name<op>value where op is one
+// of >=, <=, !=, >, <. sort is a comma-separated list of sortable field
+// names, each optionally prefixed with "-" for descending order.
+// defaultSort is used when no sort param is provided
+func ParseListQuery(rawQuery string, fields []*Field, defaultSort string) (*ListQuery, error) {
+	q := &ListQuery{}
+	sort := defaultSort
+
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		expr, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, listQueryErrorf("invalid query param: %s", part)
+		}
+
+		name, op, value := splitFilter(expr)
+		if ReservedParams[name] {
+			if name == "sort" && op == "=" {
+				sort = value
+			}
+			continue
+		}
+
+		f := findField(fields, name)
+		if f == nil || !f.Filterable {
+			return nil, listQueryErrorf("unknown filter field: '%s'", name)
+		}
+		if op == "" {
+			return nil, listQueryErrorf("filter '%s' needs a value", name)
+		}
+		if f.Condition != "" && op != "=" {
+			return nil, listQueryErrorf("filter '%s' only supports '='", name)
+		}
+		if (f.Type == FieldBool || f.Type == FieldUUID) && op != "=" && op != "!=" {
+			return nil, listQueryErrorf("filter '%s' only supports '=' and '!='", name)
+		}
+
+		v, err := parseFilterValue(f, value)
+		if err != nil {
+			return nil, err
+		}
+		q.Filters = append(q.Filters, &Filter{Field: f, Op: op, Value: v})
+	}
+
+	for _, name := range strings.Split(sort, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		s := &Sort{}
+		if strings.HasPrefix(name, "-") {
+			s.Desc = true
+			name = name[1:]
+		}
+		s.Field = findField(fields, name)
+		if s.Field == nil || !s.Field.Sortable {
+			return nil, listQueryErrorf("unknown sort field: '%s'", name)
+		}
+		q.Sort = append(q.Sort, s)
+	}
+
+	return q, nil
+}
+
+// splitFilter breaks a query expression into name, operator & value.
+// op is "" if expr has no operator
+func splitFilter(expr string) (name, op, value string) {
+	for i := 0; i < len(expr); i++ {
+		for _, o := range filterOps {
+			if strings.HasPrefix(expr[i:], o) {
+				return expr[:i], o, expr[i+len(o):]
+			}
+		}
+	}
+	return expr, "", ""
+}
+
+func findField(fields []*Field, name string) *Field {
+	for _, f := range fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func parseFilterValue(f *Field, value string) (interface{}, error) {
+	switch f.Type {
+	case FieldInt:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, listQueryErrorf("filter '%s' must be an integer", f.Name)
+		}
+		return i, nil
+	case FieldBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, listQueryErrorf("filter '%s' must be true or false", f.Name)
+		}
+		return b, nil
+	case FieldTime:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, listQueryErrorf("filter '%s' must be a date (YYYY-MM-DD) or RFC3339 timestamp", f.Name)
+	case FieldUUID:
+		if !paramTypes["uuid"].MatchString(value) {
+			return nil, listQueryErrorf("filter '%s' must be a uuid", f.Name)
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
+
+// SQL compiles the query to a parameterized sql where clause & order by
+// list. Parameter numbering starts after the first argsOffset parameters,
+// so queries can bind their own params first. where is "" if there are no
+// filters, orderBy is "" if there's no sort order. Field names never
+// appear in the output, only whitelisted columns & placeholders
+func (q *ListQuery) SQL(argsOffset int) (where, orderBy string, args []interface{}) {
+	conds := make([]string, len(q.Filters))
+	for i, f := range q.Filters {
+		args = append(args, f.Value)
+		placeholder := fmt.Sprintf("$%d", argsOffset+len(args))
+		if f.Field.Condition != "" {
+			conds[i] = "(" + strings.Replace(f.Field.Condition, "{}", placeholder, -1) + ")"
+		} else {
+			conds[i] = fmt.Sprintf("%s %s %s", f.Field.Column, f.Op, placeholder)
+		}
+	}
+	where = strings.Join(conds, " AND ")
+
+	sorts := make([]string, len(q.Sort))
+	for i, s := range q.Sort {
+		sorts[i] = s.Field.Column
+		if s.Desc {
+			sorts[i] += " DESC"
+		}
+	}
+	orderBy = strings.Join(sorts, ", ")
+	return
+}
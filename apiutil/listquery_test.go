@@ -0,0 +1,73 @@
+package apiutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var listQueryTestFields = []*Field{
+	{Name: "created", Column: "created", Type: FieldTime, Sortable: true, Filterable: true},
+	{Name: "title", Column: "title", Type: FieldString, Sortable: true, Filterable: true},
+	{Name: "status", Column: "status", Type: FieldInt, Filterable: true},
+	{Name: "contentType", Column: "content_type", Type: FieldString, Filterable: true},
+	{Name: "primer", Type: FieldUUID, Filterable: true, Condition: "primer_id = {}"},
+}
+
+func TestParseListQuery(t *testing.T) {
+	cases := []struct {
+		raw     string
+		where   string
+		orderBy string
+		args    []interface{}
+		err     string
+	}{
+		{"", "", "created DESC", nil, ""},
+		{"page=2&pageSize=10&sort=-title,created", "", "title DESC, created", nil, ""},
+		{"status=200&contentType=application%2Fpdf", "status = $3 AND content_type = $4", "created DESC",
+			[]interface{}{int64(200), "application/pdf"}, ""},
+		{"created>=2017-01-01&title!=a", "created >= $3 AND title != $4", "created DESC",
+			[]interface{}{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), "a"}, ""},
+		{"created%3C2017-01-01T10:00:00Z", "created < $3", "created DESC",
+			[]interface{}{time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)}, ""},
+		{"primer=4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1", "(primer_id = $3)", "created DESC",
+			[]interface{}{"4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1"}, ""},
+
+		{"nope=1", "", "", nil, "unknown filter field: 'nope'"},
+		{"sort=status", "", "", nil, "unknown sort field: 'status'"},
+		{"sort=-nope", "", "", nil, "unknown sort field: 'nope'"},
+		{"status=ok", "", "", nil, "filter 'status' must be an integer"},
+		{"created>=yesterday", "", "", nil, "filter 'created' must be a date (YYYY-MM-DD) or RFC3339 timestamp"},
+		{"primer>=4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1", "", "", nil, "filter 'primer' only supports '='"},
+		{"primer=abc", "", "", nil, "filter 'primer' must be a uuid"},
+		{"title", "", "", nil, "filter 'title' needs a value"},
+	}
+
+	for i, c := range cases {
+		q, err := ParseListQuery(c.raw, listQueryTestFields, "-created")
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: '%s', got: '%v'", i, c.err, err)
+			}
+			if _, ok := err.(*ListQueryError); err != nil && !ok {
+				t.Errorf("case %d expected a ListQueryError, got: %T", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+
+		where, orderBy, args := q.SQL(2)
+		if where != c.where {
+			t.Errorf("case %d where mismatch. expected: '%s', got: '%s'", i, c.where, where)
+		}
+		if orderBy != c.orderBy {
+			t.Errorf("case %d order by mismatch. expected: '%s', got: '%s'", i, c.orderBy, orderBy)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("case %d args mismatch. expected: %v, got: %v", i, c.args, args)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// media types for PATCH request bodies
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// PatchError is returned when a patch can't be applied to a document, eg:
+// it names a path that doesn't exist or a test operation fails. It should
+// be reported to clients as a 409 Conflict
+type PatchError struct {
+	Message string
+}
+
+func (e *PatchError) Error() string {
+	return e.Message
+}
+
+func patchErrorf(format string, args ...interface{}) error {
+	return &PatchError{Message: fmt.Sprintf(format, args...)}
+}
+
+// MergePatch applies an RFC 7396 JSON merge patch to a decoded JSON
+// document, returning the result. Objects in patch are merged into doc
+// recursively, null values remove keys & any other value replaces what's in
+// doc. doc may be modified
+func MergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = map[string]interface{}{}
+	}
+	for key, val := range p {
+		if val == nil {
+			delete(d, key)
+		} else {
+			d[key] = MergePatch(d[key], val)
+		}
+	}
+	return d
+}
+
+// PatchOp is a single RFC 6902 JSON patch operation
+type PatchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// UnmarshalJSON decodes an operation, keeping a "value" of null. without
+// this null & a missing value both decode to a nil Value
+func (op *PatchOp) UnmarshalJSON(data []byte) error {
+	type patchOp PatchOp
+	if err := json.Unmarshal(data, (*patchOp)(op)); err != nil {
+		return err
+	}
+	if op.Value == nil {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		if v, ok := fields["value"]; ok {
+			op.Value = &v
+		}
+	}
+	return nil
+}
+
+// ParseJSONPatch reads an RFC 6902 JSON patch document, checking each
+// operation is well formed
+func ParseJSONPatch(data []byte) ([]PatchOp, error) {
+	ops := []PatchOp{}
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("json patch must be an array of operations: %s", err)
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: '%s' requires a value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: invalid from: %s", i, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op '%s'", i, op.Op)
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: invalid path: %s", i, err)
+		}
+	}
+	return ops, nil
+}
+
+// JSONPatch applies RFC 6902 operations to a decoded JSON document in
+// order, returning the result. If any operation fails the whole patch fails
+// with a *PatchError. doc may be modified
+func JSONPatch(doc interface{}, ops []PatchOp) (interface{}, error) {
+	var err error
+	for i, op := range ops {
+		if doc, err = applyPatchOp(doc, op); err != nil {
+			return nil, patchErrorf("operation %d (%s %s): %s", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOp(doc interface{}, op PatchOp) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	var value interface{}
+	if op.Value != nil {
+		if err := json.Unmarshal(*op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err := pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		doc, val, err := pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, val)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		val, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// copies musn't share nested values with the original
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		var dup interface{}
+		if err := json.Unmarshal(data, &dup); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, dup)
+	case "test":
+		val, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(val, value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op")
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped tokens
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("json pointer must start with '/': %s", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token. "-" refers to the end of the
+// array, & is only valid when allowEnd is true
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index: %s", token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index out of range: %s", token)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch t := doc.(type) {
+		case map[string]interface{}:
+			val, ok := t[token]
+			if !ok {
+				return nil, fmt.Errorf("path doesn't exist")
+			}
+			doc = val
+		case []interface{}:
+			i, err := arrayIndex(token, len(t), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = t[i]
+		default:
+			return nil, fmt.Errorf("path doesn't exist")
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at path, returning the updated document
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch t := parent.(type) {
+	case map[string]interface{}:
+		t[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(t), true)
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, 0, len(t)+1)
+		arr = append(append(append(arr, t[:i]...), value), t[i:]...)
+		return pointerSet(doc, path[:len(path)-1], arr)
+	default:
+		return nil, fmt.Errorf("path doesn't exist")
+	}
+}
+
+// pointerSet replaces the value at path, which must exist, returning the
+// updated document. arrays are rebuilt when they change length, this puts
+// the new one where the old one was
+func pointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch t := parent.(type) {
+	case map[string]interface{}:
+		t[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(t), false)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = value
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("path doesn't exist")
+	}
+}
+
+// pointerRemove removes the value at path, returning the updated document &
+// the removed value
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch t := parent.(type) {
+	case map[string]interface{}:
+		val, ok := t[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path doesn't exist")
+		}
+		delete(t, last)
+		return doc, val, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(t), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		val := t[i]
+		arr := append(append(make([]interface{}, 0, len(t)-1), t[:i]...), t[i+1:]...)
+		doc, err = pointerSet(doc, path[:len(path)-1], arr)
+		return doc, val, err
+	default:
+		return nil, nil, fmt.Errorf("path doesn't exist")
+	}
+}
@@ -0,0 +1,146 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396 appendix A
+	cases := []struct {
+		doc, patch, expect string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for i, c := range cases {
+		got := MergePatch(decode(t, c.doc), decode(t, c.patch))
+		if s := encode(t, got); s != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, s)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	cases := []struct {
+		doc, patch, expect string
+		conflict           bool
+	}{
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, false},
+		{`{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`, false},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`, false},
+		{`{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`, false},
+		{`{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`, false},
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":"x"}]`, `{"a":"x"}`, false},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a/b","path":"/c"}]`, `{"a":{},"c":1}`, false},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`, false},
+		{`{"a/b":1,"c~d":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/c~0d","value":3}]`, `{"c~d":3}`, false},
+		{`{"a":[1,{"b":"c"}]}`, `[{"op":"test","path":"/a","value":[1,{"b":"c"}]}]`, `{"a":[1,{"b":"c"}]}`, false},
+		{`{"a":1}`, `[]`, `{"a":1}`, false},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`, false},
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":null}]`, `{"a":null}`, false},
+		{`{"a":null}`, `[{"op":"test","path":"/a","value":null}]`, `{"a":null}`, false},
+		{`{"a":[[1,2],[3]]}`, `[{"op":"add","path":"/a/0/1","value":9}]`, `{"a":[[1,9,2],[3]]}`, false},
+		{`{"a":[[1,2],[3]]}`, `[{"op":"remove","path":"/a/0/0"}]`, `{"a":[[2],[3]]}`, false},
+		{`{"a":[[1,2],[3]]}`, `[{"op":"replace","path":"/a/0/0","value":7}]`, `{"a":[[7,2],[3]]}`, false},
+		{`{"a":[[1,2],[3]]}`, `[{"op":"move","from":"/a/0/0","path":"/a/1/-"}]`, `{"a":[[2],[3,1]]}`, false},
+		{`[[[1]]]`, `[{"op":"add","path":"/0/0/0","value":0}]`, `[[[0,1]]]`, false},
+
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":2}]`, "", true},
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":null}]`, "", true},
+		{`{"a":1}`, `[{"op":"remove","path":"/b"}]`, "", true},
+		{`{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, "", true},
+		{`{"a":1}`, `[{"op":"add","path":"/b/c","value":2}]`, "", true},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/2","value":2}]`, "", true},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/-"}]`, "", true},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/01"}]`, "", true},
+		// a failed operation fails the whole patch
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":2}]`, "", true},
+	}
+
+	for i, c := range cases {
+		ops, err := ParseJSONPatch([]byte(c.patch))
+		if err != nil {
+			t.Errorf("case %d unexpected parse error: %s", i, err)
+			continue
+		}
+		got, err := JSONPatch(decode(t, c.doc), ops)
+		if c.conflict {
+			if _, ok := err.(*PatchError); !ok {
+				t.Errorf("case %d expected a PatchError, got: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if s := encode(t, got); s != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, s)
+		}
+	}
+}
+
+func TestJSONPatchCopiesArrays(t *testing.T) {
+	// spare capacity lets append write into the original's backing array
+	orig := make([]interface{}, 2, 4)
+	orig[0], orig[1] = 1.0, 2.0
+	doc := map[string]interface{}{"a": orig}
+	ops, err := ParseJSONPatch([]byte(`[{"op":"add","path":"/a/0","value":0}]`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := JSONPatch(doc, ops)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := encode(t, got); s != `{"a":[0,1,2]}` {
+		t.Errorf("patched mismatch. expected: {\"a\":[0,1,2]}, got: %s", s)
+	}
+	if s := encode(t, orig); s != `[1,2]` {
+		t.Errorf("expected the original array to be untouched, got: %s", s)
+	}
+}
+
+func TestParseJSONPatch(t *testing.T) {
+	cases := []string{
+		`{"op":"add","path":"/a","value":1}`,
+		`[{"op":"nope","path":"/a"}]`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"remove","path":"a"}]`,
+		`[{"op":"move","from":"a","path":"/b"}]`,
+	}
+	for i, c := range cases {
+		if _, err := ParseJSONPatch([]byte(c)); err == nil {
+			t.Errorf("case %d expected an error", i)
+		}
+	}
+}
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err.Error())
+	}
+	return v
+}
+
+func encode(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return string(data)
+}
@@ -6,13 +6,25 @@ import (
 )
 
 func WriteResponse(w http.ResponseWriter, data interface{}) error {
-	env := map[string]interface{}{
+	return jsonResponse(w, responseEnvelope(data))
+}
+
+func responseEnvelope(data interface{}) map[string]interface{} {
+	return map[string]interface{}{
 		"meta": map[string]interface{}{
 			"code": http.StatusOK,
 		},
 		"data": data,
 	}
-	return jsonResponse(w, env)
+}
+
+// ResponseETag is the ETag of the body WriteResponse writes for data
+func ResponseETag(data interface{}) (string, error) {
+	res, err := json.Marshal(responseEnvelope(data))
+	if err != nil {
+		return "", err
+	}
+	return ETag(res), nil
 }
 
 func WritePageResponse(w http.ResponseWriter, data interface{}, r *http.Request, p Page) error {
@@ -64,6 +76,29 @@ func WriteErrResponse(w http.ResponseWriter, code int, err error) error {
 	return err
 }
 
+// WriteErrDataResponse writes an error response that also carries data, eg:
+// the current version of a resource a client failed to update
+func WriteErrDataResponse(w http.ResponseWriter, code int, err error, data interface{}) error {
+	env := map[string]interface{}{
+		"meta": map[string]interface{}{
+			"code":  code,
+			"error": err.Error(),
+		},
+		"data": data,
+	}
+
+	res, err := json.Marshal(env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(res)
+	return err
+}
+
 func jsonResponse(w http.ResponseWriter, env interface{}) error {
 	res, err := json.Marshal(env)
 	if err != nil {
@@ -0,0 +1,214 @@
+package apiutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Router dispatches requests by method & path pattern. Patterns are paths
+// with {name} wildcard segments, optionally typed as {name:int} or
+// {name:uuid}. A segment that doesn't match a wildcard's type doesn't match
+// the pattern. When more than one pattern matches a path, the one with
+// literal segments earliest wins, so "/primers/tree" beats "/primers/{id}".
+//
+// Requests for a known path with an unregistered method get a 405 with an
+// Allow header. OPTIONS requests for known paths are answered by
+// the Options handler
+type Router struct {
+	// NotFound handles requests that don't match any pattern
+	NotFound http.Handler
+	// Options handles OPTIONS requests for known paths, after the Allow
+	// header has been set. if nil, OPTIONS responds with an empty 200
+	Options http.Handler
+
+	patterns []*pattern
+}
+
+// NewRouter allocates a Router
+func NewRouter() *Router {
+	return &Router{}
+}
+
+type pattern struct {
+	raw      string
+	segments []segment
+	handlers map[string]http.Handler
+}
+
+type segment struct {
+	literal string
+	param   string
+	typ     string
+}
+
+var paramTypes = map[string]*regexp.Regexp{
+	"":       regexp.MustCompile(`.`),
+	"string": regexp.MustCompile(`.`),
+	"int":    regexp.MustCompile(`^-?\d+$`),
+	"uuid":   regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+}
+
+// Handle registers a handler for a method & pattern, panicking if the
+// pattern is invalid or already has a handler for method
+func (rt *Router) Handle(method, path string, h http.Handler) {
+	path = "/" + strings.Trim(path, "/")
+	p := rt.find(path)
+	if p == nil {
+		var err error
+		if p, err = parsePattern(path); err != nil {
+			panic(err)
+		}
+		rt.patterns = append(rt.patterns, p)
+	}
+	if _, ok := p.handlers[method]; ok {
+		panic(fmt.Errorf("duplicate route: %s %s", method, path))
+	}
+	p.handlers[method] = h
+}
+
+// HandleFunc registers a handler func for a method & pattern
+func (rt *Router) HandleFunc(method, path string, h http.HandlerFunc) {
+	rt.Handle(method, path, h)
+}
+
+func (rt *Router) find(path string) *pattern {
+	for _, p := range rt.patterns {
+		if p.raw == path {
+			return p
+		}
+	}
+	return nil
+}
+
+func parsePattern(path string) (*pattern, error) {
+	p := &pattern{raw: path, handlers: map[string]http.Handler{}}
+	for _, s := range splitPath(path) {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			name, typ := s[1:len(s)-1], ""
+			if i := strings.Index(name, ":"); i != -1 {
+				name, typ = name[:i], name[i+1:]
+			}
+			if _, ok := paramTypes[typ]; !ok || name == "" {
+				return nil, fmt.Errorf("invalid path parameter '%s' in route: %s", s, path)
+			}
+			p.segments = append(p.segments, segment{param: name, typ: typ})
+		} else {
+			p.segments = append(p.segments, segment{literal: s})
+		}
+	}
+	return p, nil
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// match checks segs against the pattern, returning path params
+func (p *pattern) match(segs []string) (map[string]string, bool) {
+	if len(segs) != len(p.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, s := range p.segments {
+		if s.param == "" {
+			if s.literal != segs[i] {
+				return nil, false
+			}
+			continue
+		}
+		if !paramTypes[s.typ].MatchString(segs[i]) {
+			return nil, false
+		}
+		params[s.param] = segs[i]
+	}
+	return params, true
+}
+
+// moreSpecific reports whether p should win over other when both match
+func (p *pattern) moreSpecific(other *pattern) bool {
+	for i, s := range p.segments {
+		if (s.param == "") != (other.segments[i].param == "") {
+			return s.param == ""
+		}
+	}
+	return false
+}
+
+// allowed lists the methods registered for a pattern, plus OPTIONS
+func (p *pattern) allowed() string {
+	methods := []string{"OPTIONS"}
+	for m := range p.handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// ServeHTTP implements the http.Handler interface
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := splitPath(r.URL.Path)
+
+	var (
+		best   *pattern
+		params map[string]string
+	)
+	for _, p := range rt.patterns {
+		if ps, ok := p.match(segs); ok && (best == nil || p.moreSpecific(best)) {
+			best, params = p, ps
+		}
+	}
+
+	if best == nil {
+		if rt.NotFound != nil {
+			rt.NotFound.ServeHTTP(w, r)
+		} else {
+			WriteErrResponse(w, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+		return
+	}
+
+	h, ok := best.handlers[r.Method]
+	if !ok {
+		w.Header().Set("Allow", best.allowed())
+		if r.Method == "OPTIONS" {
+			if rt.Options != nil {
+				rt.Options.ServeHTTP(w, r)
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+		WriteErrResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if len(params) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey, params))
+	}
+	h.ServeHTTP(w, r)
+}
+
+type ctxKey string
+
+const pathParamsKey = ctxKey("pathParams")
+
+// PathParam returns the value of a path parameter matched by Router, ""
+// if it isn't set
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey).(map[string]string)
+	return params[name]
+}
+
+// PathParamInt returns a path parameter as an int
+func PathParamInt(r *http.Request, name string) (int, error) {
+	return strconv.Atoi(PathParam(r, name))
+}
@@ -0,0 +1,67 @@
+package apiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name + ":" + PathParam(req, "id") + PathParam(req, "n")))
+		}
+	}
+	r.HandleFunc("GET", "/things", handler("list"))
+	r.HandleFunc("POST", "/things", handler("create"))
+	r.HandleFunc("GET", "/things/{id}", handler("get"))
+	r.HandleFunc("GET", "/things/special", handler("special"))
+	r.HandleFunc("GET", "/things/{id}/parts/{n:int}", handler("part"))
+	r.HandleFunc("GET", "/uuids/{id:uuid}", handler("uuid"))
+
+	cases := []struct {
+		method, path string
+		code         int
+		body, allow  string
+	}{
+		{"GET", "/things", 200, "list:", ""},
+		{"GET", "/things/", 200, "list:", ""},
+		{"POST", "/things", 200, "create:", ""},
+		{"DELETE", "/things", 405, "", "GET, OPTIONS, POST"},
+		{"OPTIONS", "/things", 200, "", "GET, OPTIONS, POST"},
+		{"GET", "/things/a", 200, "get:a", ""},
+		{"GET", "/things/special", 200, "special:", ""},
+		{"GET", "/things/a/parts/2", 200, "part:a2", ""},
+		{"GET", "/things/a/parts/b", 404, "", ""},
+		{"GET", "/uuids/4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1", 200, "uuid:4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1", ""},
+		{"GET", "/uuids/nope", 404, "", ""},
+		{"GET", "/nope", 404, "", ""},
+	}
+
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("case %d status mismatch. expected: %d, got: %d", i, c.code, w.Code)
+			continue
+		}
+		if c.code == 200 && w.Body.String() != c.body {
+			t.Errorf("case %d body mismatch. expected: '%s', got: '%s'", i, c.body, w.Body.String())
+		}
+		if got := w.Header().Get("Allow"); got != c.allow {
+			t.Errorf("case %d Allow mismatch. expected: '%s', got: '%s'", i, c.allow, got)
+		}
+	}
+}
+
+func TestRouterDuplicateRoute(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a duplicate route to panic")
+		}
+	}()
+	r := NewRouter()
+	r.HandleFunc("GET", "/things", func(w http.ResponseWriter, req *http.Request) {})
+	r.HandleFunc("GET", "/things/", func(w http.ResponseWriter, req *http.Request) {})
+}
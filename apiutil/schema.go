@@ -0,0 +1,316 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of JSON Schema used by OpenAPI 2.0 (swagger) documents
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	// swagger 2.0 has no way to express null, x-nullable is a widely-used extension
+	Nullable bool `json:"x-nullable,omitempty"`
+}
+
+// SchemaBuilder generates schemas from go types by reflection, following
+// the same rules encoding/json uses to encode values. Named struct types
+// are added to Definitions & referenced with "$ref"
+type SchemaBuilder struct {
+	Definitions map[string]*Schema
+	// Overrides sets the schema for types that implement json.Marshaler,
+	// which can't be inferred by reflection
+	Overrides map[reflect.Type]*Schema
+}
+
+// NewSchemaBuilder allocates a SchemaBuilder
+func NewSchemaBuilder() *SchemaBuilder {
+	return &SchemaBuilder{
+		Definitions: map[string]*Schema{},
+		Overrides:   map[reflect.Type]*Schema{},
+	}
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// SchemaFor returns a schema describing the JSON encoding of v
+func (b *SchemaBuilder) SchemaFor(v interface{}) *Schema {
+	return b.schemaForType(reflect.TypeOf(v))
+}
+
+func (b *SchemaBuilder) schemaForType(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+	if s, ok := b.Overrides[t]; ok {
+		return s
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() != reflect.Ptr && t.Implements(marshalerType):
+		// custom encodings can be anything
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := *b.schemaForType(t.Elem())
+		s.Nullable = true
+		return &s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte", Nullable: t.Kind() == reflect.Slice}
+		}
+		return &Schema{Type: "array", Items: b.schemaForType(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schemaForType(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := b.Definitions[name]; !ok {
+			// add a placeholder before recursing so self-referencing types terminate
+			b.Definitions[name] = &Schema{}
+			*b.Definitions[name] = *b.structSchema(t)
+		}
+		return &Schema{Ref: "#/definitions/" + name}
+	default:
+		// interfaces, funcs, channels, etc. accept anything
+		return &Schema{}
+	}
+}
+
+// Define adds a definition for the fields of struct value v under name,
+// ignoring any custom JSON encoding v's type has, and returns a reference
+// to it. Combine with Overrides to document types that implement
+// json.Marshaler
+func (b *SchemaBuilder) Define(name string, v interface{}) *Schema {
+	b.Definitions[name] = &Schema{}
+	*b.Definitions[name] = *b.structSchema(reflect.TypeOf(v))
+	return &Schema{Ref: "#/definitions/" + name}
+}
+
+// structSchema builds an object schema from a struct's exported fields
+func (b *SchemaBuilder) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, f := range jsonFields(t) {
+		fs := b.schemaForType(f.typ)
+		if f.asString {
+			fs = &Schema{Type: "string"}
+		}
+		s.Properties[f.name] = fs
+	}
+	return s
+}
+
+type jsonField struct {
+	name     string
+	typ      reflect.Type
+	asString bool
+}
+
+// jsonFields lists the fields encoding/json would encode for struct type t,
+// flattening embedded structs. Like encoding/json, fields with conflicting
+// names at the same depth are dropped
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx != -1 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		f := jsonField{name: name, typ: sf.Type}
+		if name == "" {
+			f.name = sf.Name
+		}
+		for _, o := range strings.Split(opts, ",") {
+			if o == "string" {
+				f.asString = true
+			}
+		}
+		fields = append(fields, f)
+	}
+
+	counts := map[string]int{}
+	for _, f := range fields {
+		counts[f.name]++
+	}
+	deduped := fields[:0]
+	for _, f := range fields {
+		if counts[f.name] == 1 {
+			deduped = append(deduped, f)
+		}
+	}
+	return deduped
+}
+
+// Resolve follows a "$ref" to its definition, returning s unchanged if it
+// isn't a reference
+func (b *SchemaBuilder) Resolve(s *Schema) (*Schema, error) {
+	if s.Ref == "" {
+		return s, nil
+	}
+	name := strings.TrimPrefix(s.Ref, "#/definitions/")
+	def, ok := b.Definitions[name]
+	if !ok {
+		return nil, fmt.Errorf("undefined schema reference: %s", s.Ref)
+	}
+	return def, nil
+}
+
+// Validate checks a decoded JSON value (as produced by json.Unmarshal into
+// an interface{}) against a schema, returning a list of violations
+func (b *SchemaBuilder) Validate(s *Schema, v interface{}, path string) (errs []error) {
+	nullable := s.Nullable
+	s, err := b.Resolve(s)
+	if err != nil {
+		return []error{err}
+	}
+
+	if v == nil {
+		if nullable || s.Nullable || s.Type == "" {
+			return nil
+		}
+		return []error{fmt.Errorf("%s: expected %s, got null", pathName(path), s.Type)}
+	}
+
+	switch s.Type {
+	case "":
+		return nil
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []error{typeError(path, s.Type, v)}
+		}
+		for _, req := range s.Required {
+			if _, ok := obj[req]; !ok {
+				errs = append(errs, fmt.Errorf("%s: missing required property", pathName(path+"."+req)))
+			}
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if ps, ok := s.Properties[key]; ok {
+				errs = append(errs, b.Validate(ps, obj[key], path+"."+key)...)
+			} else if s.AdditionalProperties != nil {
+				errs = append(errs, b.Validate(s.AdditionalProperties, obj[key], path+"."+key)...)
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return []error{typeError(path, s.Type, v)}
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				errs = append(errs, b.Validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return []error{typeError(path, s.Type, v)}
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid date-time: %s", pathName(path), str))
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return []error{typeError(path, s.Type, v)}
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return []error{typeError(path, s.Type, v)}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []error{typeError(path, s.Type, v)}
+		}
+	}
+	return errs
+}
+
+func typeError(path, expect string, got interface{}) error {
+	return fmt.Errorf("%s: expected %s, got %s", pathName(path), expect, jsonTypeName(got))
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+// jsonTypeName gives the JSON type of a decoded value
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
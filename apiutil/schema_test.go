@@ -0,0 +1,84 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type schemaTestThing struct {
+	Id       string             `json:"id"`
+	Created  time.Time          `json:"created"`
+	Count    int                `json:"count,omitempty"`
+	Parent   *schemaTestThing   `json:"parent"`
+	Tags     []string           `json:"tags"`
+	Meta     map[string]float64 `json:"meta"`
+	Skipped  string             `json:"-"`
+	Untagged bool
+	private  string
+}
+
+func TestSchemaFor(t *testing.T) {
+	b := NewSchemaBuilder()
+	s := b.SchemaFor(schemaTestThing{})
+	if s.Ref != "#/definitions/schemaTestThing" {
+		t.Fatalf("expected a reference, got: %#v", s)
+	}
+
+	def := b.Definitions["schemaTestThing"]
+	expect := map[string]string{
+		"id":       "string",
+		"created":  "string",
+		"count":    "integer",
+		"parent":   "",
+		"tags":     "array",
+		"meta":     "object",
+		"Untagged": "boolean",
+	}
+	if len(def.Properties) != len(expect) {
+		t.Errorf("property count mismatch. expected: %d, got: %d", len(expect), len(def.Properties))
+	}
+	for name, typ := range expect {
+		p := def.Properties[name]
+		if p == nil {
+			t.Errorf("missing property: %s", name)
+			continue
+		}
+		if p.Type != typ {
+			t.Errorf("property %s type mismatch. expected: '%s', got: '%s'", name, typ, p.Type)
+		}
+	}
+	if def.Properties["parent"].Ref != "#/definitions/schemaTestThing" || !def.Properties["parent"].Nullable {
+		t.Errorf("expected parent to be a nullable self-reference, got: %#v", def.Properties["parent"])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	b := NewSchemaBuilder()
+	s := b.SchemaFor(schemaTestThing{})
+
+	cases := []struct {
+		json string
+		errs int
+	}{
+		{`{"id":"a","created":"2017-01-01T00:00:00Z","tags":["a"],"meta":{"b":1.5},"parent":null}`, 0},
+		{`{"id":"a","parent":{"id":"b","parent":{"id":"c"}}}`, 0},
+		{`{"unknown":true}`, 0},
+		{`{"id":5}`, 1},
+		{`{"created":"yesterday"}`, 1},
+		{`{"count":1.5,"tags":[1]}`, 2},
+		{`{"parent":{"meta":{"a":"b"}}}`, 1},
+		{`[]`, 1},
+	}
+
+	for i, c := range cases {
+		var v interface{}
+		if err := json.Unmarshal([]byte(c.json), &v); err != nil {
+			t.Fatal(err.Error())
+		}
+		errs := b.Validate(s, v, "")
+		if len(errs) != c.errs {
+			t.Errorf("case %d error count mismatch. expected: %d, got: %d: %v", i, c.errs, len(errs), errs)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package apiutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// codes for FieldErrors, so clients can handle problems without parsing
+// messages
+const (
+	CodeInvalid      = "invalid"
+	CodeRequired     = "required"
+	CodeTooLong      = "too_long"
+	CodeTooMany      = "too_many"
+	CodeInvalidURL   = "invalid_url"
+	CodeInvalidEmail = "invalid_email"
+	CodeInvalidUUID  = "invalid_uuid"
+	CodeInvalidType  = "invalid_type"
+	CodeUnknownField = "unknown_field"
+	CodeNotFound     = "not_found"
+	CodeReused       = "reused"
+)
+
+// ErrBodyTooLarge is returned by DecodeBody for bodies over the size limit,
+// & should be reported to clients as a 413
+var ErrBodyTooLarge = fmt.Errorf("request body is too large")
+
+// FieldError is a single problem with a field of a request body. Field is
+// the field's json path, eg: primer.id
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem with a request body, & should be
+// reported to clients as a 422 with WriteValidationErrResponse
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "invalid request body: " + strings.Join(msgs, ", ")
+}
+
+// Validator collects FieldErrors. Checks other than Required skip empty
+// values, so optional fields only need checking when they're set
+type Validator struct {
+	errs []*FieldError
+}
+
+// Add records a problem with a field
+func (v *Validator) Add(field, code, message string) {
+	v.errs = append(v.errs, &FieldError{Field: field, Code: code, Message: message})
+}
+
+// Required checks a value isn't empty, reporting whether it's set
+func (v *Validator) Required(field, val string) bool {
+	if strings.TrimSpace(val) == "" {
+		v.Add(field, CodeRequired, "is required")
+		return false
+	}
+	return true
+}
+
+// MaxLength caps the number of characters in a value
+func (v *Validator) MaxLength(field, val string, max int) {
+	if utf8.RuneCountInString(val) > max {
+		v.Add(field, CodeTooLong, fmt.Sprintf("must be at most %d characters", max))
+	}
+}
+
+// AbsoluteURL checks a value is an absolute http or https url
+func (v *Validator) AbsoluteURL(field, val string) {
+	if val == "" {
+		return
+	}
+	u, err := url.Parse(val)
+	if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		v.Add(field, CodeInvalidURL, "must be an absolute http or https url")
+	}
+}
+
+// Email checks a value is a bare email address, eg: a@b.com
+func (v *Validator) Email(field, val string) {
+	if val == "" {
+		return
+	}
+	addr, err := mail.ParseAddress(val)
+	if err != nil || addr.Address != val || !strings.Contains(val[strings.LastIndex(val, "@"):], ".") {
+		v.Add(field, CodeInvalidEmail, "must be an email address")
+	}
+}
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsUUID checks if s is a uuid
+func IsUUID(s string) bool {
+	return uuidRegex.MatchString(s)
+}
+
+// UUID checks a value is a uuid, reporting whether it is so callers know if
+// it's worth looking up
+func (v *Validator) UUID(field, val string) bool {
+	if val == "" {
+		return false
+	}
+	if !IsUUID(val) {
+		v.Add(field, CodeInvalidUUID, "must be a uuid")
+		return false
+	}
+	return true
+}
+
+// Err returns a *ValidationError if any problems were found, nil otherwise
+func (v *Validator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errs}
+}
+
+// DecodeBody strictly decodes a JSON request body of at most maxBytes into
+// v. Bodies over the limit return ErrBodyTooLarge, see DecodeStrict for the
+// rest
+func DecodeBody(w http.ResponseWriter, r *http.Request, v interface{}, maxBytes int64) error {
+	err := DecodeStrict(http.MaxBytesReader(w, r.Body, maxBytes), v)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return ErrBodyTooLarge
+	}
+	return err
+}
+
+// DecodeStrict decodes a single JSON value into v. Fields v doesn't have &
+// values of the wrong type return a *ValidationError, any other error means
+// the input isn't a JSON value
+func DecodeStrict(rd io.Reader, v interface{}) error {
+	dec := json.NewDecoder(rd)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return err
+		}
+		return fmt.Errorf("body must be a single JSON value")
+	}
+	return nil
+}
+
+// decodeError turns json decoding errors that are about fields rather than
+// syntax into a *ValidationError
+func decodeError(err error) error {
+	if te, ok := err.(*json.UnmarshalTypeError); ok {
+		field := te.Field
+		if field == "" {
+			field = "(root)"
+		}
+		return &ValidationError{Errors: []*FieldError{
+			{Field: field, Code: CodeInvalidType, Message: fmt.Sprintf("expected %s, got %s", te.Type, te.Value)},
+		}}
+	}
+	// encoding/json doesn't have a type for unknown field errors
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		field := strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+		return &ValidationError{Errors: []*FieldError{
+			{Field: field, Code: CodeUnknownField, Message: "isn't a field of this resource"},
+		}}
+	}
+	return err
+}
+
+// WriteValidationErrResponse writes a 422 error response listing each field
+// error under "errors"
+func WriteValidationErrResponse(w http.ResponseWriter, err *ValidationError) error {
+	env := map[string]interface{}{
+		"meta": map[string]interface{}{
+			"code":  http.StatusUnprocessableEntity,
+			"error": err.Error(),
+		},
+		"errors": err.Errors,
+	}
+
+	res, e := json.Marshal(env)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return e
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_, e = w.Write(res)
+	return e
+}
@@ -0,0 +1,108 @@
+package apiutil
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidator(t *testing.T) {
+	v := &Validator{}
+	v.Required("a", "")
+	v.Required("b", "b")
+	v.MaxLength("c", "ccc", 2)
+	v.MaxLength("d", "ééé", 3)
+	v.AbsoluteURL("e", "/relative")
+	v.AbsoluteURL("f", "ftp://example.com")
+	v.AbsoluteURL("g", "https://example.com/path")
+	v.AbsoluteURL("h", "")
+	v.Email("i", "Name <a@b.com>")
+	v.Email("j", "a@b")
+	v.Email("k", "a@b.com")
+	v.UUID("l", "nope")
+	v.UUID("m", "55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e")
+
+	expect := []struct{ field, code string }{
+		{"a", CodeRequired},
+		{"c", CodeTooLong},
+		{"e", CodeInvalidURL},
+		{"f", CodeInvalidURL},
+		{"i", CodeInvalidEmail},
+		{"j", CodeInvalidEmail},
+		{"l", CodeInvalidUUID},
+	}
+
+	err, ok := v.Err().(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got: %v", v.Err())
+	}
+	if len(err.Errors) != len(expect) {
+		t.Fatalf("error count mismatch. expected: %d, got: %d: %s", len(expect), len(err.Errors), err)
+	}
+	for i, e := range expect {
+		if got := err.Errors[i]; got.Field != e.field || got.Code != e.code {
+			t.Errorf("error %d mismatch. expected: %s %s, got: %s %s", i, e.field, e.code, got.Field, got.Code)
+		}
+	}
+
+	if err := (&Validator{}).Err(); err != nil {
+		t.Errorf("expected no error for an empty validator, got: %s", err)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	type model struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+		Inner struct {
+			On bool `json:"on"`
+		} `json:"inner"`
+	}
+
+	cases := []struct {
+		body       string
+		field      string
+		code       string
+		tooLarge   bool
+		otherError bool
+	}{
+		{`{"name":"a","count":1,"inner":{"on":true}}`, "", "", false, false},
+		{`{"nope":1}`, "nope", CodeUnknownField, false, false},
+		{`{"count":"1"}`, "count", CodeInvalidType, false, false},
+		{`{"inner":{"on":"yes"}}`, "inner.on", CodeInvalidType, false, false},
+		{`[]`, "(root)", CodeInvalidType, false, false},
+		{`{"name":"` + strings.Repeat("a", 100) + `"}`, "", "", true, false},
+		{`{"name":`, "", "", false, true},
+		{`{} {}`, "", "", false, true},
+	}
+
+	for i, c := range cases {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		err := DecodeBody(w, r, &model{}, 64)
+
+		switch {
+		case c.tooLarge:
+			if err != ErrBodyTooLarge {
+				t.Errorf("case %d expected ErrBodyTooLarge, got: %v", i, err)
+			}
+		case c.otherError:
+			if _, ok := err.(*ValidationError); err == nil || ok {
+				t.Errorf("case %d expected a non-validation error, got: %v", i, err)
+			}
+		case c.code != "":
+			ve, ok := err.(*ValidationError)
+			if !ok {
+				t.Errorf("case %d expected a ValidationError, got: %v", i, err)
+				continue
+			}
+			if got := ve.Errors[0]; got.Field != c.field || got.Code != c.code {
+				t.Errorf("case %d mismatch. expected: %s %s, got: %s %s", i, c.field, c.code, got.Field, got.Code)
+			}
+		default:
+			if err != nil {
+				t.Errorf("case %d unexpected error: %s", i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// embeddedAssets bundles everything the server reads from disk into the
+// binary, so it can be deployed without a copy of the source tree
+//
+//go:embed sql/schema.sql sql/migrations/*.sql docs
+var embeddedAssets embed.FS
+
+// assets returns the filesystem sql & docs are read from.
+// if cfg.AssetsDir is set, files are read from that directory instead of
+// the copy embedded in the binary. Pointing ASSETS_DIR at a checkout of this
+// repo during development means edits show up without a rebuild
+func assets() fs.FS {
+	if cfg != nil && cfg.AssetsDir != "" {
+		return os.DirFS(cfg.AssetsDir)
+	}
+	return embeddedAssets
+}
+
+// assetsSub returns a subdirectory of assets, panicking if dir is an
+// invalid path, which can only happen when dir is a bad constant
+func assetsSub(dir string) fs.FS {
+	sub, err := fs.Sub(assets(), dir)
+	if err != nil {
+		panic(fmt.Errorf("invalid assets directory '%s': %s", dir, err))
+	}
+	return sub
+}
+
+// DocsHandler serves the static api documentation site
+func DocsHandler() http.Handler {
+	return http.StripPrefix("/docs/", http.FileServer(http.FS(assetsSub("docs"))))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// audit event actions
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+// auditModels are the models audited resources are stored as, by resource
+// kind. used to read snapshots of a resource inside a write's transaction
+var auditModels = map[string]sql_datastore.Model{
+	"primers":      &core.Primer{},
+	"sources":      &core.Source{},
+	"collections":  &core.Collection{},
+	"uncrawlables": &core.Uncrawlable{},
+	"customcrawls": &core.CustomCrawl{},
+}
+
+// AuditEvent records a single change made through the api
+type AuditEvent struct {
+	Id      int64     `json:"id"`
+	Created time.Time `json:"created"`
+	// ActorId is the identity service id of the user who made the change,
+	// empty for anonymous requests
+	ActorId string `json:"actorId"`
+	// ActorName is the user's username, or the ip of anonymous requests
+	ActorName    string `json:"actorName"`
+	Ip           string `json:"ip"`
+	ResourceType string `json:"resourceType"`
+	ResourceId   string `json:"resourceId"`
+	// Action is one of create, update, delete, restore or purge
+	Action string `json:"action"`
+	// Diff lists changed fields of the resource
+	Diff map[string]*apiutil.Change `json:"diff"`
+}
+
+// UnmarshalSQL reads an audit event from a row of auditEventsResource
+func (e *AuditEvent) UnmarshalSQL(row sqlutil.Scannable) error {
+	var diff []byte
+	if err := row.Scan(&e.Id, &e.Created, &e.ActorId, &e.ActorName, &e.Ip,
+		&e.ResourceType, &e.ResourceId, &e.Action, &diff); err != nil {
+		return err
+	}
+	if diff == nil {
+		return nil
+	}
+	return json.Unmarshal(diff, &e.Diff)
+}
+
+// auditSnapshot reads the stored version of a resource inside ts, nil if
+// it doesn't exist
+func auditSnapshot(ts txStore, kind, id string) (interface{}, error) {
+	m, ok := auditModels[kind]
+	if !ok || id == "" {
+		return nil, nil
+	}
+	v, err := ts.Get(datastore.NewKey(fmt.Sprintf("%s:%s", m.DatastoreType(), id)))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// recordAudit writes an audit event for a change made by r inside tx, with
+// a diff of the resource before & after the change
+func recordAudit(tx sqlutil.Execable, r *http.Request, action, kind, id string, before, after interface{}) error {
+	diff, err := apiutil.Diff(before, after)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	ip := getIP(r)
+	actorId, actorName := "", ip
+	if u := requestUser(r); u != nil {
+		actorId, actorName = u.Id, u.Username
+	}
+	_, err = tx.Exec(qAuditEventInsert, actorId, actorName, ip, kind, id, action, string(data))
+	return err
+}
+
+// ListAuditEventsHandler lists audit events, most recent first. admin only
+func ListAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, auditEventsResource) {
+		return
+	}
+	p := apiutil.PageFromRequest(r)
+	q, err := auditEventsResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
+	events := make([]*AuditEvent, 0, p.Size)
+	err = queryList(appDB, auditEventsResource, q, p.Limit(), p.Offset(), func(row sqlutil.Scannable) error {
+		e := &AuditEvent{}
+		if err := e.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, events, r, p)
+}
@@ -7,8 +7,14 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/datatogether/api/apiutil"
 )
 
+var errAdminRequired = fmt.Errorf("this endpoint is only available to admins, authenticate with an admin's api_token")
+
+var errSignInRequired = fmt.Errorf("this endpoint is only available to signed in users, authenticate with an api_token")
+
 // Proxied User model. The real user model is in github.com/datatogether/identity/user.go
 type User struct {
 	Id          string `json:"id" sql:"id"`
@@ -51,6 +57,50 @@ func requestAddUser(r *http.Request) (*http.Request, error) {
 	return r.WithContext(ctx), nil
 }
 
+// requestUser returns the user requestAddUser added to a request, nil if
+// there isn't one
+func requestUser(r *http.Request) *User {
+	u, _ := r.Context().Value("user").(*User)
+	return u
+}
+
+// isAdmin checks if a user is listed in cfg.AdminUsers
+func isAdmin(u *User) bool {
+	if u == nil || u.Anonymous || u.Id == "" {
+		return false
+	}
+	for _, id := range cfg.AdminUsers {
+		if u.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin wraps an admin route's handler, responding 403 to requests
+// that aren't from an admin. must run after requestAddUser
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(requestUser(r)) {
+			apiutil.WriteErrResponse(w, http.StatusForbidden, errAdminRequired)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// requireSignIn wraps a route's handler, responding 403 to anonymous
+// requests. must run after requestAddUser
+func requireSignIn(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u := requestUser(r); u == nil || u.Anonymous || u.Username == "" {
+			apiutil.WriteErrResponse(w, http.StatusForbidden, errSignInRequired)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func getIP(r *http.Request) string {
 	remoteAddr := r.Header.Get("x-forwarded-for")
 	if remoteAddr != "" {
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/lib/pq"
+)
+
+// maxBatchSize caps the number of keys or items in a batch request
+const maxBatchSize = 500
+
+var (
+	errBatchFailed          = fmt.Errorf("batch failed, no items were saved. see data for the result of each item")
+	errBatchUpdatedRequired = fmt.Errorf("this resource already exists, updating it in a batch requires the updated time it was last read with")
+)
+
+// BatchGetRequest lists the resources a batch get should read
+type BatchGetRequest struct {
+	Ids []string `json:"ids"`
+	// Urls looks resources up by url, only for resources with unique urls
+	Urls []string `json:"urls,omitempty"`
+}
+
+// BatchResult is the outcome for one item of a batch request. Results are
+// listed in the order items were requested
+type BatchResult struct {
+	// Key is the id or url that was looked up. for upserts it's the id of
+	// the item, empty for new items that weren't saved
+	Key string `json:"key"`
+	// Status is an http status code for the item
+	Status int                   `json:"status"`
+	Error  string                `json:"error,omitempty"`
+	Errors []*apiutil.FieldError `json:"errors,omitempty"`
+	Data   interface{}           `json:"data,omitempty"`
+}
+
+// writeBatchGet reads up to maxBatchSize resources by id, & by url if the
+// resource has unique urls, in a single query. Every key gets a result,
+// keys that don't match anything get a 404 result
+func writeBatchGet(w http.ResponseWriter, r *http.Request, res *resource) {
+	req := &BatchGetRequest{}
+	if !decodeBody(w, r, req) {
+		return
+	}
+	v := &apiutil.Validator{}
+	if len(req.Ids)+len(req.Urls) > maxBatchSize {
+		v.Add("ids", apiutil.CodeTooMany, fmt.Sprintf("batches are limited to %d keys", maxBatchSize))
+	}
+	if res.URL == nil && len(req.Urls) > 0 {
+		v.Add("urls", apiutil.CodeInvalid, fmt.Sprintf("%s can't be looked up by url", res.Name))
+	}
+	if err := v.Err(); err != nil {
+		writeBodyErr(w, err)
+		return
+	}
+
+	// ids are always uuids, anything else can't match
+	ids := []string{}
+	for _, id := range req.Ids {
+		if apiutil.IsUUID(id) {
+			ids = append(ids, id)
+		}
+	}
+	where := "id = ANY($1)"
+	args := []interface{}{pq.Array(ids)}
+	if res.URL != nil {
+		where = "(id = ANY($1) OR url = ANY($2))"
+		args = append(args, pq.Array(req.Urls))
+	}
+	if res.Where != "" {
+		where = res.Where + " AND " + where
+	}
+
+	rows, err := appDB.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s;", res.Columns, res.Table, where), args...)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	var (
+		models = []interface{}{}
+		byKey  = map[string]interface{}{}
+	)
+	for rows.Next() {
+		m, err := res.Scan(rows)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		models = append(models, m)
+		byKey["id:"+m.(sql_datastore.Model).GetId()] = m
+		if res.URL != nil {
+			byKey["url:"+res.URL(m)] = m
+		}
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	// expanding nothing gives results the same shape as GET
+	if res.Expand != nil {
+		if err := res.Expand(appDB, models, nil); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	results := make([]*BatchResult, 0, len(req.Ids)+len(req.Urls))
+	add := func(key, prefix string) {
+		if m, ok := byKey[prefix+key]; ok {
+			results = append(results, &BatchResult{Key: key, Status: http.StatusOK, Data: m})
+		} else {
+			results = append(results, &BatchResult{Key: key, Status: http.StatusNotFound, Error: core.ErrNotFound.Error()})
+		}
+	}
+	for _, id := range req.Ids {
+		add(id, "id:")
+	}
+	for _, url := range req.Urls {
+		add(url, "url:")
+	}
+	apiutil.WriteResponse(w, results)
+}
+
+// batchUpsert decodes, checks & saves one item of a batch upsert made by r in
+// ts. A non-nil error aborts the whole batch, unless it's one the database
+// raised for just that item, see batchItemDBErr
+type batchUpsert func(ts txStore, r *http.Request, item json.RawMessage) (*BatchResult, error)
+
+// writeBatchUpsert creates or updates up to maxBatchSize resources of kind
+// in a single transaction. The body is a list of resources, as PUT accepts
+// them. If any item fails nothing is saved: the response is a 422, & items
+// that would have been saved get a 424 result. Each item is saved under a
+// savepoint so a failed item doesn't stop the rest from being checked
+func writeBatchUpsert(w http.ResponseWriter, r *http.Request, kind string, upsert batchUpsert) {
+	items := []json.RawMessage{}
+	if !decodeBody(w, r, &items) {
+		return
+	}
+	if len(items) > maxBatchSize {
+		v := &apiutil.Validator{}
+		v.Add("(root)", apiutil.CodeTooMany, fmt.Sprintf("batches are limited to %d items", maxBatchSize))
+		writeBodyErr(w, v.Err())
+		return
+	}
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// items are locked one at a time, the kind's lock has to come first
+	if err := lockKind(tx, kind); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	ts := txStore{tx: tx}
+	results := make([]*BatchResult, len(items))
+	failed := false
+	for i, item := range items {
+		if _, err := tx.Exec("SAVEPOINT batch_item;"); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		results[i], err = upsert(ts, r, item)
+		if err != nil {
+			if results[i] = batchItemDBErr(err); results[i] == nil {
+				apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		end := "RELEASE SAVEPOINT batch_item;"
+		if results[i].Status >= 400 {
+			failed, end = true, "ROLLBACK TO SAVEPOINT batch_item;"
+		}
+		if _, err := tx.Exec(end); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if failed {
+		for _, res := range results {
+			if res.Status < 400 {
+				if res.Status == http.StatusCreated {
+					res.Key = ""
+				}
+				res.Status, res.Error, res.Data = http.StatusFailedDependency, "not saved because another item failed", nil
+			}
+		}
+		apiutil.WriteErrDataResponse(w, http.StatusUnprocessableEntity, errBatchFailed, results)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, results)
+}
+
+// upsertItem saves one decoded item of a batch upsert with the same checks
+// conditionalWrite makes, except that the item's own updated time stands in
+// for If-Match: updating an existing resource requires the updated time it
+// was last read with. read returns the stored version, save validates &
+// writes m. Saved items are audited & trigger webhooks like single writes
+func upsertItem(ts txStore, r *http.Request, kind string, m sql_datastore.Model, updated time.Time, read readCurrent, save func() error) (*BatchResult, error) {
+	id := m.GetId()
+	res := &BatchResult{Key: id}
+	if id != "" && !apiutil.IsUUID(id) {
+		v := &apiutil.Validator{}
+		v.UUID("id", id)
+		res = batchItemErr(v.Err())
+		res.Key = id
+		return res, nil
+	}
+	exists := false
+	if id != "" {
+		if _, err := ts.tx.Exec(qLockResource, kind+":"+id); err != nil {
+			return nil, err
+		}
+		if trashed, err := checkTrash(ts.tx, kind, id); err != nil {
+			return nil, err
+		} else if trashed {
+			res.Status, res.Error = http.StatusConflict, errInTrash.Error()
+			return res, nil
+		}
+		current, stored, err := read()
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		exists = err == nil
+
+		switch {
+		case exists && updated.IsZero():
+			res.Status, res.Error = http.StatusPreconditionRequired, errBatchUpdatedRequired.Error()
+			return res, nil
+		case exists && !updated.Truncate(time.Second).Equal(stored.Truncate(time.Second)):
+			res.Status, res.Error, res.Data = http.StatusPreconditionFailed, errStaleWrite.Error(), current
+			return res, nil
+		}
+	}
+
+	var before interface{}
+	if exists {
+		var err error
+		if before, err = auditSnapshot(ts, kind, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := save(); err != nil {
+		if ve, ok := err.(*apiutil.ValidationError); ok {
+			res.Status, res.Error, res.Errors = http.StatusUnprocessableEntity, ve.Error(), ve.Errors
+			return res, nil
+		}
+		return nil, err
+	}
+	res.Key, res.Data, res.Status = m.GetId(), m, http.StatusOK
+	action := auditUpdate
+	if !exists {
+		res.Status, action = http.StatusCreated, auditCreate
+	}
+	after, err := auditSnapshot(ts, kind, res.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordAudit(ts.tx, r, action, kind, res.Key, before, after); err != nil {
+		return nil, err
+	}
+	if err := queueWebhooks(ts.tx, action, kind, before, after); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// batchItemDBErr is the result for an item the database refused, eg: for
+// reusing a unique url. It's nil for any other error
+func batchItemDBErr(err error) *BatchResult {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return nil
+	}
+	switch {
+	case pqErr.Code.Name() == "unique_violation":
+		return &BatchResult{Status: http.StatusConflict, Error: pqErr.Message}
+	// integrity constraint violations & data exceptions
+	case pqErr.Code.Class() == "23" || pqErr.Code.Class() == "22":
+		return &BatchResult{Status: http.StatusUnprocessableEntity, Error: pqErr.Message}
+	}
+	return nil
+}
+
+// batchItemErr is the result for an item that couldn't be decoded
+func batchItemErr(err error) *BatchResult {
+	ve, ok := err.(*apiutil.ValidationError)
+	if !ok {
+		ve = &apiutil.ValidationError{Errors: []*apiutil.FieldError{
+			{Field: "(root)", Code: apiutil.CodeInvalidType, Message: err.Error()},
+		}}
+	}
+	return &BatchResult{Status: http.StatusUnprocessableEntity, Error: ve.Error(), Errors: ve.Errors}
+}
+
+func upsertPrimer(ts txStore, r *http.Request, item json.RawMessage) (*BatchResult, error) {
+	m := &core.Primer{}
+	if err := apiutil.DecodeStrict(bytes.NewReader(item), m); err != nil {
+		return batchItemErr(err), nil
+	}
+	read := func() (interface{}, time.Time, error) {
+		stored := &core.Primer{Id: m.Id}
+		err := stored.Read(ts)
+		return stored, stored.Updated, err
+	}
+	return upsertItem(ts, r, "primers", m, m.Updated, read, func() error {
+		if err := validatePrimer(ts.tx, m); err != nil {
+			return err
+		}
+		return savePrimer(ts, m)
+	})
+}
+
+func upsertSource(ts txStore, r *http.Request, item json.RawMessage) (*BatchResult, error) {
+	m := &core.Source{}
+	if err := apiutil.DecodeStrict(bytes.NewReader(item), m); err != nil {
+		return batchItemErr(err), nil
+	}
+	read := func() (interface{}, time.Time, error) {
+		stored := &core.Source{Id: m.Id}
+		err := stored.Read(ts)
+		return stored, stored.Updated, err
+	}
+	return upsertItem(ts, r, "sources", m, m.Updated, read, func() error {
+		if err := validateSource(ts.tx, m); err != nil {
+			return err
+		}
+		return saveSource(ts, m)
+	})
+}
+
+func upsertUncrawlable(ts txStore, r *http.Request, item json.RawMessage) (*BatchResult, error) {
+	m := &core.Uncrawlable{}
+	if err := apiutil.DecodeStrict(bytes.NewReader(item), &uncrawlableBody{Uncrawlable: m}); err != nil {
+		return batchItemErr(err), nil
+	}
+	stored := &core.Uncrawlable{Id: m.Id}
+	read := func() (interface{}, time.Time, error) {
+		err := stored.Read(ts)
+		return stored, stored.Updated, err
+	}
+	return upsertItem(ts, r, "uncrawlables", m, m.Updated, read, func() error {
+		// orgId & suborgId share a json key so items can't set them, keep
+		// any stored values
+		m.OrgId, m.SuborgId = stored.OrgId, stored.SuborgId
+		if err := validateUncrawlable(ts.tx, m); err != nil {
+			return err
+		}
+		return m.Save(ts)
+	})
+}
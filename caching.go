@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+)
+
+// defaultCacheControl makes clients & caches revalidate before reusing a
+// response, which is cheap with ETags
+const defaultCacheControl = "no-cache"
+
+// withCaching wraps a GET route's handler to support conditional requests.
+// Successful responses get a strong ETag hashed from the body, a
+// Last-Modified header from the "updated" field of single resources & the
+// route's Cache-Control policy. Requests with a matching If-None-Match or
+// If-Modified-Since get a 304 with no body. Exports are streamed, so they
+// only get Cache-Control
+func withCaching(rt *Route, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", rt.CacheControlPolicy())
+		if rt.Resource != nil || rt.Export {
+			// lists respond differently depending on Accept, see writeExport
+			w.Header().Add("Vary", "Accept")
+		}
+		if isExport(rt, r) {
+			handler(w, r)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, code: http.StatusOK}
+		handler(rec, r)
+		if rec.code != http.StatusOK {
+			rec.flush(w)
+			return
+		}
+
+		etag := rec.header.Get("ETag")
+		if etag == "" {
+			etag = apiutil.ETag(rec.body.Bytes())
+			rec.header.Set("ETag", etag)
+		}
+		lastModified := responseLastModified(rt, rec.body.Bytes())
+		if !lastModified.IsZero() {
+			rec.header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		}
+
+		if apiutil.NotModified(r, etag, lastModified) {
+			w.Header().Set("ETag", etag)
+			if lm := rec.header.Get("Last-Modified"); lm != "" {
+				w.Header().Set("Last-Modified", lm)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rec.flush(w)
+	}
+}
+
+// responseLastModified reads the updated time of the resource in a response
+// body, the zero time if there isn't a single resource
+func responseLastModified(rt *Route, body []byte) time.Time {
+	var v interface{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&v); err != nil {
+		return time.Time{}
+	}
+	if !rt.Raw {
+		env, _ := v.(map[string]interface{})
+		v = env["data"]
+	}
+	return apiutil.LastUpdated(v)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+)
+
+const (
+	// changeEventsChannel is the postgres channel log_change notifies
+	changeEventsChannel = "change_events"
+	// changeEventsBatchSize caps the events read from the log at once
+	changeEventsBatchSize = 500
+	// changeHeartbeat is how often idle /events streams get a comment, so
+	// proxies don't close them
+	changeHeartbeat = 15 * time.Second
+	// changeSubscriberBuffer is how many events a slow /events client can
+	// fall behind before it's disconnected. clients reconnect with
+	// Last-Event-ID to catch up from the log
+	changeSubscriberBuffer = 256
+	// changeGapRecheck is how often the listener checks whether a gap in
+	// the log has been filled or rolled back
+	changeGapRecheck = time.Second
+)
+
+// changeTypes are the resource types with change events, see the
+// log_change trigger in sql/migrations
+var changeTypes = []string{"primers", "sources", "urls", "collections", "uncrawlables", "customcrawls"}
+
+var (
+	errStreamingUnsupported = fmt.Errorf("streaming isn't supported by this connection")
+	errChangeType           = fmt.Errorf("type must be a comma-separated list of: %s", strings.Join(changeTypes, ", "))
+	errLastEventId          = fmt.Errorf("Last-Event-ID must be an event id")
+)
+
+// ChangeEvent is an insert, update or delete of a resource
+type ChangeEvent struct {
+	Id           int64     `json:"id"`
+	Created      time.Time `json:"created"`
+	ResourceType string    `json:"resourceType"`
+	ResourceId   string    `json:"resourceId"`
+	// Action is one of insert, update or delete. moving a resource to the
+	// trash is an update
+	Action string `json:"action"`
+}
+
+// UnmarshalSQL reads a change event from a row of change_events
+func (e *ChangeEvent) UnmarshalSQL(row sqlutil.Scannable) error {
+	return row.Scan(&e.Id, &e.Created, &e.ResourceType, &e.ResourceId, &e.Action)
+}
+
+// changes fans change events out to /events streams
+var changes = newChangeFeed()
+
+// changeFeed broadcasts change events to subscribers. Subscribers that
+// can't keep up are dropped instead of holding up everyone else
+type changeFeed struct {
+	mu     sync.Mutex
+	subs   map[chan *ChangeEvent]bool
+	closed bool
+	// last is the id of the last event published, once started is set by
+	// the listener
+	last    int64
+	started bool
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subs: map[chan *ChangeEvent]bool{}}
+}
+
+// subscribe returns a channel of new events & the id of the last event
+// published before it, so the log can be replayed up to there. The id is
+// math.MaxInt64 if the listener hasn't started. The channel is closed if
+// the subscriber falls too far behind or the feed is closed
+func (f *changeFeed) subscribe() (chan *ChangeEvent, int64) {
+	ch := make(chan *ChangeEvent, changeSubscriberBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	last := int64(math.MaxInt64)
+	if f.started {
+		last = f.last
+	}
+	if f.closed {
+		close(ch)
+		return ch, last
+	}
+	f.subs[ch] = true
+	return ch, last
+}
+
+// seek starts the feed after the event with id last
+func (f *changeFeed) seek(last int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = last
+	f.started = true
+}
+
+// unsubscribe stops sending events to ch
+func (f *changeFeed) unsubscribe(ch chan *ChangeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[ch] {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+func (f *changeFeed) publish(e *ChangeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = e.Id
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends all subscriptions so streams finish up on shutdown
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// listenForChanges publishes change events to the feed until ctx is done.
+// Notifications only wake the listener up, events are read from the log
+// with a changeCursor, so nothing is missed if the listener's connection
+// drops or events commit out of order
+func listenForChanges(ctx context.Context) {
+	c := &changeCursor{}
+	err := retryWithBackoff(ctx, "change events", time.Second, 30*time.Second, func() error {
+		if !isDBReady() {
+			return errNotReady
+		}
+		return appDB.QueryRow(qChangeEventsLatest).Scan(&c.last)
+	})
+	if err != nil {
+		log.Infoln(err)
+		return
+	}
+	changes.seek(c.last)
+
+	l := pq.NewListener(cfg.PostgresDbUrl, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Infof("change events listener: %s", err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(changeEventsChannel); err != nil {
+		log.Infof("error listening for change events: %s", err)
+		return
+	}
+
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	for {
+		// while waiting on a gap there might not be another notification
+		var recheck <-chan time.Time
+		if c.horizon != 0 {
+			recheck = time.After(changeGapRecheck)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			if err := l.Ping(); err != nil {
+				log.Infof("change events listener ping: %s", err)
+			}
+			continue
+		case <-recheck:
+		case <-l.Notify:
+			// a nil notification means the connection was re-established,
+			// either way catch up from the log
+		}
+		c.publish()
+	}
+}
+
+// changeCursor is the listener's place in the change event log. Event ids
+// are taken when a transaction writes an event, not when it commits, so an
+// event can show up in the log after ones with higher ids. Reading past a
+// missing id would skip it for good, so a gap after last is held until
+// every transaction that might fill it has finished
+type changeCursor struct {
+	// last is the id of the last event published
+	last int64
+	// horizon is the id the next transaction would get when the gap after
+	// last was found, 0 if there isn't a gap. Once the oldest running
+	// transaction is past it, ids still missing were rolled back
+	horizon int64
+}
+
+// publish publishes events after c.last, stopping at a gap that might
+// still be filled
+func (c *changeCursor) publish() {
+	for {
+		xmin, _, err := txidHorizon()
+		if err != nil {
+			log.Infof("error reading change events: %s", err)
+			return
+		}
+		events, err := readChangeEvents(c.last, math.MaxInt64)
+		if err != nil {
+			log.Infof("error reading change events: %s", err)
+			return
+		}
+		for _, e := range events {
+			if e.Id > c.last+1 {
+				if c.horizon == 0 {
+					// whatever took the missing ids had a transaction id
+					// before this read, & so before the horizon
+					if _, c.horizon, err = txidHorizon(); err != nil {
+						log.Infof("error reading change events: %s", err)
+					}
+					return
+				}
+				if xmin < c.horizon {
+					return
+				}
+			}
+			changes.publish(e)
+			c.last = e.Id
+			c.horizon = 0
+		}
+		if len(events) < changeEventsBatchSize {
+			return
+		}
+	}
+}
+
+// txidHorizon reads the oldest running transaction id & the id the next
+// transaction will get
+func txidHorizon() (xmin, xmax int64, err error) {
+	err = appDB.QueryRow(qTxidHorizon).Scan(&xmin, &xmax)
+	return
+}
+
+// readChangeEvents reads a batch of events after last, up to & including
+// upTo, from the log
+func readChangeEvents(last, upTo int64) ([]*ChangeEvent, error) {
+	rows, err := appDB.Query(qChangeEventsSince, last, upTo, changeEventsBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*ChangeEvent, 0, changeEventsBatchSize)
+	for rows.Next() {
+		e := &ChangeEvent{}
+		if err := e.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// pruneChangeEvents trims the change event log to cfg.EventLogSize events
+// every interval until ctx is done
+func pruneChangeEvents(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isDBReady() {
+			continue
+		}
+		if _, err := appDB.Exec(qChangeEventsPrune, cfg.eventLogSize()); err != nil {
+			log.Infof("error pruning change events: %s", err)
+		}
+	}
+}
+
+func isChangeType(name string) bool {
+	for _, t := range changeTypes {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// changeFilter picks the events an /events stream is interested in
+type changeFilter struct {
+	types map[string]bool
+	id    string
+}
+
+// changeFilterFromRequest reads the type & id params
+func changeFilterFromRequest(r *http.Request) (*changeFilter, error) {
+	f := &changeFilter{id: r.FormValue("id")}
+	if t := r.FormValue("type"); t != "" {
+		f.types = map[string]bool{}
+		for _, name := range strings.Split(t, ",") {
+			if !isChangeType(name) {
+				return nil, errChangeType
+			}
+			f.types[name] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *changeFilter) match(e *ChangeEvent) bool {
+	return (f.types == nil || f.types[e.ResourceType]) && (f.id == "" || f.id == e.ResourceId)
+}
+
+// EventsHandler streams change events as Server-Sent Events. Clients that
+// send Last-Event-ID get the events they missed from the log first. If
+// some of them have already been pruned from the log, the stream starts
+// with a "reset" event so clients know to reload
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, errStreamingUnsupported)
+		return
+	}
+	filter, err := changeFilterFromRequest(r)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	var last int64
+	resume := r.Header.Get("Last-Event-ID")
+	if resume != "" {
+		if last, err = strconv.ParseInt(resume, 10, 64); err != nil || last < 0 {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, errLastEventId)
+			return
+		}
+	}
+
+	// subscribe before replaying so events that happen in between aren't
+	// missed. the replay stops where the feed starts, anything replayed
+	// before the listener starts is skipped when it comes through the feed
+	ch, upTo := changes.subscribe()
+	defer changes.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if resume != "" {
+		if last, err = replayChanges(w, filter, last, upTo); err != nil {
+			log.Infof("error replaying change events: %s", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(changeHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if e.Id <= last {
+				continue
+			}
+			last = e.Id
+			if !filter.match(e) {
+				continue
+			}
+			if err := writeChangeEvent(w, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// replayChanges writes the events after last, up to & including upTo, that
+// match filter from the log, returning the id of the last event read
+func replayChanges(w io.Writer, filter *changeFilter, last, upTo int64) (int64, error) {
+	var oldest int64
+	if err := appDB.QueryRow(qChangeEventsOldest).Scan(&oldest); err != nil {
+		return last, err
+	}
+	if oldest > last+1 {
+		if _, err := io.WriteString(w, "event: reset\ndata: null\n\n"); err != nil {
+			return last, err
+		}
+	}
+
+	for {
+		events, err := readChangeEvents(last, upTo)
+		if err != nil {
+			return last, err
+		}
+		for _, e := range events {
+			last = e.Id
+			if !filter.match(e) {
+				continue
+			}
+			if err := writeChangeEvent(w, e); err != nil {
+				return last, err
+			}
+		}
+		if len(events) < changeEventsBatchSize {
+			return last, nil
+		}
+	}
+}
+
+// writeChangeEvent writes e as a "change" event
+func writeChangeEvent(w io.Writer, e *ChangeEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", e.Id, data)
+	return err
+}
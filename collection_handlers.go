@@ -3,33 +3,15 @@ package main
 import (
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
 	"net/http"
+	"time"
 )
 
-func CollectionHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetCollectionHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func CollectionsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		ListCollectionsHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func GetCollectionHandler(w http.ResponseWriter, r *http.Request) {
 	res := &core.Collection{}
 	args := &CollectionsGetParams{
-		Id: r.URL.Path[len("/collections/"):],
+		Id: apiutil.PathParam(r, "id"),
 		// Collection: r.FormValue("collection"),
 		// Hash:       r.FormValue("hash"),
 	}
@@ -42,17 +24,77 @@ func GetCollectionHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, collectionsResource) {
+		return
+	}
 	p := apiutil.PageFromRequest(r)
+	q, err := collectionsResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
 	res := make([]*core.Collection, p.Size)
 	args := &CollectionsListParams{
-		Limit:   p.Limit(),
-		Offset:  p.Offset(),
-		OrderBy: "created",
+		Query:  q,
+		Limit:  p.Limit(),
+		Offset: p.Offset(),
 	}
-	err := new(Collections).List(args, &res)
+	err = new(Collections).List(args, &res)
 	if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
 	apiutil.WritePageResponse(w, res, r, p)
 }
+
+func SaveCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	m := &core.Collection{}
+	if !decodeBody(w, r, m) {
+		return
+	}
+	m.Id = apiutil.PathParam(r, "id")
+	if !conditionalWrite(w, r, "collections", m.Id, currentCollection(m.Id), func(ts txStore) (sql_datastore.Model, error) {
+		if err := validateCollection(ts.tx, m); err != nil {
+			return nil, err
+		}
+		return m, m.Save(ts)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, m)
+}
+
+func PatchCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	m := &core.Collection{}
+	if !patchResource(w, r, "collections", id, currentCollection(id), m, func(ts txStore, current interface{}) error {
+		m.Id = id
+		if err := validateCollection(ts.tx, m); err != nil {
+			return err
+		}
+		return m.Save(ts)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, m)
+}
+
+func DeleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	res := &core.Collection{Id: id}
+	if !conditionalWrite(w, r, "collections", id, currentCollection(id), func(ts txStore) (sql_datastore.Model, error) {
+		return nil, res.Delete(ts)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, res)
+}
+
+// currentCollection reads a collection for conditionalWrite, as GET responds with it
+func currentCollection(id string) readCurrent {
+	return func() (interface{}, time.Time, error) {
+		res := &core.Collection{}
+		err := new(Collections).Get(&CollectionsGetParams{Id: id}, res)
+		return res, res.Updated, err
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
 )
 
 type Collections int
@@ -24,16 +26,46 @@ func (u *Collections) Get(args *CollectionsGetParams, res *core.Collection) (err
 }
 
 type CollectionsListParams struct {
-	OrderBy string
-	Limit   int
-	Offset  int
+	// Query holds filters & sort order, nil lists everything in the
+	// resource's default order
+	Query  *apiutil.ListQuery
+	Limit  int
+	Offset int
 }
 
 func (u *Collections) List(args *CollectionsListParams, res *[]*core.Collection) (err error) {
-	ps, err := core.ListCollections(store, args.Limit, args.Offset)
+	list := make([]*core.Collection, 0, args.Limit)
+	err = queryList(appDB, collectionsResource, args.Query, args.Limit, args.Offset, func(row sqlutil.Scannable) error {
+		m := &core.Collection{}
+		if err := m.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	*res = ps
+	*res = list
+	return nil
+}
+
+func (u *Collections) Save(model *core.Collection, res *core.Collection) (err error) {
+	err = model.Save(store)
+	if err != nil {
+		return err
+	}
+
+	*res = *model
+	return nil
+}
+
+func (u *Collections) Delete(model *core.Collection, res *core.Collection) (err error) {
+	err = model.Delete(store)
+	if err != nil {
+		return err
+	}
+
+	*res = *model
 	return nil
 }
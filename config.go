@@ -5,6 +5,8 @@ import (
 	conf "github.com/datatogether/config"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // server modes
@@ -25,6 +27,10 @@ const (
 //
 // configuration is read at startup and cannot be alterd without restarting the server.
 type config struct {
+	// server mode the config was loaded for, one of the *_MODE constants.
+	// set by initConfig, not read from the environment
+	Mode string
+
 	// path to go source code
 	Gopath string
 	// port to listen on, will be read from PORT env variable if present.
@@ -58,6 +64,103 @@ type config struct {
 	// CertbotResponse is only for doing manual SSL certificate generation
 	// via LetsEncrypt.
 	CertbotResponse string
+
+	// optional path to a directory to read sql, docs & the api spec from
+	// instead of the copies embedded in the binary. useful in development,
+	// set to the root of this repo
+	AssetsDir string
+
+	// if true, pending database migrations won't be applied at startup &
+	// must be run with "api migrate up"
+	SkipMigrations bool
+
+	// how long to wait for in-flight requests & background jobs to finish
+	// when shutting down, as a duration string. default is "30s"
+	ShutdownTimeout string
+
+	// how long responses to POSTs with an Idempotency-Key header are kept
+	// for replay, as a duration string. default is "24h"
+	IdempotencyWindow string
+
+	// ids of identity service users allowed to call admin endpoints, like
+	// purging the trash
+	AdminUsers []string
+
+	// how long deleted primers, sources & uncrawlables stay in the trash
+	// before they can be purged, as a duration string. default is "720h"
+	TrashRetention string
+
+	// number of recent change events kept for clients resuming /events
+	// with Last-Event-ID. default is "10000"
+	EventLogSize string
+
+	// notifiers new source alerts are sent to, any of log, email & webhook.
+	// default is log
+	AlertNotifiers []string
+
+	// host:port of the smtp server alert emails are sent through. in
+	// development this is a local stand-in like MailHog, see
+	// docker-compose.yml
+	SmtpAddr string
+
+	// address alert emails are sent from
+	AlertEmailFrom string
+
+	// addresses alert emails are sent to
+	AlertEmailTo []string
+
+	// the most times over a source's stale duration a url can wait to be
+	// fetched again when its content doesn't change. each fetch that finds
+	// the same content doubles the wait up to this limit. default is "1",
+	// no backoff
+	StaleBackoffMax string
+
+	// how long finished jobs are kept for clients to read their results,
+	// as a duration string. default is "168h"
+	JobRetention string
+
+	// how often primer & source stats are recomputed, as a duration
+	// string. default is "1h"
+	StatsInterval string
+
+	// if true, webhooks can be delivered to loopback, private & link-local
+	// addresses. only for development & tests, default is false
+	WebhookAllowPrivate bool
+}
+
+// shutdownTimeout parses cfg.ShutdownTimeout, falling back to a default
+func (c *config) shutdownTimeout() time.Duration {
+	return parseDurationDefault(c.ShutdownTimeout, 30*time.Second)
+}
+
+// idempotencyWindow parses cfg.IdempotencyWindow, falling back to a default
+func (c *config) idempotencyWindow() time.Duration {
+	return parseDurationDefault(c.IdempotencyWindow, 24*time.Hour)
+}
+
+// trashRetention parses cfg.TrashRetention, falling back to a default
+func (c *config) trashRetention() time.Duration {
+	return parseDurationDefault(c.TrashRetention, 30*24*time.Hour)
+}
+
+// eventLogSize parses cfg.EventLogSize, falling back to a default
+func (c *config) eventLogSize() int {
+	return parseIntDefault(c.EventLogSize, 10000)
+}
+
+// staleBackoffMax parses cfg.StaleBackoffMax, falling back to a default
+func (c *config) staleBackoffMax() int {
+	return parseIntDefault(c.StaleBackoffMax, 1)
+}
+
+// jobRetention parses cfg.JobRetention, falling back to a default
+func (c *config) jobRetention() time.Duration {
+	return parseDurationDefault(c.JobRetention, 7*24*time.Hour)
+}
+
+// statsInterval parses cfg.StatsInterval, falling back to a default
+func (c *config) statsInterval() time.Duration {
+	return parseDurationDefault(c.StatsInterval, time.Hour)
 }
 
 // initConfig pulls configuration from config.json
@@ -75,6 +178,8 @@ func initConfig(mode string) (cfg *config, err error) {
 		}
 	}
 
+	cfg.Mode = mode
+
 	// make sure port is set
 	if cfg.Port == "" {
 		cfg.Port = "8080"
@@ -93,6 +198,9 @@ func initConfig(mode string) (cfg *config, err error) {
 	return
 }
 
+// packagePath resolves a path relative to this package's source directory
+// within the GOPATH. only used to find .env files in development, everything
+// else the server needs is embedded, see assets.go
 func packagePath(path string) string {
 	return filepath.Join(os.Getenv("GOPATH"), "src/github.com/datatogether/api", path)
 }
@@ -121,6 +229,34 @@ func configFilePath(mode string, cfg *config) string {
 	return fileName
 }
 
+// parseDurationDefault parses a duration string, returning def if the
+// string is empty or invalid
+func parseDurationDefault(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Infof("invalid duration '%s', using default: %s", s, def)
+		return def
+	}
+	return d
+}
+
+// parseIntDefault parses a positive integer string, returning def if the
+// string is empty or invalid
+func parseIntDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i <= 0 {
+		log.Infof("invalid number '%s', using default: %d", s, def)
+		return def
+	}
+	return i
+}
+
 // Does this file exist?
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
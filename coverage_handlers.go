@@ -5,23 +5,10 @@ import (
 	"github.com/datatogether/core"
 	"github.com/datatogether/coverage/coverage"
 	"github.com/datatogether/coverage/tree"
-	"net"
 	"net/http"
-	"net/rpc"
 	"strings"
 )
 
-func CoverageHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		CoverageTreeHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func CoverageTreeHandler(w http.ResponseWriter, r *http.Request) {
 	var primer *core.Primer
 	patterns := strings.Split(r.FormValue("patterns"), ",")
@@ -41,13 +28,6 @@ func CoverageTreeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	conn, err := net.Dial("tcp", cfg.CoverageServiceUrl)
-	if err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-		return
-	}
-	cli := rpc.NewClient(conn)
-
 	p := coverage.CoverageTreeParams{
 		Root:     r.FormValue("root"),
 		Patterns: patterns,
@@ -68,7 +48,7 @@ func CoverageTreeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reply := &tree.Node{}
-	if err := cli.Call("CoverageRequests.Tree", p, reply); err != nil {
+	if err := coverageRPC.Call("CoverageRequests.Tree", p, reply); err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -1,42 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
 	"net/http"
+	"time"
 )
 
-func CustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetCustomCrawlHandler(w, r)
-	case "PUT":
-		SaveCustomCrawlHandler(w, r)
-	case "DELETE":
-		DeleteCustomCrawlHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func CustomCrawlsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		ListCustomCrawlsHandler(w, r)
-	case "PUT", "POST":
-		SaveCustomCrawlHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func GetCustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
 	res := &core.CustomCrawl{}
 	args := &CustomCrawlsGetParams{
-		Id: r.URL.Path[len("/customcrawls/"):],
+		Id: apiutil.PathParam(r, "id"),
 	}
 	err := new(CustomCrawls).Get(args, res)
 	if err != nil {
@@ -47,14 +22,22 @@ func GetCustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListCustomCrawlsHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, customCrawlsResource) {
+		return
+	}
 	p := apiutil.PageFromRequest(r)
+	q, err := customCrawlsResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
 	res := make([]*core.CustomCrawl, p.Size)
 	args := &CustomCrawlsListParams{
-		Limit:   p.Limit(),
-		Offset:  p.Offset(),
-		OrderBy: "created",
+		Query:  q,
+		Limit:  p.Limit(),
+		Offset: p.Offset(),
 	}
-	err := new(CustomCrawls).List(args, &res)
+	err = new(CustomCrawls).List(args, &res)
 	if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
@@ -64,28 +47,55 @@ func ListCustomCrawlsHandler(w http.ResponseWriter, r *http.Request) {
 
 func SaveCustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
 	un := &core.CustomCrawl{}
-	if err := json.NewDecoder(r.Body).Decode(un); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+	if !decodeBody(w, r, un) {
 		return
 	}
-	res := &core.CustomCrawl{}
-	if err := new(CustomCrawls).Save(un, res); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+	// PUT /customcrawls/{id} takes the id from the path
+	if id := apiutil.PathParam(r, "id"); id != "" {
+		un.Id = id
+	}
+	if !conditionalWrite(w, r, "customcrawls", un.Id, currentCustomCrawl(un.Id), func(ts txStore) (sql_datastore.Model, error) {
+		if err := validateCustomCrawl(ts.tx, un); err != nil {
+			return nil, err
+		}
+		return un, un.Save(ts)
+	}) {
 		return
 	}
-	apiutil.WriteResponse(w, res)
+	apiutil.WriteResponse(w, un)
 }
 
-func DeleteCustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
-	un := &core.CustomCrawl{}
-	if err := json.NewDecoder(r.Body).Decode(un); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+func PatchCustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	m := &core.CustomCrawl{}
+	if !patchResource(w, r, "customcrawls", id, currentCustomCrawl(id), m, func(ts txStore, current interface{}) error {
+		m.Id = id
+		if err := validateCustomCrawl(ts.tx, m); err != nil {
+			return err
+		}
+		return m.Save(ts)
+	}) {
 		return
 	}
-	res := &core.CustomCrawl{}
-	if err := new(CustomCrawls).Save(un, res); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+	apiutil.WriteResponse(w, m)
+}
+
+func DeleteCustomCrawlHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	res := &core.CustomCrawl{Id: id}
+	if !conditionalWrite(w, r, "customcrawls", id, currentCustomCrawl(id), func(ts txStore) (sql_datastore.Model, error) {
+		return nil, res.Delete(ts)
+	}) {
 		return
 	}
 	apiutil.WriteResponse(w, res)
 }
+
+// currentCustomCrawl reads a custom crawl for conditionalWrite
+func currentCustomCrawl(id string) readCurrent {
+	return func() (interface{}, time.Time, error) {
+		res := &core.CustomCrawl{}
+		err := new(CustomCrawls).Get(&CustomCrawlsGetParams{Id: id}, res)
+		return res, res.Updated, err
+	}
+}
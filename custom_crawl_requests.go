@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
 )
 
 type CustomCrawls int
@@ -24,17 +26,27 @@ func (u *CustomCrawls) Get(p *CustomCrawlsGetParams, res *core.CustomCrawl) (err
 }
 
 type CustomCrawlsListParams struct {
-	OrderBy string
-	Limit   int
-	Offset  int
+	// Query holds filters & sort order, nil lists everything in the
+	// resource's default order
+	Query  *apiutil.ListQuery
+	Limit  int
+	Offset int
 }
 
 func (u *CustomCrawls) List(p *CustomCrawlsListParams, res *[]*core.CustomCrawl) (err error) {
-	urls, err := core.ListCustomCrawls(store, p.Limit, p.Offset)
+	list := make([]*core.CustomCrawl, 0, p.Limit)
+	err = queryList(appDB, customCrawlsResource, p.Query, p.Limit, p.Offset, func(row sqlutil.Scannable) error {
+		m := &core.CustomCrawl{}
+		if err := m.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	*res = urls
+	*res = list
 	return nil
 }
 
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+)
+
+// expansions clients can request for primers & sources
+var (
+	primerExpansions = []string{"parent", "sources", "subPrimers", "stats"}
+	sourceExpansions = []string{"primer", "primer.parent", "stats"}
+)
+
+// withFields wraps a Selectable route's handler, checking fields= & expand=
+// params against the route. both are passed to the handler through the
+// request context, see requestExpansions & requestFields. When fields are
+// requested json responses are buffered & their data trimmed before they're
+// sent, exports trim rows as they're written
+func withFields(rt *Route, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		exp, err := apiutil.ParseExpansions(query.Get("expand"), rt.Expand)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), expandKey, exp))
+
+		fields := apiutil.ParseFieldset(query.Get("fields"))
+		if fields == nil {
+			handler(w, r)
+			return
+		}
+		_, schemas := getAPISpec()
+		if err := schemas.CheckFieldset(schemas.SchemaFor(rt.Response), fields); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), fieldsKey, fields))
+
+		// exports handle fields themselves, see writeExport
+		if isExport(rt, r) {
+			handler(w, r)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, code: http.StatusOK}
+		handler(rec, r)
+		if rec.code == http.StatusOK {
+			if err := selectFields(rec, fields); err != nil {
+				apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		rec.flush(w)
+	}
+}
+
+// selectFields trims the data of a recorded response envelope to fields
+func selectFields(rec *responseRecorder, fields apiutil.Fieldset) error {
+	env := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(rec.body.Bytes()))
+	// keep numbers as written, large ints would lose precision as float64s
+	dec.UseNumber()
+	if err := dec.Decode(&env); err != nil {
+		return err
+	}
+	env["data"] = fields.Select(env["data"])
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	rec.body.Reset()
+	rec.body.Write(data)
+	return nil
+}
+
+type ctxKey string
+
+// context keys withFields stores a request's fields & expansions under
+const (
+	fieldsKey = ctxKey("fields")
+	expandKey = ctxKey("expand")
+)
+
+// requestFields returns the fields a request asked for, nil for all fields
+func requestFields(r *http.Request) apiutil.Fieldset {
+	fields, _ := r.Context().Value(fieldsKey).(apiutil.Fieldset)
+	return fields
+}
+
+// requestExpansions returns the expansions a request asked for
+func requestExpansions(r *http.Request) apiutil.Expansions {
+	exp, _ := r.Context().Value(expandKey).(apiutil.Expansions)
+	return exp
+}
+
+// expandPrimers embeds the related resources in exp for a list of primers,
+// with one query per expansion no matter how many primers there are. stats
+// are only included if expanded
+func expandPrimers(db sqlutil.Queryable, primers []*core.Primer, exp apiutil.Expansions) error {
+	if len(primers) == 0 {
+		return nil
+	}
+	ids := make([]string, len(primers))
+	for i, p := range primers {
+		ids[i] = p.Id
+	}
+
+	if exp.Has("parent") {
+		var parentIds []string
+		for _, p := range primers {
+			if p.Parent != nil && p.Parent.Id != "" {
+				parentIds = append(parentIds, p.Parent.Id)
+			}
+		}
+		parents, err := readPrimers(db, qPrimersByIds, parentIds)
+		if err != nil {
+			return err
+		}
+		byId := map[string]*core.Primer{}
+		for _, parent := range parents {
+			byId[parent.Id] = parent
+		}
+		for _, p := range primers {
+			if p.Parent != nil && byId[p.Parent.Id] != nil {
+				p.Parent = byId[p.Parent.Id]
+			}
+		}
+		if err := expandPrimers(db, parents, exp.Sub("parent")); err != nil {
+			return err
+		}
+	}
+
+	if exp.Has("subPrimers") {
+		subs, err := readPrimers(db, qPrimersByParentIds, ids)
+		if err != nil {
+			return err
+		}
+		byParent := map[string][]*core.Primer{}
+		for _, sub := range subs {
+			byParent[sub.Parent.Id] = append(byParent[sub.Parent.Id], sub)
+		}
+		for _, p := range primers {
+			p.SubPrimers = byParent[p.Id]
+		}
+		if err := expandPrimers(db, subs, exp.Sub("subPrimers")); err != nil {
+			return err
+		}
+	}
+
+	if exp.Has("sources") {
+		sources, err := readSources(db, qSourcesByPrimerIds, ids)
+		if err != nil {
+			return err
+		}
+		byPrimer := map[string][]*core.Source{}
+		for _, s := range sources {
+			byPrimer[s.Primer.Id] = append(byPrimer[s.Primer.Id], s)
+		}
+		for _, p := range primers {
+			p.Sources = byPrimer[p.Id]
+		}
+		if err := expandSources(db, sources, exp.Sub("sources")); err != nil {
+			return err
+		}
+	}
+
+	if !exp.Has("stats") {
+		for _, p := range primers {
+			p.Stats = nil
+		}
+	}
+	return nil
+}
+
+// expandSources embeds the related resources in exp for a list of sources,
+// see expandPrimers
+func expandSources(db sqlutil.Queryable, sources []*core.Source, exp apiutil.Expansions) error {
+	if len(sources) == 0 {
+		return nil
+	}
+
+	if exp.Has("primer") {
+		var primerIds []string
+		for _, s := range sources {
+			if s.Primer != nil && s.Primer.Id != "" {
+				primerIds = append(primerIds, s.Primer.Id)
+			}
+		}
+		primers, err := readPrimers(db, qPrimersByIds, primerIds)
+		if err != nil {
+			return err
+		}
+		byId := map[string]*core.Primer{}
+		for _, p := range primers {
+			byId[p.Id] = p
+		}
+		for _, s := range sources {
+			if s.Primer != nil && byId[s.Primer.Id] != nil {
+				s.Primer = byId[s.Primer.Id]
+			}
+		}
+		if err := expandPrimers(db, primers, exp.Sub("primer")); err != nil {
+			return err
+		}
+	}
+
+	if !exp.Has("stats") {
+		for _, s := range sources {
+			s.Stats = nil
+		}
+	}
+	return nil
+}
+
+// readPrimers runs a primer query that takes a single array of ids
+func readPrimers(db sqlutil.Queryable, query string, ids []string) ([]*core.Primer, error) {
+	primers := []*core.Primer{}
+	if len(ids) == 0 {
+		return primers, nil
+	}
+	rows, err := db.Query(query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &core.Primer{}
+		if err := p.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		primers = append(primers, p)
+	}
+	return primers, rows.Err()
+}
+
+// readSources runs a source query that takes a single array of ids
+func readSources(db sqlutil.Queryable, query string, ids []string) ([]*core.Source, error) {
+	sources := []*core.Source{}
+	if len(ids) == 0 {
+		return sources, nil
+	}
+	rows, err := db.Query(query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := &core.Source{}
+		if err := s.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	return sources, rows.Err()
+}
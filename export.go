@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/sqlutil"
+)
+
+// exportBatchSize is how many rows are read before related resources are
+// expanded & the rows are sent to the client
+const exportBatchSize = 100
+
+// isExport reports whether a request to rt will be handled by writeExport
+// or writeListExport.
+// requests with an invalid format are, so writeExport can report the error
+func isExport(rt *Route, r *http.Request) bool {
+	if rt.Resource == nil && !rt.Export {
+		return false
+	}
+	f, err := apiutil.RequestFormat(r)
+	return err != nil || f != apiutil.FormatJSON
+}
+
+// writeExport streams a list as csv or ndjson if the request asks for either,
+// reporting whether it handled the request. Rows are written as they're read
+// from the db cursor, so nothing holds the whole result. Exports aren't
+// paginated unless page or pageSize is set. Once rows have been sent errors
+// can't change the response status, so they're logged & the response is
+// cut short
+func writeExport(w http.ResponseWriter, r *http.Request, res *resource) bool {
+	f, err := apiutil.RequestFormat(r)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return true
+	}
+	if f == apiutil.FormatJSON {
+		return false
+	}
+
+	q, err := res.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return true
+	}
+
+	limit, offset := 0, 0
+	if query := r.URL.Query(); query.Get("page") != "" || query.Get("pageSize") != "" {
+		p := apiutil.PageFromRequest(r)
+		limit, offset = p.Limit(), p.Offset()
+	}
+	exp := requestExpansions(r)
+
+	var (
+		rw    apiutil.RowWriter
+		batch = make([]interface{}, 0, exportBatchSize)
+	)
+	flush := func() error {
+		if res.Expand != nil {
+			if err := res.Expand(appDB, batch, exp); err != nil {
+				return err
+			}
+		}
+		// the response starts with the first batch, so errors running the
+		// query can still be reported properly
+		if rw == nil {
+			if f == apiutil.FormatCSV {
+				w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, res.Name))
+			}
+			rw = apiutil.NewRowWriter(w, f, apiutil.FieldNames(res.Model), requestFields(r))
+		}
+		for _, m := range batch {
+			if err := rw.WriteRow(m); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return rw.Flush()
+	}
+
+	err = queryList(appDB, res, q, limit, offset, func(row sqlutil.Scannable) error {
+		m, err := res.Scan(row)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, m)
+		if len(batch) == exportBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		if rw == nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return true
+		}
+		log.Infof("export %s failed partway: %s", res.Name, err)
+	}
+	return true
+}
+
+// writeListExport writes list as csv or ndjson if the request asks for
+// either, reporting whether it handled the request. it's for routes that
+// build their whole list before responding, see Route.Export
+func writeListExport(w http.ResponseWriter, r *http.Request, name string, model interface{}, list []interface{}) bool {
+	f, err := apiutil.RequestFormat(r)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return true
+	}
+	if f == apiutil.FormatJSON {
+		return false
+	}
+
+	if f == apiutil.FormatCSV {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+	}
+	rw := apiutil.NewRowWriter(w, f, apiutil.FieldNames(model), requestFields(r))
+	for _, m := range list {
+		if err := rw.WriteRow(m); err != nil {
+			log.Infof("export %s failed partway: %s", name, err)
+			return true
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		log.Infof("export %s failed partway: %s", name, err)
+	}
+	return true
+}
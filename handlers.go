@@ -1,13 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 )
 
 // HealthCheckHandler is a basic "hey I'm fine" for load balancers & co
-// TODO - add Database connection & proper configuration checks here for more accurate
-// health reporting
+// it doesn't check any dependencies, see LiveHandler & ReadyHandler in health.go
+// for more accurate health reporting
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{ "status" : 200 }`))
@@ -27,3 +28,20 @@ func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 func EmptyOkHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
+
+// OptionsHandler answers OPTIONS requests for any known path. apiutil.Router
+// sets the Allow header before calling it
+func OptionsHandler(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	EmptyOkHandler(w, r)
+}
+
+// deprecatedAlias marks responses from unversioned paths as deprecated,
+// pointing clients at the versioned equivalent
+func deprecatedAlias(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", apiVersion, r.URL.Path))
+		handler(w, r)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// healthCheckTimeout bounds each dependency probe made by ReadyHandler
+const healthCheckTimeout = 2 * time.Second
+
+// appTables is the list of tables the api expects to exist before it
+// can serve requests
+var appTables = []string{
+	"primers",
+	"sources",
+	"urls",
+	"links",
+	"metadata",
+	"snapshots",
+	"collections",
+	"collection_items",
+	"uncrawlables",
+	"archive_requests",
+	"custom_crawls",
+	"schema_migrations",
+}
+
+// dbReady is set to 1 once initPostgres has connected, ensured the schema
+// & registered models with the default store. read & write with sync/atomic
+var dbReady int32
+
+// setDBReady flags the application database as usable (or not)
+func setDBReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&dbReady, v)
+}
+
+// isDBReady reports weather initPostgres has finished connecting
+func isDBReady() bool {
+	return atomic.LoadInt32(&dbReady) == 1
+}
+
+// dependency check status values
+const (
+	checkStatusOk      = "ok"
+	checkStatusFailing = "failing"
+	checkStatusSkipped = "skipped"
+	// server-wide status while draining connections
+	checkStatusShuttingDown = "shutting down"
+)
+
+// DependencyCheck is the result of probing a single service dependency
+type DependencyCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthReport is the response body for readiness checks
+type HealthReport struct {
+	Status string                      `json:"status"`
+	Checks map[string]*DependencyCheck `json:"checks"`
+}
+
+// dependencyProbe checks a single dependency, returning a non-nil error
+// if the dependency isn't usable. errSkipped signals the dependency
+// isn't configured & shouldn't count against readiness
+type dependencyProbe func(ctx context.Context) error
+
+var errSkipped = fmt.Errorf("not configured")
+
+// readinessProbes lists all dependencies that must be healthy for the
+// server to accept traffic
+func readinessProbes() map[string]dependencyProbe {
+	return map[string]dependencyProbe{
+		"postgres": probePostgres,
+		"schema":   probeSchema,
+		"coverage": probeTCP(cfg.CoverageServiceUrl),
+		"identity": probeTCP(cfg.IdentityServiceUrl),
+	}
+}
+
+// LiveHandler reports that the process is up & able to serve http. It
+// deliberately doesn't check dependencies, a failing liveness check
+// should only ever mean "restart me"
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, http.StatusOK, &HealthReport{Status: checkStatusOk})
+}
+
+// ReadyHandler probes all service dependencies concurrently, responding
+// with 503 if any of them are failing
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		writeHealthReport(w, http.StatusServiceUnavailable, &HealthReport{Status: checkStatusShuttingDown})
+		return
+	}
+
+	report := checkDependencies(r.Context(), readinessProbes())
+	code := http.StatusOK
+	if report.Status != checkStatusOk {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealthReport(w, code, report)
+}
+
+// checkDependencies runs a set of probes, each with healthCheckTimeout,
+// and collects the results into a report
+func checkDependencies(ctx context.Context, probes map[string]dependencyProbe) *HealthReport {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	report := &HealthReport{
+		Status: checkStatusOk,
+		Checks: map[string]*DependencyCheck{},
+	}
+
+	for name, probe := range probes {
+		wg.Add(1)
+		go func(name string, probe dependencyProbe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := probe(ctx)
+			check := &DependencyCheck{
+				Status:    checkStatusOk,
+				LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err == errSkipped {
+				check.Status = checkStatusSkipped
+			} else if err != nil {
+				check.Status = checkStatusFailing
+				check.Error = err.Error()
+			}
+
+			mu.Lock()
+			report.Checks[name] = check
+			if check.Status == checkStatusFailing {
+				report.Status = checkStatusFailing
+			}
+			mu.Unlock()
+		}(name, probe)
+	}
+
+	wg.Wait()
+	return report
+}
+
+// probePostgres pings the application database
+func probePostgres(ctx context.Context) error {
+	if !isDBReady() {
+		return fmt.Errorf("database connection not yet established")
+	}
+	return appDB.PingContext(ctx)
+}
+
+// probeSchema confirms all of appTables exist in the database
+func probeSchema(ctx context.Context) error {
+	if !isDBReady() {
+		return fmt.Errorf("database connection not yet established")
+	}
+
+	rows, err := appDB.QueryContext(ctx, qSchemaTablesPresent, pq.Array(appTables))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	present := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		present[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for _, t := range appTables {
+		if !present[t] {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing tables: %v", missing)
+	}
+	return nil
+}
+
+// probeTCP creates a probe that checks an RPC endpoint is accepting
+// connections
+func probeTCP(addr string) dependencyProbe {
+	return func(ctx context.Context) error {
+		if addr == "" {
+			return errSkipped
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func writeHealthReport(w http.ResponseWriter, code int, report *HealthReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(data)
+}
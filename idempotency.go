@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+)
+
+const (
+	// idempotencyKeyHeader is the request header clients set to make retries
+	// of a POST safe
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyReplayedHeader is set on responses replayed from a stored key
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKeyLength caps the length of idempotency keys
+	maxIdempotencyKeyLength = 255
+	// idempotencyLockTimeout is how long a request can hold a key before
+	// it's assumed to have died & another request may take it over
+	idempotencyLockTimeout = time.Minute
+)
+
+var (
+	errIdempotencyKeyTooLong    = fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	errIdempotencyKeyInProgress = fmt.Errorf("a request with this %s is still being handled, please try again shortly", idempotencyKeyHeader)
+)
+
+// withIdempotency wraps a POST route's handler to honor the Idempotency-Key
+// header. The first request with a key is handled as usual & its response
+// stored, retries with the same key get the stored response back with an
+// Idempotent-Replayed header instead of being handled again. Reusing a key
+// for a different request is a 422, & retrying while the first request is
+// still in flight is a 409. 5xx responses aren't stored, so requests that
+// failed on the server can be retried. Keys are kept for
+// cfg.IdempotencyWindow, & only apply to the route & requester they were
+// sent with, see idempotencyScope
+func withIdempotency(rt *Route, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, errIdempotencyKeyTooLong)
+			return
+		}
+
+		fingerprint, err := requestFingerprint(rt, r)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		scope := idempotencyScope(rt, r)
+		claimed, err := claimIdempotencyKey(scope, key, fingerprint)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !claimed {
+			replayIdempotentResponse(w, scope, key, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, code: http.StatusOK}
+		handler(rec, r)
+		if err := completeIdempotencyKey(scope, key, rec); err != nil {
+			log.Infof("error storing response for idempotency key '%s': %s", key, err)
+		}
+		rec.flush(w)
+	}
+}
+
+// requestFingerprint hashes everything that makes a request distinct. The
+// body is read up to one byte over maxBodySize & replaced, so handlers still
+// see the whole body & can reject it if it's too large
+func requestFingerprint(rt *Route, r *http.Request) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", rt.Method, rt.Path, r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// idempotencyScope is the route & requester an idempotency key belongs to:
+// the user id for signed in users, otherwise the ip address
+func idempotencyScope(rt *Route, r *http.Request) string {
+	requester := "ip:" + getIP(r)
+	if u := requestUser(r); u != nil && !u.Anonymous && u.Id != "" {
+		requester = "user:" + u.Id
+	}
+	return fmt.Sprintf("%s %s %s", rt.Method, rt.Path, requester)
+}
+
+// claimIdempotencyKey records key in scope for a new request, reporting
+// false if it's already in use
+func claimIdempotencyKey(scope, key, fingerprint string) (bool, error) {
+	err := appDB.QueryRow(qIdempotencyKeyClaim, scope, key, fingerprint,
+		cfg.idempotencyWindow().Seconds(), idempotencyLockTimeout.Seconds()).Scan(&key)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// completeIdempotencyKey stores the response for a claimed key, or releases
+// the key if the response shouldn't be replayed
+func completeIdempotencyKey(scope, key string, rec *responseRecorder) error {
+	if rec.code >= 500 {
+		_, err := appDB.Exec(qIdempotencyKeyRelease, scope, key)
+		return err
+	}
+	header, err := json.Marshal(rec.header)
+	if err != nil {
+		return err
+	}
+	_, err = appDB.Exec(qIdempotencyKeyComplete, scope, key, rec.code, string(header), rec.body.Bytes())
+	return err
+}
+
+// replayIdempotentResponse writes the response stored for a key that's
+// already in use
+func replayIdempotentResponse(w http.ResponseWriter, scope, key, fingerprint string) {
+	var (
+		stored, header string
+		status         int
+		body           []byte
+	)
+	err := appDB.QueryRow(qIdempotencyKeyRead, scope, key).Scan(&stored, &status, &header, &body)
+	if err == sql.ErrNoRows {
+		// the key was released between claiming & reading it
+		apiutil.WriteErrResponse(w, http.StatusConflict, errIdempotencyKeyInProgress)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if stored != fingerprint {
+		v := &apiutil.Validator{}
+		v.Add(idempotencyKeyHeader, apiutil.CodeReused, "was already used for a different request")
+		apiutil.WriteValidationErrResponse(w, v.Err().(*apiutil.ValidationError))
+		return
+	}
+	if status == 0 {
+		apiutil.WriteErrResponse(w, http.StatusConflict, errIdempotencyKeyInProgress)
+		return
+	}
+
+	rec := &responseRecorder{header: http.Header{}, code: status}
+	if err := json.Unmarshal([]byte(header), &rec.header); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	rec.header.Set(idempotencyReplayedHeader, "true")
+	rec.body.Write(body)
+	rec.flush(w)
+}
+
+// pruneIdempotencyKeys deletes expired idempotency keys every interval
+// until ctx is done. expired keys are already ignored, this keeps the table
+// from growing
+func pruneIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isDBReady() {
+			continue
+		}
+		res, err := appDB.Exec(qIdempotencyKeysPrune, cfg.idempotencyWindow().Seconds())
+		if err != nil {
+			log.Infof("error pruning idempotency keys: %s", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Infof("pruned %d expired idempotency keys", n)
+		}
+	}
+}
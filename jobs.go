@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+	"github.com/pborman/uuid"
+)
+
+// job statuses
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+const (
+	// jobLease is how long a worker holds a job without renewing it. jobs
+	// held by an instance that died are claimed again once it runs out
+	jobLease = time.Minute
+	// jobHeartbeat is how often running jobs renew their lease & check if
+	// they've been canceled
+	jobHeartbeat = 10 * time.Second
+	// jobRetryDelay is the wait before retrying a failed job, doubling
+	// after each attempt up to jobMaxRetryDelay
+	jobRetryDelay    = 30 * time.Second
+	jobMaxRetryDelay = time.Hour
+)
+
+var (
+	errJobCanceled = fmt.Errorf("job was canceled")
+	errJobLost     = fmt.Errorf("job's lease expired on its last attempt")
+	errJobFinished = fmt.Errorf("job has already finished")
+	errJobCancel   = fmt.Errorf("jobs can only be canceled by admins & whoever started them")
+)
+
+// Job is an operation too slow for a request, run in the background.
+// clients poll GET /jobs/{id} for its progress & result
+type Job struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Type is the kind of job, see jobTypes
+	Type string `json:"type"`
+	// Status is one of queued, running, succeeded, failed or canceled.
+	// failed jobs with attempts left go back to queued
+	Status string          `json:"status"`
+	Params json.RawMessage `json:"params"`
+	// Result is what the job produced, set once it succeeds
+	Result json.RawMessage `json:"result"`
+	// Error is why the last attempt failed
+	Error string `json:"error"`
+	// Progress is the fraction of the job that's done, from 0 to 1
+	Progress        float64    `json:"progress"`
+	ProgressMessage string     `json:"progressMessage"`
+	Attempts        int        `json:"attempts"`
+	MaxAttempts     int        `json:"maxAttempts"`
+	RunAfter        time.Time  `json:"runAfter"`
+	Started         *time.Time `json:"started"`
+	Finished        *time.Time `json:"finished"`
+	// CancelRequested is set when a running job has been asked to stop
+	CancelRequested bool   `json:"cancelRequested"`
+	CreatedBy       string `json:"createdBy"`
+}
+
+// UnmarshalSQL reads a job from a row of jobColumns
+func (j *Job) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		params, result    []byte
+		started, finished pq.NullTime
+	)
+	if err := row.Scan(&j.Id, &j.Created, &j.Updated, &j.Type, &j.Status, &params, &result, &j.Error,
+		&j.Progress, &j.ProgressMessage, &j.Attempts, &j.MaxAttempts, &j.RunAfter, &started, &finished,
+		&j.CancelRequested, &j.CreatedBy); err != nil {
+		return err
+	}
+	j.Params = json.RawMessage(params)
+	if result != nil {
+		j.Result = json.RawMessage(result)
+	}
+	if started.Valid {
+		j.Started = &started.Time
+	}
+	if finished.Valid {
+		j.Finished = &finished.Time
+	}
+	return nil
+}
+
+// JobRequest is the body of a request to start a job
+type JobRequest struct {
+	Type string `json:"type"`
+	// Params are passed to the job, see the job type for what it accepts
+	Params json.RawMessage `json:"params"`
+}
+
+// jobType is a kind of job workers know how to run
+type jobType struct {
+	Name string
+	// Concurrency caps how many jobs of this type an instance runs at once
+	Concurrency int
+	// MaxAttempts is how many times a job is run before it's marked failed
+	MaxAttempts int
+	// Singleton jobs only run on the leader, one at a time, see leader.go
+	Singleton bool
+	// Admin jobs can only be started by admins
+	Admin bool
+	// Validate checks params when a job is started, optional
+	Validate func(params json.RawMessage) error
+	// Run does the job, returning its result. Run should return promptly
+	// once ctx is done, which happens if the job is canceled or the
+	// instance shuts down
+	Run func(ctx context.Context, run *jobRun) (interface{}, error)
+}
+
+// jobTypes are the jobs clients can start
+var jobTypes = []*jobType{
+	scheduleUrlsJob,
+	refreshStatsJob,
+}
+
+func jobTypeNames() []string {
+	names := make([]string, len(jobTypes))
+	for i, t := range jobTypes {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// findJobType finds a job type by name, nil if there isn't one
+func findJobType(name string) *jobType {
+	for _, t := range jobTypes {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// scheduleUrlsJob reschedules every url now, instead of waiting for urls
+// to be picked up by scheduleUrls
+var scheduleUrlsJob = &jobType{
+	Name:        "urls.schedule",
+	Concurrency: 1,
+	MaxAttempts: 3,
+	Singleton:   true,
+	Admin:       true,
+	Run: func(ctx context.Context, run *jobRun) (interface{}, error) {
+		n, err := refreshUrlSchedules(time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int64{"scheduled": n}, nil
+	},
+}
+
+// jobRun is a job that's being run by a worker
+type jobRun struct {
+	*Job
+	// claim is the token the job was claimed with, see qJobsClaim
+	claim  string
+	cancel context.CancelFunc
+	// canceled is set once a cancel request has been seen
+	mu       sync.Mutex
+	canceled bool
+}
+
+// Progress records how far along the job is, with a note on what it's
+// doing. returns errJobCanceled if the job has been asked to stop
+func (run *jobRun) Progress(fraction float64, message string) error {
+	return run.heartbeat(&fraction, &message)
+}
+
+// heartbeat renews the job's lease, optionally recording progress, &
+// cancels the run if the job has been canceled or lost
+func (run *jobRun) heartbeat(fraction *float64, message *string) error {
+	cancel := false
+	err := appDB.QueryRow(qJobHeartbeat, run.Id, jobLease.Seconds(), fraction, message, run.claim).Scan(&cancel)
+	if err == sql.ErrNoRows {
+		// the lease ran out & another worker has claimed the job, or it's
+		// finished
+		run.cancel()
+		return errJobCanceled
+	} else if err != nil {
+		return err
+	}
+	if cancel {
+		run.mu.Lock()
+		run.canceled = true
+		run.mu.Unlock()
+		run.cancel()
+		return errJobCanceled
+	}
+	return nil
+}
+
+func (run *jobRun) wasCanceled() bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	return run.canceled
+}
+
+// jobWorker claims & runs jobs, keeping each instance under the job types'
+// concurrency limits
+type jobWorker struct {
+	mu      sync.Mutex
+	running map[string]int
+	wg      sync.WaitGroup
+}
+
+func newJobWorker() *jobWorker {
+	return &jobWorker{running: map[string]int{}}
+}
+
+// runJobs claims jobs every interval until ctx is done, then waits for
+// running jobs to stop. jobs interrupted by shutdown go back in the queue
+func runJobs(ctx context.Context, interval time.Duration) {
+	w := newJobWorker()
+	defer w.wg.Wait()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	pruned := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isDBReady() {
+			continue
+		}
+		if err := w.claim(ctx); err != nil {
+			log.Infof("error claiming jobs: %s", err)
+		}
+		if leader.isLeader() && time.Since(pruned) > time.Hour {
+			if _, err := appDB.Exec(qJobsPrune, cfg.jobRetention().Seconds()); err != nil {
+				log.Infof("error pruning jobs: %s", err)
+			}
+			pruned = time.Now()
+		}
+	}
+}
+
+// claim starts as many jobs as there's room for. jobs left running by a
+// worker that stopped are finished first if they can't be run again
+func (w *jobWorker) claim(ctx context.Context) error {
+	if _, err := appDB.Exec(qJobsExpire, errJobLost.Error(), errJobCanceled.Error()); err != nil {
+		return err
+	}
+	for _, t := range jobTypes {
+		if t.Singleton && !leader.isLeader() {
+			continue
+		}
+		w.mu.Lock()
+		free := t.Concurrency - w.running[t.Name]
+		w.mu.Unlock()
+		if free <= 0 {
+			continue
+		}
+
+		claim := uuid.New()
+		rows, err := appDB.Query(qJobsClaim, t.Name, free, jobLease.Seconds(), t.Singleton, claim)
+		if err != nil {
+			return err
+		}
+		var claimed []*Job
+		for rows.Next() {
+			j := &Job{}
+			if err := j.UnmarshalSQL(rows); err != nil {
+				rows.Close()
+				return err
+			}
+			claimed = append(claimed, j)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, j := range claimed {
+			w.mu.Lock()
+			w.running[t.Name]++
+			w.mu.Unlock()
+			w.wg.Add(1)
+			go func(t *jobType, j *Job) {
+				defer func() {
+					w.mu.Lock()
+					w.running[t.Name]--
+					w.mu.Unlock()
+					w.wg.Done()
+				}()
+				runJob(ctx, t, &jobRun{Job: j, claim: claim})
+			}(t, j)
+		}
+	}
+	return nil
+}
+
+// runJob runs a claimed job, renewing its lease until it's done & recording
+// how it ended
+func runJob(ctx context.Context, t *jobType, run *jobRun) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	run.cancel = cancel
+	j := run.Job
+
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(jobHeartbeat)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				if err := run.heartbeat(nil, nil); err != nil && err != errJobCanceled {
+					log.Infof("error renewing lease on job %s: %s", j.Id, err)
+				}
+			}
+		}
+	}()
+
+	result, err := runJobSafely(runCtx, t, run)
+	close(done)
+
+	switch {
+	case err != nil && run.wasCanceled():
+		finishJob(run, jobCanceled, nil, errJobCanceled.Error(), time.Now().UTC())
+	case err != nil && ctx.Err() != nil:
+		// the instance is shutting down, let another one pick the job up
+		if _, err := appDB.Exec(qJobRelease, j.Id, run.claim); err != nil {
+			log.Infof("error releasing job %s: %s", j.Id, err)
+		}
+	case err != nil:
+		log.Infof("job %s (%s) attempt %d failed: %s", j.Id, j.Type, j.Attempts, err)
+		if j.Attempts < j.MaxAttempts {
+			finishJob(run, jobQueued, nil, err.Error(), time.Now().UTC().Add(jobBackoff(j.Attempts)))
+		} else {
+			finishJob(run, jobFailed, nil, err.Error(), time.Now().UTC())
+		}
+	default:
+		data, err := json.Marshal(result)
+		if err != nil {
+			finishJob(run, jobFailed, nil, err.Error(), time.Now().UTC())
+			return
+		}
+		finishJob(run, jobSucceeded, string(data), "", time.Now().UTC())
+	}
+}
+
+// runJobSafely runs a job, turning a panic into an error so one bad job
+// doesn't take the instance down
+func runJobSafely(ctx context.Context, t *jobType, run *jobRun) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return t.Run(ctx, run)
+}
+
+// finishJob records the end of a job run. runAfter is when a queued job is
+// retried. nothing is recorded if the run's claim on the job has been lost
+func finishJob(run *jobRun, status string, result interface{}, msg string, runAfter time.Time) {
+	now := time.Now().UTC()
+	res, err := appDB.Exec(qJobFinish, run.Id, status, result, msg, now, runAfter, run.claim)
+	if err != nil {
+		log.Infof("error finishing job %s: %s", run.Id, err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		log.Infof("job %s was claimed by another worker, dropping the %s result", run.Id, status)
+	}
+}
+
+// jobBackoff is the wait before retrying a job that has failed attempts
+// times
+func jobBackoff(attempts int) time.Duration {
+	d := jobRetryDelay
+	for i := 1; i < attempts && d < jobMaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > jobMaxRetryDelay {
+		d = jobMaxRetryDelay
+	}
+	return d
+}
+
+// readJob reads a job by id, returning core.ErrNotFound if it doesn't exist
+func readJob(db sqlutil.Queryable, id string) (*Job, error) {
+	j := &Job{}
+	if err := j.UnmarshalSQL(db.QueryRow(qJobRead, id)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, core.ErrNotFound
+		}
+		return nil, err
+	}
+	return j, nil
+}
+
+// ListJobsHandler lists jobs, most recent first
+func ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, jobsResource) {
+		return
+	}
+	p := apiutil.PageFromRequest(r)
+	q, err := jobsResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
+	jobs := make([]*Job, 0, p.Size)
+	err = queryList(appDB, jobsResource, q, p.Limit(), p.Offset(), func(row sqlutil.Scannable) error {
+		j := &Job{}
+		if err := j.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		jobs = append(jobs, j)
+		return nil
+	})
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, jobs, r, p)
+}
+
+// CreateJobHandler queues a job, responding with it. poll the job with
+// GetJobHandler to follow its progress
+func CreateJobHandler(w http.ResponseWriter, r *http.Request) {
+	req := &JobRequest{}
+	if !decodeBody(w, r, req) {
+		return
+	}
+	t := findJobType(req.Type)
+	if t == nil {
+		v := &apiutil.Validator{}
+		v.Add("type", apiutil.CodeInvalid, "must be one of: "+strings.Join(jobTypeNames(), ", "))
+		writeBodyErr(w, v.Err())
+		return
+	}
+	if t.Admin && !isAdmin(requestUser(r)) {
+		apiutil.WriteErrResponse(w, http.StatusForbidden, errAdminRequired)
+		return
+	}
+	if len(req.Params) == 0 || string(req.Params) == "null" {
+		req.Params = json.RawMessage("{}")
+	}
+	if t.Validate != nil {
+		if err := t.Validate(req.Params); err != nil {
+			writeBodyErr(w, err)
+			return
+		}
+	}
+
+	writeQueuedJob(w, r, t, req.Params)
+}
+
+// queueJob adds a job of type t to the queue
+func queueJob(db sqlutil.Queryable, t *jobType, params json.RawMessage, createdBy string) (*Job, error) {
+	j := &Job{}
+	err := j.UnmarshalSQL(db.QueryRow(qJobInsert, uuid.New(), time.Now().UTC(), t.Name, string(params), t.MaxAttempts, createdBy))
+	return j, err
+}
+
+// pendingJob reads the oldest queued or running job of type t, nil if
+// there isn't one
+func pendingJob(db sqlutil.Queryable, t *jobType) (*Job, error) {
+	j := &Job{}
+	if err := j.UnmarshalSQL(db.QueryRow(qJobPending, t.Name)); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// writeQueuedJob queues a job for r, recording an audit event, & responds
+// with it
+func writeQueuedJob(w http.ResponseWriter, r *http.Request, t *jobType, params json.RawMessage) {
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	j, err := queueJob(tx, t, params, actorName(r))
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordAudit(tx, r, auditCreate, "jobs", j.Id, nil, j); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, j)
+}
+
+// GetJobHandler gets a job
+func GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := readJob(appDB, apiutil.PathParam(r, "id"))
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, j)
+}
+
+// CancelJobHandler cancels a queued job, or asks a running job to stop,
+// responding with the job. running jobs stop the next time they report
+// progress or renew their lease. jobs can be canceled by admins & whoever
+// started them
+func CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := readJob(tx, id)
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if before.CreatedBy != actorName(r) && !isAdmin(requestUser(r)) {
+		apiutil.WriteErrResponse(w, http.StatusForbidden, errJobCancel)
+		return
+	}
+
+	after := &Job{}
+	err = after.UnmarshalSQL(tx.QueryRow(qJobCancel, id, time.Now().UTC()))
+	if err == sql.ErrNoRows {
+		apiutil.WriteErrDataResponse(w, http.StatusConflict, errJobFinished, before)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordAudit(tx, r, auditUpdate, "jobs", id, before, after); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, after)
+}
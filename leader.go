@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"time"
+)
+
+// leaderLockName names the advisory lock the leader holds
+const leaderLockName = "datatogether-api:leader"
+
+// leader tracks whether this instance is the leader. Singleton jobs only
+// run on the leader, so they don't run twice when there's more than one
+// instance of the api
+var leader = &leaderElection{}
+
+// leaderElection holds a session-level advisory lock on its own connection
+// for as long as the instance is the leader. If the connection drops,
+// postgres releases the lock & another instance takes over
+type leaderElection struct {
+	mu     sync.Mutex
+	leader bool
+}
+
+func (l *leaderElection) isLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+func (l *leaderElection) set(leader bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if leader != l.leader {
+		if leader {
+			log.Infof("this instance is now the leader")
+		} else {
+			log.Infof("this instance is no longer the leader")
+		}
+	}
+	l.leader = leader
+}
+
+// electLeader tries to become the leader every interval, checking that the
+// lock is still held once it is, until ctx is done. the lock is released on
+// the way out so another instance can take over right away
+func electLeader(ctx context.Context, interval time.Duration) {
+	var conn *sql.Conn
+	defer func() {
+		leader.set(false)
+		if conn != nil {
+			discardConn(conn)
+		}
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if isDBReady() {
+			var err error
+			if conn, err = campaign(ctx, conn); err != nil {
+				log.Infof("leader election: %s", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// campaign takes the leader lock if it's free, or checks the connection
+// holding it is still alive, returning the connection to use next time
+func campaign(ctx context.Context, conn *sql.Conn) (*sql.Conn, error) {
+	var err error
+	if conn == nil {
+		if conn, err = appDB.Conn(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if leader.isLeader() {
+		// the lock is held for as long as the connection is open
+		var pid int
+		err = conn.QueryRowContext(ctx, qLeaderCheck).Scan(&pid)
+	} else {
+		held := false
+		if err = conn.QueryRowContext(ctx, qLeaderTryLock, leaderLockName).Scan(&held); err == nil {
+			leader.set(held)
+		}
+	}
+	if err != nil {
+		leader.set(false)
+		discardConn(conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// discardConn closes the connection that took the leader lock instead of
+// returning it to the pool. the lock belongs to the postgres session, so a
+// pooled connection would keep holding it for whatever query used it next.
+// telling Raw the connection is bad closes it for good
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// background tracks long-running goroutines (pollers, listeners, workers)
+// that need to be stopped before the database is closed on shutdown
+var background = newBackgroundGroup()
+
+// backgroundGroup is a WaitGroup paired with a context that is cancelled
+// when the group is stopped
+type backgroundGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackgroundGroup() *backgroundGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in a new goroutine. fn must return promptly once ctx is done
+func (b *backgroundGroup) Go(name string, fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		log.Infof("starting background job: %s", name)
+		fn(b.ctx)
+		log.Infof("stopped background job: %s", name)
+	}()
+}
+
+// Stop cancels all background jobs & waits for them to return, giving up
+// when ctx is done
+func (b *backgroundGroup) Stop(ctx context.Context) error {
+	b.cancel()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background jobs didn't stop in time: %s", ctx.Err())
+	}
+}
+
+// shuttingDown is set to 1 once the server has begun shutting down.
+// read & write with sync/atomic
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// retryWithBackoff calls fn until it succeeds or ctx is done, sleeping for
+// exponentially longer periods (capped at max) between attempts
+func retryWithBackoff(ctx context.Context, name string, initial, max time.Duration, fn func() error) error {
+	wait := initial
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		log.Infof("%s failed (attempt %d), retrying in %s: %s", name, attempt, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %s", name, ctx.Err())
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > max {
+			wait = max
+		}
+	}
+}
+
+// shutdown stops the server in order: stop accepting new requests, drain
+// in-flight requests, stop background jobs, then close rpc clients & the
+// database connection pool. All steps share a single deadline
+func shutdown(s *http.Server, timeout time.Duration) error {
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	log.Infoln("draining http connections")
+	if err := s.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http server shutdown: %s", err))
+	}
+
+	log.Infoln("stopping background jobs")
+	if err := background.Stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	log.Infoln("closing rpc clients")
+	for _, cli := range []*rpcClient{coverageRPC, identityRPC} {
+		if err := cli.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if isDBReady() {
+		log.Infoln("closing database connections")
+		setDBReady(false)
+		if err := appDB.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing db: %s", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("shutdown errors: %v", errs)
+	}
+	return nil
+}
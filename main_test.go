@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
+	"github.com/datatogether/api/migrate"
 	"github.com/datatogether/sqlutil"
 	"github.com/gchaincl/dotsql"
 	_ "github.com/lib/pq"
@@ -32,7 +34,6 @@ func setupTestDatabase() func() {
 	var err error
 	appDB, err = sqlutil.SetupConnection("postgres", cfg.PostgresDbUrl)
 	if err != nil {
-		appDB.Close()
 		panic(err.Error())
 	}
 
@@ -40,6 +41,8 @@ func setupTestDatabase() func() {
 	if err != nil {
 		panic(err.Error())
 	}
+	initDatastore(appDB)
+	setDBReady(true)
 
 	if err := resetTestData(appDB,
 		"primers",
@@ -65,22 +68,18 @@ func initializeAppSchema(db *sql.DB) (func(), error) {
 		return nil, err
 	}
 
-	for _, cmd := range []string{
-		"drop-all",
-		"create-primers",
-		"create-sources",
-		"create-urls",
-		"create-links",
-		"create-metadata",
-		"create-snapshots",
-		"create-collections",
-		"create-archive_requests",
-		"create-uncrawlables",
-	} {
-		if _, err := schema.Exec(db, cmd); err != nil {
-			fmt.Println(cmd, "error:", err)
-			return nil, err
-		}
+	if _, err := schema.Exec(db, "drop-all"); err != nil {
+		fmt.Println("drop-all error:", err)
+		return nil, err
+	}
+
+	m, err := migrate.New(db, os.DirFS("sql/migrations"))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Up(context.Background()); err != nil {
+		fmt.Println("migration error:", err)
+		return nil, err
 	}
 
 	teardown := func() {
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"github.com/datatogether/api/apiutil"
 	"net/http"
 	"time"
 )
 
+var errNotReady = fmt.Errorf("service is starting up or shutting down, please try again shortly")
+
 // middleware handles request logging
 func middleware(handler http.HandlerFunc) http.HandlerFunc {
 	// no-auth middware func
@@ -31,6 +34,14 @@ func middleware(handler http.HandlerFunc) http.HandlerFunc {
 		// }
 		addCORSHeaders(w, r)
 
+		// the database connects in the background at startup & closes on shutdown,
+		// don't let requests through to handlers that would hit a nil db
+		if !isDBReady() {
+			w.Header().Set("Retry-After", "5")
+			apiutil.WriteErrResponse(w, http.StatusServiceUnavailable, errNotReady)
+			return
+		}
+
 		req, err := requestAddUser(r)
 		if err != nil {
 			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
@@ -47,8 +58,8 @@ func addCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	for _, o := range cfg.AllowedOrigins {
 		if origin == o {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, PATCH, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,If-Match,Idempotency-Key,Last-Event-ID")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			return
 		}
@@ -0,0 +1,341 @@
+// Package migrate applies numbered, versioned sql migrations to a postgres
+// database. Migrations are pairs of files named in the form:
+//
+//	0001_create_things.up.sql
+//	0001_create_things.down.sql
+//
+// where the leading number is the version. Applied versions are recorded
+// in the schema_migrations table. Every operation takes a postgres advisory
+// lock, so multiple instances starting at once won't race each other.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// lockKey is the postgres advisory lock id held while migrating
+const lockKey int64 = 7236457001
+
+// Migration is a numbered pair of up & down sql scripts
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes a migration & weather it's been applied
+type Status struct {
+	Version int64      `json:"version"`
+	Name    string     `json:"name"`
+	Applied *time.Time `json:"applied"`
+	// Missing is true when a version is recorded in schema_migrations but
+	// no migration file exists for it
+	Missing bool `json:"missing,omitempty"`
+}
+
+var filenameRegex = regexp.MustCompile(`^(\d+)_([\w-]+)\.(up|down)\.sql$`)
+
+// Load reads all migrations from the root of fsys, returning them sorted by
+// version. Every migration must have both an up & a down file
+func Load(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		match := filenameRegex.FindStringSubmatch(e.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version '%s': %s", e.Name(), err)
+		}
+		if version <= 0 {
+			return nil, fmt.Errorf("migration versions must be greater than zero: %s", e.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, path.Clean(e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d has conflicting names: %s, %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up & down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator runs migrations against a database
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []*Migration
+	// Logf, if set, is called with progress messages
+	Logf func(format string, args ...interface{})
+}
+
+// New creates a Migrator with migrations loaded from fsys
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Latest returns the highest known migration version, 0 if there are none
+func (m *Migrator) Latest() int64 {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down rolls back the most recent steps applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if err := m.apply(ctx, conn, mig, false); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// To migrates up or down until version is the latest applied migration.
+// To(ctx, 0) rolls back all migrations
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("unknown migration version: %d", version)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// roll back anything newer than the target, newest first
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				if err := m.apply(ctx, conn, mig, false); err != nil {
+					return err
+				}
+			}
+		}
+
+		// apply anything pending up to & including the target, oldest first
+		for _, mig := range m.Migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				if err := m.apply(ctx, conn, mig, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status lists all known migrations along with when they were applied,
+// plus any applied versions that don't have a matching migration
+func (m *Migrator) Status(ctx context.Context) ([]*Status, error) {
+	var statuses []*Status
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.Migrations {
+			s := &Status{Version: mig.Version, Name: mig.Name}
+			if t, ok := applied[mig.Version]; ok {
+				t := t
+				s.Applied = &t
+				delete(applied, mig.Version)
+			}
+			statuses = append(statuses, s)
+		}
+
+		for v, t := range applied {
+			t := t
+			statuses = append(statuses, &Status{Version: v, Applied: &t, Missing: true})
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Version < statuses[j].Version
+		})
+		return nil
+	})
+	return statuses, err
+}
+
+// Version returns the highest applied migration version, 0 if no
+// migrations have been applied
+func (m *Migrator) Version(ctx context.Context) (version int64, err error) {
+	if _, err = m.DB.ExecContext(ctx, qCreateMigrationsTable); err != nil {
+		return 0, err
+	}
+	err = m.DB.QueryRowContext(ctx, qCurrentVersion).Scan(&version)
+	return
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for _, mig := range m.Migrations {
+		if mig.Version == version {
+			return mig
+		}
+	}
+	return nil
+}
+
+// apply runs a single migration's up or down script in a transaction,
+// recording the result in schema_migrations
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig *Migration, up bool) error {
+	direction, script := "down", mig.Down
+	if up {
+		direction, script = "up", mig.Up
+	}
+	m.logf("migrating %s: %d_%s", direction, mig.Version, mig.Name)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d_%s %s: %s", mig.Version, mig.Name, direction, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, qInsertVersion, mig.Version, mig.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, qDeleteVersion, mig.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// withLock runs fn on a single connection while holding the migrations
+// advisory lock. advisory locks are session-scoped, so the lock & all work
+// must happen on the same connection
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, qAdvisoryLock, lockKey); err != nil {
+		return fmt.Errorf("acquiring migration lock: %s", err)
+	}
+	// unlock with a fresh context so a cancelled ctx doesn't leave the lock held
+	defer conn.ExecContext(context.Background(), qAdvisoryUnlock, lockKey)
+
+	if _, err := conn.ExecContext(ctx, qCreateMigrationsTable); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) logf(format string, args ...interface{}) {
+	if m.Logf != nil {
+		m.Logf(format, args...)
+	}
+}
+
+// appliedVersions reads applied migration versions & their timestamps
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, qAppliedVersions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var (
+			version int64
+			t       time.Time
+		)
+		if err := rows.Scan(&version, &t); err != nil {
+			return nil, err
+		}
+		applied[version] = t.In(time.UTC)
+	}
+	return applied, rows.Err()
+}
+
+const qCreateMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version          bigint PRIMARY KEY NOT NULL,
+  name             text NOT NULL default '',
+  applied          timestamp NOT NULL default (now() at time zone 'utc')
+);`
+
+const qAppliedVersions = `SELECT version, applied FROM schema_migrations ORDER BY version;`
+
+const qCurrentVersion = `SELECT coalesce(max(version), 0) FROM schema_migrations;`
+
+const qInsertVersion = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`
+
+const qDeleteVersion = `DELETE FROM schema_migrations WHERE version = $1;`
+
+const qAdvisoryLock = `SELECT pg_advisory_lock($1);`
+
+const qAdvisoryUnlock = `SELECT pg_advisory_unlock($1);`
@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_things.up.sql":      {Data: []byte("ALTER TABLE things ADD COLUMN b text;")},
+		"0002_add_things.down.sql":    {Data: []byte("ALTER TABLE things DROP COLUMN b;")},
+		"0001_create_things.up.sql":   {Data: []byte("CREATE TABLE things (a text);")},
+		"0001_create_things.down.sql": {Data: []byte("DROP TABLE things;")},
+		"readme.md":                   {Data: []byte("not a migration")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got: %d", len(migrations))
+	}
+
+	cases := []struct {
+		version  int64
+		name, up string
+	}{
+		{1, "create_things", "CREATE TABLE things (a text);"},
+		{2, "add_things", "ALTER TABLE things ADD COLUMN b text;"},
+	}
+	for i, c := range cases {
+		m := migrations[i]
+		if m.Version != c.version {
+			t.Errorf("case %d version mismatch. expected: %d, got: %d", i, c.version, m.Version)
+		}
+		if m.Name != c.name {
+			t.Errorf("case %d name mismatch. expected: %s, got: %s", i, c.name, m.Name)
+		}
+		if m.Up != c.up {
+			t.Errorf("case %d up mismatch. expected: %s, got: %s", i, c.up, m.Up)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		fsys fstest.MapFS
+		err  string
+	}{
+		{fstest.MapFS{
+			"0001_a.up.sql": {Data: []byte("")},
+		}, "migration 1_a must have both up & down files"},
+		{fstest.MapFS{
+			"0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		}, "migration version 1 has conflicting names: a, b"},
+		{fstest.MapFS{
+			"0000_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"0000_a.down.sql": {Data: []byte("SELECT 1;")},
+		}, "migration versions must be greater than zero: 0000_a.down.sql"},
+	}
+
+	for i, c := range cases {
+		_, err := Load(c.fsys)
+		if err == nil {
+			t.Errorf("case %d expected error: %s", i, c.err)
+			continue
+		}
+		if err.Error() != c.err {
+			t.Errorf("case %d error mismatch. expected: %s, got: %s", i, c.err, err.Error())
+		}
+	}
+}
+
+func TestLoadRepoMigrations(t *testing.T) {
+	migrations, err := Load(os.DirFS("../sql/migrations"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration versions should be sequential. expected: %d, got: %d", i+1, m.Version)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/datatogether/api/migrate"
+	"github.com/datatogether/sqlutil"
+)
+
+// newMigrator creates a migrator for the application's sql migrations
+func newMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	m, err := migrate.New(db, assetsSub("sql/migrations"))
+	if err != nil {
+		return nil, err
+	}
+	m.Logf = log.Infof
+	return m, nil
+}
+
+// migrateUsage documents the migrate subcommand
+const migrateUsage = `usage: api migrate <command>
+
+commands:
+  up              apply all pending migrations
+  down [n]        roll back the last n migrations, default 1
+  to <version>    migrate up or down to a specific version, 0 rolls back everything
+  status          list migrations & when they were applied
+`
+
+// migrateCommand runs the "migrate" subcommand, returning an exit code
+func migrateCommand(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(out, migrateUsage)
+		return 2
+	}
+
+	db, err := sqlutil.SetupConnection("postgres", cfg.PostgresDbUrl)
+	if err != nil {
+		fmt.Fprintf(out, "error connecting to db: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	m, err := newMigrator(db)
+	if err != nil {
+		fmt.Fprintf(out, "error loading migrations: %s\n", err)
+		return 1
+	}
+
+	if err := runMigrateCommand(context.Background(), m, args, out); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+func runMigrateCommand(ctx context.Context, m *migrate.Migrator, args []string, out io.Writer) error {
+	switch args[0] {
+	case "up":
+		if err := m.Up(ctx); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = n
+		}
+		if err := m.Down(ctx, steps); err != nil {
+			return err
+		}
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("a version is required. %s", migrateUsage)
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version: %s", args[1])
+		}
+		if err := m.To(ctx, version); err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.Format("2006-01-02 15:04:05")
+			}
+			name := s.Name
+			if s.Missing {
+				name = "(missing migration file)"
+			}
+			fmt.Fprintf(out, "%04d  %-40s  %s\n", s.Version, name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %s\n%s", args[0], migrateUsage)
+	}
+
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema at version %d\n", version)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// alertNotifier sends word of a new alert somewhere. notifiers are picked
+// with cfg.AlertNotifiers
+type alertNotifier interface {
+	// Notify sends an alert raised about source s
+	Notify(a *Alert, s *core.Source) error
+}
+
+// newAlertNotifiers builds the notifiers named in c.AlertNotifiers,
+// skipping any that are unknown or missing config
+func newAlertNotifiers(c *config) []alertNotifier {
+	var names []string
+	for _, name := range c.AlertNotifiers {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{"log"}
+	}
+
+	notifiers := []alertNotifier{}
+	for _, name := range names {
+		switch name {
+		case "log":
+			notifiers = append(notifiers, logNotifier{})
+		case "email":
+			if c.SmtpAddr == "" || c.AlertEmailFrom == "" || len(c.AlertEmailTo) == 0 {
+				log.Infof("email alert notifier needs SMTP_ADDR, ALERT_EMAIL_FROM & ALERT_EMAIL_TO set, skipping")
+				continue
+			}
+			notifiers = append(notifiers, &emailNotifier{addr: c.SmtpAddr, from: c.AlertEmailFrom, to: c.AlertEmailTo})
+		case "webhook":
+			notifiers = append(notifiers, webhookNotifier{})
+		default:
+			log.Infof("unknown alert notifier '%s', skipping", name)
+		}
+	}
+	return notifiers
+}
+
+// notifyAlerts sends alerts to every notifier. errors are logged, so one
+// notifier failing doesn't stop the others
+func notifyAlerts(notifiers []alertNotifier, alerts []*Alert) {
+	for _, a := range alerts {
+		s := &core.Source{Id: a.SourceId}
+		if err := s.Read(store); err != nil {
+			log.Infof("error reading source %s for alert %d: %s", a.SourceId, a.Id, err)
+			continue
+		}
+		for _, n := range notifiers {
+			if err := n.Notify(a, s); err != nil {
+				log.Infof("error sending alert %d with %T: %s", a.Id, n, err)
+			}
+		}
+	}
+}
+
+// alertSummary describes an alert in a line
+func alertSummary(a *Alert, s *core.Source) string {
+	if a.Url == "" {
+		return fmt.Sprintf("%s alert for %s (%s): %s", a.Kind, s.Title, s.Url, a.Message)
+	}
+	return fmt.Sprintf("%s alert for %s (%s): %s %s", a.Kind, s.Title, s.Url, a.Url, a.Message)
+}
+
+// logNotifier writes alerts to the server log
+type logNotifier struct{}
+
+func (logNotifier) Notify(a *Alert, s *core.Source) error {
+	log.Infof("alert %d: %s", a.Id, alertSummary(a, s))
+	return nil
+}
+
+// emailNotifier emails alerts through an smtp server
+type emailNotifier struct {
+	addr string
+	from string
+	to   []string
+}
+
+func (n *emailNotifier) Notify(a *Alert, s *core.Source) error {
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	// source titles come from users, encoding keeps newlines in them from
+	// starting new headers
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("%s alert for %s", a.Kind, s.Title)))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(msg, "%s\r\n\r\n", alertSummary(a, s))
+	fmt.Fprintf(msg, "source: %s\r\nalert: %d\r\nraised: %s\r\n", s.Id, a.Id, a.Created.Format(time.RFC3339))
+	return smtp.SendMail(n.addr, nil, n.from, n.to, msg.Bytes())
+}
+
+// webhookNotifier queues an "alert.created" delivery to webhooks that
+// subscribe to it
+type webhookNotifier struct{}
+
+func (webhookNotifier) Notify(a *Alert, s *core.Source) error {
+	payload, err := json.Marshal(&webhookPayload{Event: "alert.created", Created: time.Now().UTC(), Data: a})
+	if err != nil {
+		return err
+	}
+	_, err = appDB.Exec(qWebhookDeliveriesQueue, "alert.created", string(payload), nil)
+	return err
+}
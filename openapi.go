@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/identity/user"
+	"gopkg.in/yaml.v2"
+)
+
+// OpenAPISpec is a swagger 2.0 document
+type OpenAPISpec struct {
+	Swagger     string                                  `json:"swagger"`
+	Info        OpenAPIInfo                             `json:"info"`
+	Host        string                                  `json:"host"`
+	BasePath    string                                  `json:"basePath"`
+	Schemes     []string                                `json:"schemes"`
+	Consumes    []string                                `json:"consumes"`
+	Produces    []string                                `json:"produces"`
+	Paths       map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Definitions map[string]*apiutil.Schema              `json:"definitions"`
+}
+
+// OpenAPIInfo is spec metadata
+type OpenAPIInfo struct {
+	Version        string            `json:"version"`
+	Title          string            `json:"title"`
+	Description    string            `json:"description"`
+	TermsOfService string            `json:"termsOfService"`
+	Contact        map[string]string `json:"contact"`
+	License        map[string]string `json:"license"`
+}
+
+// OpenAPIOperation describes a single method on a path
+type OpenAPIOperation struct {
+	Summary    string                      `json:"summary,omitempty"`
+	Tags       []string                    `json:"tags,omitempty"`
+	Consumes   []string                    `json:"consumes,omitempty"`
+	Produces   []string                    `json:"produces,omitempty"`
+	Parameters []*OpenAPIParameter         `json:"parameters,omitempty"`
+	Responses  map[string]*OpenAPIResponse `json:"responses"`
+}
+
+// OpenAPIParameter is a path, query or body parameter
+type OpenAPIParameter struct {
+	Name        string          `json:"name"`
+	In          string          `json:"in"`
+	Description string          `json:"description,omitempty"`
+	Required    bool            `json:"required"`
+	Type        string          `json:"type,omitempty"`
+	Format      string          `json:"format,omitempty"`
+	Schema      *apiutil.Schema `json:"schema,omitempty"`
+}
+
+// OpenAPIResponse is a possible response to an operation
+type OpenAPIResponse struct {
+	Description string                    `json:"description"`
+	Schema      *apiutil.Schema           `json:"schema,omitempty"`
+	Headers     map[string]*OpenAPIHeader `json:"headers,omitempty"`
+}
+
+// OpenAPIHeader is a response header
+type OpenAPIHeader struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// apiSpec is the spec generated from apiRoutes. it's built on first use &
+// never changes, access it with getAPISpec
+var apiSpec struct {
+	once    sync.Once
+	spec    *OpenAPISpec
+	schemas *apiutil.SchemaBuilder
+}
+
+// getAPISpec returns the OpenAPI spec for apiRoutes, along with the schema
+// builder that holds its definitions
+func getAPISpec() (*OpenAPISpec, *apiutil.SchemaBuilder) {
+	apiSpec.once.Do(func() {
+		apiSpec.spec, apiSpec.schemas = buildAPISpec(apiRoutes)
+	})
+	return apiSpec.spec, apiSpec.schemas
+}
+
+// newSchemaBuilder creates a schema builder that knows about types with
+// custom JSON encodings
+func newSchemaBuilder() *apiutil.SchemaBuilder {
+	b := apiutil.NewSchemaBuilder()
+	b.Overrides[reflect.TypeOf(user.UserType(0))] = &apiutil.Schema{Type: "string"}
+	// users encode as just an id string when only the id is known, which
+	// swagger 2.0 can't express. document the full object
+	b.Overrides[reflect.TypeOf(user.User{})] = b.Define("User", user.User{})
+	return b
+}
+
+// buildAPISpec generates a swagger 2.0 document from a list of routes
+func buildAPISpec(routes []*Route) (*OpenAPISpec, *apiutil.SchemaBuilder) {
+	schemas := newSchemaBuilder()
+	spec := &OpenAPISpec{
+		Swagger: "2.0",
+		Info: OpenAPIInfo{
+			Version:        "0.0.1",
+			Title:          "Data Together API",
+			Description:    "Api for Data Together records. Paths without the /v1 prefix are deprecated aliases of their /v1 equivalents",
+			TermsOfService: "https://archivers.co/terms/api",
+			Contact:        map[string]string{"name": "b5"},
+			License:        map[string]string{"name": "AGPL"},
+		},
+		Host:        "api.archivers.co",
+		BasePath:    "/",
+		Schemes:     []string{"https"},
+		Consumes:    []string{"application/json"},
+		Produces:    []string{"application/json"},
+		Paths:       map[string]map[string]*OpenAPIOperation{},
+		Definitions: schemas.Definitions,
+	}
+	schemas.Definitions["Error"] = errorSchema()
+	schemas.Definitions["ValidationError"] = validationErrorSchema(schemas)
+
+	for _, rt := range routes {
+		path := rt.SpecPath()
+		if spec.Paths[path] == nil {
+			spec.Paths[path] = map[string]*OpenAPIOperation{}
+		}
+		spec.Paths[path][strings.ToLower(rt.Method)] = routeOperation(schemas, rt)
+	}
+	return spec, schemas
+}
+
+func routeOperation(schemas *apiutil.SchemaBuilder, rt *Route) *OpenAPIOperation {
+	op := &OpenAPIOperation{
+		Summary: rt.Summary,
+		Responses: map[string]*OpenAPIResponse{
+			"200": {Description: rt.Summary, Schema: responseSchema(schemas, rt)},
+		},
+	}
+	if rt.Tag != "" {
+		op.Tags = []string{rt.Tag}
+	}
+	if rt.Stream {
+		// see EventsHandler
+		op.Produces = []string{"text/event-stream"}
+	} else if rt.Method == "GET" {
+		// conditional requests, see withCaching
+		op.Responses["200"].Headers = map[string]*OpenAPIHeader{
+			"ETag":          {Type: "string", Description: "strong entity tag for the response body"},
+			"Last-Modified": {Type: "string", Description: "when the resource was last updated. single resources only"},
+			"Cache-Control": {Type: "string", Description: rt.CacheControlPolicy()},
+		}
+		op.Responses["304"] = &OpenAPIResponse{Description: "Not Modified, the If-None-Match or If-Modified-Since header matched"}
+	}
+	if rt.Resource != nil || rt.Export {
+		// lists can be exported, see writeExport
+		op.Produces = []string{
+			apiutil.FormatJSON.ContentType(),
+			apiutil.FormatCSV.ContentType(),
+			apiutil.FormatNDJSON.ContentType(),
+		}
+	}
+	if rt.Method == "PATCH" {
+		// see patchResource
+		op.Consumes = acceptPatch
+		op.Responses["409"] = &OpenAPIResponse{Description: "Conflict, the patch can't be applied to the current version", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+		op.Responses["415"] = &OpenAPIResponse{Description: "Unsupported Media Type, the Content-Type isn't a supported patch format", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+	}
+	if rt.Method == "PUT" && !rt.Batch && trashResource(rt.Tag) != nil {
+		// see checkTrash
+		op.Responses["409"] = &OpenAPIResponse{Description: "Conflict, the resource is in the trash, restore it first", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+	}
+	if rt.Raw {
+		op.Responses["default"] = &OpenAPIResponse{Description: "Error", Schema: op.Responses["200"].Schema}
+	} else {
+		op.Responses["default"] = &OpenAPIResponse{Description: "Error", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+	}
+
+	for _, p := range rt.PathParams() {
+		param := &OpenAPIParameter{Name: p.Name, In: "path", Required: true, Type: "string"}
+		switch p.Type {
+		case "int":
+			param.Type = "integer"
+		case "uuid":
+			param.Format = "uuid"
+		}
+		op.Parameters = append(op.Parameters, param)
+	}
+	params := rt.Params()
+	for _, p := range params {
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{
+			Name:        p.Name,
+			In:          "query",
+			Description: p.Description,
+			Required:    p.Required,
+			Type:        p.Type,
+		})
+	}
+	if rt.Stream {
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{
+			Name:        "Last-Event-ID",
+			In:          "header",
+			Description: "id of the last event received. the stream starts with the events after it that are still in the log",
+			Type:        "string",
+		})
+	}
+	if rt.Conditional() {
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{
+			Name:        "If-Match",
+			In:          "header",
+			Description: "current ETag or updated time of the resource. required to modify a resource that already exists. ETags of GETs with fields or expand don't match",
+			Type:        "string",
+		})
+		op.Responses["412"] = &OpenAPIResponse{
+			Description: "Precondition Failed, the resource has changed. data is the current version",
+			Schema:      preconditionFailedSchema(schemas, rt),
+		}
+		op.Responses["428"] = &OpenAPIResponse{
+			Description: "Precondition Required, modifying an existing resource requires If-Match",
+			Schema:      &apiutil.Schema{Ref: "#/definitions/Error"},
+		}
+		if rt.Method != "DELETE" {
+			op.Responses["200"].Headers = map[string]*OpenAPIHeader{
+				"ETag":          {Type: "string", Description: "the resource's new ETag, for the next If-Match"},
+				"Last-Modified": {Type: "string", Description: "when the resource was last updated"},
+			}
+		}
+	}
+	if rt.Admin {
+		// see requireAdmin
+		op.Responses["403"] = &OpenAPIResponse{Description: "Forbidden, the request isn't from an admin", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+	} else if rt.SignedIn {
+		// see requireSignIn
+		op.Responses["403"] = &OpenAPIResponse{Description: "Forbidden, the request isn't from a signed in user", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+	}
+	if rt.Idempotent {
+		// see withIdempotency
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{
+			Name:        idempotencyKeyHeader,
+			In:          "header",
+			Description: "unique key for this request. retries with the same key get the first response back instead of being handled again",
+			Type:        "string",
+		})
+		op.Responses["200"].Headers = map[string]*OpenAPIHeader{
+			idempotencyReplayedHeader: {Type: "string", Description: "true if the response was replayed for a retried Idempotency-Key"},
+		}
+		op.Responses["409"] = &OpenAPIResponse{Description: "Conflict, a request with the same Idempotency-Key is still being handled", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+	}
+	if rt.Body != nil {
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: "body", In: "body", Required: true, Schema: schemas.SchemaFor(rt.Body)})
+		// see decodeBody
+		op.Responses["413"] = &OpenAPIResponse{Description: "Request Entity Too Large", Schema: &apiutil.Schema{Ref: "#/definitions/Error"}}
+		op.Responses["422"] = &OpenAPIResponse{Description: "Unprocessable Entity, the body has unknown fields or fails validation", Schema: &apiutil.Schema{Ref: "#/definitions/ValidationError"}}
+	}
+	if rt.Batch && rt.Method == "PUT" {
+		// see writeBatchUpsert
+		s := validationErrorSchema(schemas)
+		s.Required = []string{"meta"}
+		s.Properties["data"] = responseSchema(schemas, rt).Properties["data"]
+		op.Responses["422"] = &OpenAPIResponse{Description: "Unprocessable Entity, the body is invalid or an item failed & nothing was saved. data has the result of each item", Schema: s}
+	}
+	return op
+}
+
+// responseSchema wraps a route's response type in the standard envelope
+func responseSchema(schemas *apiutil.SchemaBuilder, rt *Route) *apiutil.Schema {
+	data := schemas.SchemaFor(rt.Response)
+	if rt.Batch {
+		data = &apiutil.Schema{Type: "array", Items: batchResultSchema(schemas, data), Nullable: true}
+	}
+	if rt.List || rt.Paginated {
+		data = &apiutil.Schema{Type: "array", Items: data, Nullable: true}
+	}
+	if rt.Raw || rt.Stream {
+		return data
+	}
+
+	env := &apiutil.Schema{
+		Type:     "object",
+		Required: []string{"meta", "data"},
+		Properties: map[string]*apiutil.Schema{
+			"meta": {Type: "object", Properties: map[string]*apiutil.Schema{
+				"code": {Type: "integer"},
+			}},
+			"data": data,
+		},
+	}
+	if rt.Paginated {
+		env.Required = append(env.Required, "pagination")
+		env.Properties["pagination"] = &apiutil.Schema{Type: "object", Properties: map[string]*apiutil.Schema{
+			"nextUrl": {Type: "string"},
+		}}
+	}
+	return env
+}
+
+// preconditionFailedSchema describes the error envelope conditionalWrite
+// responds with for stale writes, which includes the current resource if
+// there is one
+func preconditionFailedSchema(schemas *apiutil.SchemaBuilder, rt *Route) *apiutil.Schema {
+	s := errorSchema()
+	s.Properties["data"] = schemas.SchemaFor(rt.Response)
+	return s
+}
+
+// batchResultSchema describes a BatchResult holding data
+func batchResultSchema(schemas *apiutil.SchemaBuilder, data *apiutil.Schema) *apiutil.Schema {
+	def, _ := schemas.Resolve(schemas.SchemaFor(BatchResult{}))
+	s := *def
+	s.Properties = map[string]*apiutil.Schema{}
+	for name, prop := range def.Properties {
+		s.Properties[name] = prop
+	}
+	s.Properties["data"] = data
+	return &s
+}
+
+// validationErrorSchema describes the envelope written by
+// apiutil.WriteValidationErrResponse
+func validationErrorSchema(schemas *apiutil.SchemaBuilder) *apiutil.Schema {
+	s := errorSchema()
+	s.Required = append(s.Required, "errors")
+	s.Properties["errors"] = &apiutil.Schema{Type: "array", Items: schemas.SchemaFor(apiutil.FieldError{})}
+	return s
+}
+
+// errorSchema describes the envelope written by apiutil.WriteErrResponse
+func errorSchema() *apiutil.Schema {
+	return &apiutil.Schema{
+		Type:     "object",
+		Required: []string{"meta"},
+		Properties: map[string]*apiutil.Schema{
+			"meta": {Type: "object", Required: []string{"code", "error"}, Properties: map[string]*apiutil.Schema{
+				"code":  {Type: "integer"},
+				"error": {Type: "string"},
+			}},
+		},
+	}
+}
+
+// OpenAPIJSONHandler serves the generated api spec as JSON
+func OpenAPIJSONHandler(w http.ResponseWriter, r *http.Request) {
+	spec, _ := getAPISpec()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(spec); err != nil {
+		log.Info(err)
+	}
+}
+
+// OpenAPIYAMLHandler serves the generated api spec as YAML
+func OpenAPIYAMLHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	if err := writeAPISpecYAML(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeAPISpecYAML encodes the generated spec as YAML. The spec is
+// round-tripped through JSON first so json tags determine key names
+func writeAPISpecYAML(w io.Writer) error {
+	spec, _ := getAPISpec()
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	data, err = yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// openAPICommand runs the "openapi" subcommand, printing the generated
+// spec as YAML. "api openapi > open_api.yaml" updates the copy checked
+// into this repo
+func openAPICommand(out io.Writer) int {
+	if err := writeAPISpecYAML(out); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
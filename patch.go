@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/sql_datastore"
+)
+
+// acceptPatch lists the patch formats PATCH routes accept, for the
+// Accept-Patch header & the api spec
+var acceptPatch = []string{apiutil.MergePatchType, apiutil.JSONPatchType}
+
+// patch is a parsed PATCH request body
+type patch struct {
+	merge interface{}
+	ops   []apiutil.PatchOp
+	json  bool
+}
+
+// apply patches a decoded JSON document
+func (p *patch) apply(doc interface{}) (interface{}, error) {
+	if p.json {
+		return apiutil.JSONPatch(doc, p.ops)
+	}
+	return apiutil.MergePatch(doc, p.merge), nil
+}
+
+// readPatch parses a PATCH request body according to its Content-Type,
+// responding with a 415 for formats we don't support, a 413 for patches over
+// maxBodySize & a 400 for malformed patches. returns nil if it responded
+func readPatch(w http.ResponseWriter, r *http.Request) *patch {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != apiutil.MergePatchType && mediatype != apiutil.JSONPatchType {
+		w.Header().Set("Accept-Patch", strings.Join(acceptPatch, ", "))
+		apiutil.WriteErrResponse(w, http.StatusUnsupportedMediaType, fmt.Errorf("PATCH requires a Content-Type of %s", strings.Join(acceptPatch, " or ")))
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		writeBodyErr(w, apiutil.ErrBodyTooLarge)
+		return nil
+	} else if err != nil {
+		writeBodyErr(w, err)
+		return nil
+	}
+
+	p := &patch{json: mediatype == apiutil.JSONPatchType}
+	if p.json {
+		p.ops, err = apiutil.ParseJSONPatch(body)
+	} else if err = json.Unmarshal(body, &p.merge); err != nil {
+		err = fmt.Errorf("merge patch isn't valid JSON: %s", err)
+	}
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return nil
+	}
+	return p
+}
+
+// patchResource applies the request's patch to the stored version of a
+// resource & saves the result, all under conditionalWrite so PATCH follows
+// the same If-Match rules as PUT. The patched document is decoded into model
+// as strictly as a PUT body, then save is called with the write's
+// transaction & the stored version, for fields that can't round-trip through
+// JSON. Patches that can't be
+// applied get a 409, patched documents that don't decode a 422, save should
+// validate model. patchResource writes an error response & returns false if
+// the write didn't happen
+func patchResource(w http.ResponseWriter, r *http.Request, kind, id string, read readCurrent, model sql_datastore.Model, save func(ts txStore, current interface{}) error) bool {
+	p := readPatch(w, r)
+	if p == nil {
+		return false
+	}
+
+	var current interface{}
+	keep := func() (interface{}, time.Time, error) {
+		data, updated, err := read()
+		current = data
+		return data, updated, err
+	}
+
+	return conditionalWrite(w, r, kind, id, keep, func(ts txStore) (sql_datastore.Model, error) {
+		data, err := json.Marshal(current)
+		if err != nil {
+			return nil, err
+		}
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+
+		if doc, err = p.apply(doc); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+		if err := apiutil.DecodeStrict(bytes.NewReader(data), model); err != nil {
+			if _, ok := err.(*apiutil.ValidationError); !ok {
+				err = &apiutil.ValidationError{Errors: []*apiutil.FieldError{
+					{Field: "(root)", Code: apiutil.CodeInvalidType, Message: err.Error()},
+				}}
+			}
+			return nil, err
+		}
+		return model, save(ts, current)
+	})
+}
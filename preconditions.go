@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+var (
+	errIfMatchRequired = fmt.Errorf("this resource already exists, updating or deleting it requires an If-Match header with its current ETag or updated time. use the ETag of a GET without fields or expand")
+	errStaleWrite      = fmt.Errorf("resource has changed since it was read, the current version is included")
+)
+
+// kindLocks are locks that writes of a kind take before they lock the
+// resource itself. primer moves are checked against the whole hierarchy,
+// see validatePrimer
+var kindLocks = map[string]string{
+	"primers": "primers:hierarchy",
+}
+
+// lockKind takes kind's lock in tx, if it has one. it must be taken before
+// any resource locks, or two writers could each hold a lock the other is
+// waiting for
+func lockKind(tx *sql.Tx, kind string) error {
+	name, ok := kindLocks[kind]
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(qLockResource, name)
+	return err
+}
+
+// readCurrent reads the current version of a resource for conditionalWrite,
+// returning it as GET would respond with it & its updated time
+type readCurrent func() (data interface{}, updated time.Time, err error)
+
+// conditionalWrite runs write if the request's If-Match header matches the
+// current version of the resource read returns, so clients can't overwrite
+// changes they haven't seen. Updates, patches & deletes of existing
+// resources must send If-Match: without it they get a 428, if it's stale
+// they get a 412 with the current version so they can merge. Resources that
+// don't exist yet can be created without it, patching or deleting them is a
+// 404. ETags are compared with the ETag of the plain GET response: GETs with
+// fields or expand respond with another representation & another ETag, so
+// clients using them should send the updated time instead. Successful
+// updates respond with the new ETag, for the next write.
+//
+// A lock on the resource's kind & id is held from reading the current
+// version until write returns, so concurrent writers can't both pass the
+// check. Writes without an id always create. write runs in a transaction
+// with ts & returns the model it saved, nil for deletes. An audit event is
+// recorded & webhook deliveries are queued in the same transaction, see
+// recordAudit & queueWebhooks. conditionalWrite writes an error response &
+// returns false if the write didn't happen
+func conditionalWrite(w http.ResponseWriter, r *http.Request, kind, id string, read readCurrent, write func(ts txStore) (sql_datastore.Model, error)) bool {
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+	defer tx.Rollback()
+
+	if err := lockKind(tx, kind); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+	var (
+		data    interface{}
+		updated time.Time
+		exists  bool
+		// read is bound to the id in the request, creates without one can't
+		// read what they saved
+		readable = id != ""
+	)
+	if id != "" {
+		if _, err := tx.Exec(qLockResource, kind+":"+id); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return false
+		}
+		data, updated, err = read()
+		exists = err == nil
+		if err != nil && !isNotFound(err) {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return false
+		}
+		// deleting or patching something in the trash is a 404 below
+		if !exists && r.Method != "DELETE" && r.Method != "PATCH" {
+			if trashed, err := checkTrash(tx, kind, id); err != nil {
+				apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+				return false
+			} else if trashed {
+				apiutil.WriteErrResponse(w, http.StatusConflict, errInTrash)
+				return false
+			}
+		}
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	switch {
+	case !exists && (r.Method == "DELETE" || r.Method == "PATCH"):
+		apiutil.WriteErrResponse(w, http.StatusNotFound, core.ErrNotFound)
+		return false
+	case !exists && ifMatch != "":
+		apiutil.WriteErrResponse(w, http.StatusPreconditionFailed, core.ErrNotFound)
+		return false
+	case exists && ifMatch == "":
+		apiutil.WriteErrResponse(w, http.StatusPreconditionRequired, errIfMatchRequired)
+		return false
+	case exists:
+		etag, err := apiutil.ResponseETag(data)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return false
+		}
+		if !apiutil.IfMatch(ifMatch, etag, updated) {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+			apiutil.WriteErrDataResponse(w, http.StatusPreconditionFailed, errStaleWrite, data)
+			return false
+		}
+	}
+
+	ts := txStore{tx: tx}
+	var before interface{}
+	if exists {
+		if before, err = auditSnapshot(ts, kind, id); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return false
+		}
+	}
+
+	saved, err := write(ts)
+	if err != nil {
+		writeWriteErr(w, err)
+		return false
+	}
+
+	action, after := auditDelete, interface{}(nil)
+	if saved != nil {
+		action, id = auditUpdate, saved.GetId()
+		if !exists {
+			action = auditCreate
+		}
+		if after, err = auditSnapshot(ts, kind, id); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return false
+		}
+	}
+	if err := recordAudit(tx, r, action, kind, id, before, after); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if err := queueWebhooks(tx, action, kind, before, after); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if saved != nil && readable {
+		if data, updated, err := read(); err == nil {
+			if etag, err := apiutil.ResponseETag(data); err == nil {
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+			}
+		}
+	}
+	return true
+}
+
+// writeWriteErr responds to an error returned by a conditionalWrite write
+// func
+func writeWriteErr(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *apiutil.ValidationError:
+		apiutil.WriteValidationErrResponse(w, e)
+	case *apiutil.PatchError:
+		apiutil.WriteErrResponse(w, http.StatusConflict, err)
+	default:
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+	}
+}
+
+// isNotFound checks for the not found errors models & the datastore return
+func isNotFound(err error) bool {
+	return err == core.ErrNotFound || err == datastore.ErrNotFound
+}
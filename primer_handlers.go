@@ -3,36 +3,22 @@ package main
 import (
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
 	"net/http"
+	"time"
 )
 
-func PrimerHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetPrimerHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func PrimersHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		ListPrimersHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func GetPrimerHandler(w http.ResponseWriter, r *http.Request) {
 	res := &core.Primer{}
 	args := &PrimersGetArgs{
-		Id: r.URL.Path[len("/primers/"):],
+		Id:     apiutil.PathParam(r, "id"),
+		Expand: requestExpansions(r),
 	}
 	err := new(Primers).Get(args, res)
-	if err != nil {
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -40,17 +26,100 @@ func GetPrimerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListPrimersHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, primersResource) {
+		return
+	}
 	p := apiutil.PageFromRequest(r)
+	q, err := primersResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
 	res := make([]*core.Primer, p.Size)
 	args := &PrimersListArgs{
-		Limit:   p.Limit(),
-		Offset:  p.Offset(),
-		OrderBy: "created",
+		Query:  q,
+		Limit:  p.Limit(),
+		Offset: p.Offset(),
+		Expand: requestExpansions(r),
 	}
-	err := new(Primers).List(args, &res)
+	err = new(Primers).List(args, &res)
 	if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
 	apiutil.WritePageResponse(w, res, r, p)
 }
+
+func ListPrimerSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	res := []*core.Source{}
+	args := &PrimersSourcesArgs{
+		Id:     apiutil.PathParam(r, "id"),
+		Expand: requestExpansions(r),
+	}
+	err := new(Primers).Sources(args, &res)
+	if err == core.ErrNotFound {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, res)
+}
+
+func SavePrimerHandler(w http.ResponseWriter, r *http.Request) {
+	m := &core.Primer{}
+	if !decodeBody(w, r, m) {
+		return
+	}
+	m.Id = apiutil.PathParam(r, "id")
+	if !conditionalWrite(w, r, "primers", m.Id, currentPrimer(m.Id), func(ts txStore) (sql_datastore.Model, error) {
+		if err := validatePrimer(ts.tx, m); err != nil {
+			return nil, err
+		}
+		return m, savePrimer(ts, m)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, m)
+}
+
+func PatchPrimerHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	m := &core.Primer{}
+	if !patchResource(w, r, "primers", id, currentPrimer(id), m, func(ts txStore, current interface{}) error {
+		m.Id = id
+		if err := validatePrimer(ts.tx, m); err != nil {
+			return err
+		}
+		return savePrimer(ts, m)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, m)
+}
+
+func DeletePrimerHandler(w http.ResponseWriter, r *http.Request) {
+	writeSoftDelete(w, r, primersResource, currentPrimer(apiutil.PathParam(r, "id")))
+}
+
+func RestorePrimerHandler(w http.ResponseWriter, r *http.Request) {
+	writeRestore(w, r, primersResource, currentPrimer(apiutil.PathParam(r, "id")))
+}
+
+func BatchGetPrimersHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchGet(w, r, primersResource)
+}
+
+func BatchUpsertPrimersHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchUpsert(w, r, "primers", upsertPrimer)
+}
+
+// currentPrimer reads a primer for conditionalWrite, as GET responds with it
+func currentPrimer(id string) readCurrent {
+	return func() (interface{}, time.Time, error) {
+		res := &core.Primer{}
+		err := new(Primers).Get(&PrimersGetArgs{Id: id}, res)
+		return res, res.Updated, err
+	}
+}
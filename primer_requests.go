@@ -1,13 +1,18 @@
 package main
 
 import (
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	datastore "github.com/ipfs/go-datastore"
 )
 
 type Primers int
 
 type PrimersGetArgs struct {
 	Id string
+	// Expand lists related resources to embed, see expandPrimers
+	Expand apiutil.Expansions
 }
 
 func (u *Primers) Get(args *PrimersGetArgs, res *core.Primer) (err error) {
@@ -18,22 +23,98 @@ func (u *Primers) Get(args *PrimersGetArgs, res *core.Primer) (err error) {
 	if err != nil {
 		return err
 	}
+	if err = expandPrimers(appDB, []*core.Primer{p}, args.Expand); err != nil {
+		return err
+	}
 
 	*res = *p
 	return nil
 }
 
 type PrimersListArgs struct {
-	OrderBy string
-	Limit   int
-	Offset  int
+	// Query holds filters & sort order, nil lists everything in the
+	// resource's default order
+	Query  *apiutil.ListQuery
+	Limit  int
+	Offset int
+	Expand apiutil.Expansions
 }
 
 func (u *Primers) List(args *PrimersListArgs, res *[]*core.Primer) (err error) {
-	ps, err := core.ListPrimers(store, args.Limit, args.Offset)
+	list := make([]*core.Primer, 0, args.Limit)
+	err = queryList(appDB, primersResource, args.Query, args.Limit, args.Offset, func(row sqlutil.Scannable) error {
+		m := &core.Primer{}
+		if err := m.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	*res = ps
+	if err = expandPrimers(appDB, list, args.Expand); err != nil {
+		return err
+	}
+	*res = list
+	return nil
+}
+
+type PrimersSourcesArgs struct {
+	Id     string
+	Expand apiutil.Expansions
+}
+
+// Sources lists the sources that belong to a primer
+func (u *Primers) Sources(args *PrimersSourcesArgs, res *[]*core.Source) (err error) {
+	p := &core.Primer{
+		Id: args.Id,
+	}
+	if err = p.Read(store); err != nil {
+		return err
+	}
+	if err = p.ReadSources(appDB); err != nil {
+		return err
+	}
+	if err = expandSources(appDB, p.Sources, args.Expand); err != nil {
+		return err
+	}
+	*res = p.Sources
+	return nil
+}
+
+// Save writes a primer. stats are calculated rather than edited & are
+// left out of responses unless expanded, so a primer saved without stats
+// keeps its stored stats
+func (u *Primers) Save(model *core.Primer, res *core.Primer) (err error) {
+	err = savePrimer(store, model)
+	if err != nil {
+		return err
+	}
+
+	*res = *model
+	return nil
+}
+
+// savePrimer saves a primer to st, keeping its stored stats if it doesn't
+// have any
+func savePrimer(st datastore.Datastore, model *core.Primer) error {
+	if model.Stats == nil && model.Id != "" {
+		stored := &core.Primer{Id: model.Id}
+		if err := stored.Read(st); err == nil {
+			model.Stats = stored.Stats
+		}
+	}
+	return model.Save(st)
+}
+
+// Delete moves a primer to the trash, see softDelete
+func (u *Primers) Delete(model *core.Primer, res *core.Primer) (err error) {
+	err = softDelete(appDB, primersResource, model.Id)
+	if err != nil {
+		return err
+	}
+
+	*res = *model
 	return nil
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+)
+
+// PrimerNode is a primer's place in the primer hierarchy
+type PrimerNode struct {
+	Id         string            `json:"id"`
+	ParentId   string            `json:"parentId"`
+	ShortTitle string            `json:"shortTitle"`
+	Title      string            `json:"title"`
+	Stats      *core.PrimerStats `json:"stats"`
+	// Depth is how many steps the primer is from the start of the query,
+	// down for trees & up for ancestors
+	Depth    int           `json:"depth"`
+	Children []*PrimerNode `json:"children,omitempty"`
+}
+
+// UnmarshalSQL reads a node from a row of primerNodeColumns
+func (n *PrimerNode) UnmarshalSQL(row sqlutil.Scannable) error {
+	var stats []byte
+	if err := row.Scan(&n.Id, &n.ParentId, &n.ShortTitle, &n.Title, &stats, &n.Depth); err != nil {
+		return err
+	}
+	if stats != nil {
+		n.Stats = &core.PrimerStats{}
+		return json.Unmarshal(stats, n.Stats)
+	}
+	return nil
+}
+
+// readPrimerNodes runs a primer hierarchy query, in the order it returns
+func readPrimerNodes(query string, args ...interface{}) ([]*PrimerNode, error) {
+	rows, err := appDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := []*PrimerNode{}
+	for rows.Next() {
+		n := &PrimerNode{}
+		if err := n.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// nestPrimerNodes puts nodes under their parents, returning the nodes at
+// depth 0. nodes must be ordered by depth, as tree queries return them
+func nestPrimerNodes(nodes []*PrimerNode) []*PrimerNode {
+	roots := []*PrimerNode{}
+	byId := map[string]*PrimerNode{}
+	for _, n := range nodes {
+		byId[n.Id] = n
+		if n.Depth == 0 {
+			roots = append(roots, n)
+		} else if parent := byId[n.ParentId]; parent != nil {
+			parent.Children = append(parent.Children, n)
+		}
+	}
+	return roots
+}
+
+// PrimerTreeHandler responds with the whole primer hierarchy, a list of
+// the primers at the top with their sub-primers nested under them
+func PrimerTreeHandler(w http.ResponseWriter, r *http.Request) {
+	nodes, err := readPrimerNodes(qPrimersTree)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, nestPrimerNodes(nodes))
+}
+
+// PrimerSubtreeHandler responds with a primer & its sub-primers nested
+// under it, down to the depth query param if it's set
+func PrimerSubtreeHandler(w http.ResponseWriter, r *http.Request) {
+	depth := -1
+	if v := r.URL.Query().Get("depth"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("invalid depth: '%s'. expected a number 0 or more", v))
+			return
+		}
+		depth = d
+	}
+
+	nodes, err := readPrimerNodes(qPrimerSubtree, apiutil.PathParam(r, "id"), depth)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(nodes) == 0 {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, core.ErrNotFound)
+		return
+	}
+	apiutil.WriteResponse(w, nestPrimerNodes(nodes)[0])
+}
+
+// PrimerAncestorsHandler responds with a primer's ancestors for
+// breadcrumbs, starting from the top of the hierarchy & ending with the
+// primer's parent
+func PrimerAncestorsHandler(w http.ResponseWriter, r *http.Request) {
+	nodes, err := readPrimerNodes(qPrimerAncestors, apiutil.PathParam(r, "id"))
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(nodes) == 0 {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, core.ErrNotFound)
+		return
+	}
+	// nodes run from the primer up, drop it & put the top first
+	ancestors := make([]*PrimerNode, 0, len(nodes)-1)
+	for i := len(nodes) - 1; i > 0; i-- {
+		ancestors = append(ancestors, nodes[i])
+	}
+	apiutil.WriteResponse(w, ancestors)
+}
@@ -0,0 +1,715 @@
+package main
+
+// select the names of any of the passed-in tables that exist in the current schema
+const qSchemaTablesPresent = `
+SELECT table_name
+FROM information_schema.tables
+WHERE
+  table_schema = current_schema() AND
+  table_name = ANY($1);`
+
+// primers with any of the given ids, for embedding referenced primers
+const qPrimersByIds = `
+SELECT
+  id, created, updated, short_title, title, description,
+  parent_id, stats, meta
+FROM primers
+WHERE
+  deleted = false AND
+  id = ANY($1);`
+
+// child primers of any of the given primers
+const qPrimersByParentIds = `
+SELECT
+  id, created, updated, short_title, title, description,
+  parent_id, stats, meta
+FROM primers
+WHERE
+  deleted = false AND
+  parent_id = ANY($1)
+ORDER BY created;`
+
+// sources belonging to any of the given primers
+const qSourcesByPrimerIds = `
+SELECT
+  id, created, updated, title, description, url, primer_id, crawl, stale_duration,
+  last_alert_sent, meta, stats
+FROM sources
+WHERE
+  deleted = false AND
+  primer_id = ANY($1)
+ORDER BY created;`
+
+// take a transaction-scoped lock on a resource key, see conditionalWrite
+const qLockResource = `SELECT pg_advisory_xact_lock(hashtext($1));`
+
+// whether a primer that hasn't been deleted exists, for validating references
+const qPrimerExists = `SELECT exists(SELECT 1 FROM primers WHERE id = $1 AND deleted = false);`
+
+// claim idempotency key $2 in scope $1 for a new request. a key that's
+// expired, or held by a request that has taken longer than the lock timeout,
+// is taken over. returns no rows if the key is in use
+const qIdempotencyKeyClaim = `
+INSERT INTO idempotency_keys (scope, key, fingerprint)
+VALUES ($1, $2, $3)
+ON CONFLICT (scope, key) DO UPDATE SET
+  fingerprint = EXCLUDED.fingerprint,
+  created = EXCLUDED.created,
+  status = 0,
+  header = null,
+  body = null
+WHERE
+  idempotency_keys.created < (now() at time zone 'utc') - $4::double precision * interval '1 second' OR
+  (idempotency_keys.status = 0 AND idempotency_keys.created < (now() at time zone 'utc') - $5::double precision * interval '1 second')
+RETURNING key;`
+
+// an idempotency key & the response stored for it
+const qIdempotencyKeyRead = `
+SELECT fingerprint, status, coalesce(header, '{}'), coalesce(body, '')
+FROM idempotency_keys
+WHERE scope = $1 AND key = $2;`
+
+// store the response to the request holding an idempotency key
+const qIdempotencyKeyComplete = `
+UPDATE idempotency_keys
+SET status = $3, header = $4, body = $5
+WHERE scope = $1 AND key = $2;`
+
+// give up an idempotency key so the request can be retried
+const qIdempotencyKeyRelease = `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status = 0;`
+
+// remove idempotency keys older than a number of seconds
+const qIdempotencyKeysPrune = `
+DELETE FROM idempotency_keys
+WHERE created < (now() at time zone 'utc') - $1::double precision * interval '1 second';`
+
+// move a row of a trashable table to the trash, see softDelete. %s is the
+// table name
+const qTrashDelete = `
+UPDATE %s
+SET deleted = true, deleted_at = (now() at time zone 'utc')
+WHERE deleted = false AND id = $1;`
+
+// take a row of a trashable table out of the trash, see restoreFromTrash.
+// %s is the table name
+const qTrashRestore = `
+UPDATE %s
+SET deleted = false, deleted_at = null
+WHERE deleted = true AND id = $1;`
+
+// whether a row of a trashable table is in the trash. %s is the table name
+const qTrashHas = `SELECT exists(SELECT 1 FROM %s WHERE deleted = true AND id = $1);`
+
+// a page of a trashable table's trash, most recently deleted first. the
+// first %s is the table's columns, the second the table name
+const qTrashList = `
+SELECT %s, deleted_at
+FROM %s
+WHERE deleted = true
+ORDER BY deleted_at DESC NULLS LAST, id
+LIMIT $1 OFFSET $2;`
+
+// whether a trashed primer's parent is also in the trash
+const qTrashPrimerParentDeleted = `
+SELECT exists(
+  SELECT 1 FROM primers parent, primers p
+  WHERE p.id = $1 AND parent.id::text = p.parent_id AND parent.deleted = true
+);`
+
+// whether a trashed source's primer is also in the trash
+const qTrashSourcePrimerDeleted = `
+SELECT exists(
+  SELECT 1 FROM primers, sources
+  WHERE sources.id = $1 AND primers.id = sources.primer_id AND primers.deleted = true
+);`
+
+// hard delete sources that have been in the trash for more than a number of
+// seconds, returning their ids
+const qTrashPurgeSources = `
+DELETE FROM sources
+WHERE
+  deleted = true AND
+  deleted_at < (now() at time zone 'utc') - $1::double precision * interval '1 second'
+RETURNING id::text;`
+
+// hard delete uncrawlables that have been in the trash for more than a
+// number of seconds, returning their ids
+const qTrashPurgeUncrawlables = `
+DELETE FROM uncrawlables
+WHERE
+  deleted = true AND
+  deleted_at < (now() at time zone 'utc') - $1::double precision * interval '1 second'
+RETURNING id::text;`
+
+// hard delete primers that have been in the trash for more than a number of
+// seconds, returning their ids. primers with sources or child primers are kept, deleting them
+// would cascade to sources that haven't been purged
+const qTrashPurgePrimers = `
+DELETE FROM primers p
+WHERE
+  deleted = true AND
+  deleted_at < (now() at time zone 'utc') - $1::double precision * interval '1 second' AND
+  NOT EXISTS (SELECT 1 FROM sources WHERE sources.primer_id = p.id) AND
+  NOT EXISTS (SELECT 1 FROM primers child WHERE child.parent_id = p.id::text)
+RETURNING id::text;`
+
+// record a change made through the api, see recordAudit
+const qAuditEventInsert = `
+INSERT INTO audit_events
+  (actor_id, actor_name, ip, resource_type, resource_id, action, diff)
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7);`
+
+// latest change event id, 0 if there aren't any. see listenForChanges
+const qChangeEventsLatest = `SELECT coalesce(max(id), 0) FROM change_events;`
+
+// oldest change event id still in the log, 0 if there aren't any
+const qChangeEventsOldest = `SELECT coalesce(min(id), 0) FROM change_events;`
+
+// change events after an id, up to & including another, oldest first
+const qChangeEventsSince = `
+SELECT id, created, resource_type, resource_id, action
+FROM change_events
+WHERE id > $1 AND id <= $2
+ORDER BY id
+LIMIT $3;`
+
+// the oldest transaction still running & the id the next transaction will
+// get. see changeCursor
+const qTxidHorizon = `SELECT txid_snapshot_xmin(s), txid_snapshot_xmax(s) FROM txid_current_snapshot() s;`
+
+// trim the change event log to the most recent n events
+const qChangeEventsPrune = `
+DELETE FROM change_events
+WHERE id <= (SELECT max(id) FROM change_events) - $1;`
+
+// webhook columns, in the order Webhook.UnmarshalSQL reads them
+const webhookColumns = `id, created, updated, url, events, agency_id, created_by`
+
+const qWebhookInsert = `
+INSERT INTO webhooks
+  (id, created, updated, url, events, agency_id, created_by, secret)
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8);`
+
+const qWebhookRead = `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = $1;`
+
+// webhooks registered by $1, or every webhook if $1 is empty
+const qWebhooksList = `
+SELECT ` + webhookColumns + `
+FROM webhooks
+WHERE $1 = '' OR created_by = $1
+ORDER BY created DESC;`
+
+const qWebhookDelete = `DELETE FROM webhooks WHERE id = $1;`
+
+// queue a delivery of an event to every webhook subscribed to it. $3 is
+// the agency of uncrawlable events, null for events without one
+const qWebhookDeliveriesQueue = `
+INSERT INTO webhook_deliveries (webhook_id, event, payload)
+SELECT id, $1::text, $2::jsonb
+FROM webhooks
+WHERE
+  $1 = ANY(events) AND
+  (agency_id = '' OR $3::text IS NULL OR agency_id = $3);`
+
+// webhook delivery columns, in the order WebhookDelivery.UnmarshalSQL
+// reads them
+const webhookDeliveryColumns = `id, created, webhook_id, event, payload, status, attempts, next_attempt, last_attempt, response_code, error`
+
+const qWebhookDeliveriesList = `
+SELECT ` + webhookDeliveryColumns + `
+FROM webhook_deliveries
+WHERE webhook_id = $1
+ORDER BY created DESC, id DESC
+LIMIT $2 OFFSET $3;`
+
+// queue a copy of a delivery to be sent again
+const qWebhookDeliveryRedeliver = `
+INSERT INTO webhook_deliveries (webhook_id, event, payload)
+SELECT webhook_id, event, payload
+FROM webhook_deliveries
+WHERE webhook_id = $1 AND id = $2
+RETURNING ` + webhookDeliveryColumns + `;`
+
+// claim up to $1 due deliveries for $2 seconds, so other instances don't
+// send them at the same time
+const qWebhookDeliveriesClaim = `
+UPDATE webhook_deliveries d
+SET
+  attempts = d.attempts + 1,
+  next_attempt = (now() at time zone 'utc') + $2::double precision * interval '1 second'
+FROM webhooks w
+WHERE
+  w.id = d.webhook_id AND
+  d.id IN (
+    SELECT id FROM webhook_deliveries
+    WHERE status = 'pending' AND next_attempt <= (now() at time zone 'utc')
+    ORDER BY next_attempt
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED
+  )
+RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret;`
+
+// record the result of a delivery attempt. failed attempts that can be
+// retried stay pending until $6
+const qWebhookDeliveryResult = `
+UPDATE webhook_deliveries
+SET
+  status = $2,
+  response_code = $3,
+  error = $4,
+  last_attempt = $5,
+  next_attempt = $6
+WHERE id = $1;`
+
+// alert columns, in the order Alert.UnmarshalSQL reads them
+const alertColumns = `id, created, source_id, url, kind, message, dismissed_at, dismissed_by`
+
+const qAlertRead = `SELECT ` + alertColumns + ` FROM alerts WHERE id = $1;`
+
+// take a batch of url alert checks off the queue
+const qUrlAlertChecksTake = `
+DELETE FROM url_alert_checks
+WHERE id IN (
+  SELECT id FROM url_alert_checks
+  ORDER BY id
+  LIMIT $1
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING url, previous_hash, hash, previous_status, status;`
+
+// alertNotSuppressed is a condition on a source s that excludes alerts
+// matching a live suppression. $1 is the url & $2 the kind
+const alertNotSuppressed = `
+  NOT EXISTS (
+    SELECT 1 FROM alert_suppressions x
+    WHERE
+      x.source_id = s.id AND
+      (x.url = '' OR x.url = $1) AND
+      (x.kind = '' OR x.kind = $2) AND
+      (x.until IS NULL OR x.until > (now() at time zone 'utc'))
+  )`
+
+// raise an alert about a url for every source it's under. sources that
+// already have the same alert open are skipped
+const qAlertsRaiseForUrl = `
+INSERT INTO alerts (source_id, url, kind, message)
+SELECT s.id, $1::text, $2::text, $3::text
+FROM sources s
+WHERE
+  s.deleted = false AND
+  $1 ILIKE '%' || s.url || '%' AND` + alertNotSuppressed + `
+ON CONFLICT (source_id, url, kind) WHERE dismissed_at IS NULL DO NOTHING
+RETURNING ` + alertColumns + `;`
+
+// sourceStaleAfter is how long a source s's urls can go unfetched before
+// they're stale, $3 seconds if the source doesn't set it
+const sourceStaleAfter = `CASE
+    WHEN s.stale_duration > 0 THEN s.stale_duration * interval '1 millisecond'
+    ELSE $3::double precision * interval '1 second'
+  END`
+
+// raise a stale alert for sources with urls that haven't been fetched
+// within the source's stale duration. urls count toward the source that
+// schedules them, see qUrlSchedulesRefresh. sources with a stale alert
+// dismissed within the stale duration are skipped, so dismissing one holds
+// until the urls go stale again. $1 is always empty & $2 is the stale kind,
+// so suppressions match the same way
+const qAlertsRaiseStale = `
+INSERT INTO alerts (source_id, url, kind, message)
+SELECT s.id, $1::text, $2::text, count(x.url) || ' urls haven''t been checked within the stale duration'
+FROM sources s
+JOIN url_schedules x ON x.source_id = s.id
+WHERE
+  s.deleted = false AND
+  x.last_get IS NOT NULL AND
+  x.last_get < (now() at time zone 'utc') - ` + sourceStaleAfter + ` AND
+  NOT EXISTS (
+    SELECT 1 FROM alerts a
+    WHERE
+      a.source_id = s.id AND
+      a.kind = $2 AND
+      a.dismissed_at > (now() at time zone 'utc') - ` + sourceStaleAfter + `
+  ) AND` + alertNotSuppressed + `
+GROUP BY s.id
+ON CONFLICT (source_id, url, kind) WHERE dismissed_at IS NULL DO NOTHING
+RETURNING ` + alertColumns + `;`
+
+// note when sources last had an alert raised
+const qSourcesAlertSent = `
+UPDATE sources SET last_alert_sent = $2
+WHERE id = ANY($1::uuid[]);`
+
+const qAlertDismiss = `
+UPDATE alerts
+SET dismissed_at = $2, dismissed_by = $3
+WHERE id = $1 AND dismissed_at IS NULL;`
+
+// alert suppression columns, in the order AlertSuppression.UnmarshalSQL
+// reads them
+const alertSuppressionColumns = `id, created, source_id, url, kind, until, created_by`
+
+const qAlertSuppressionInsert = `
+INSERT INTO alert_suppressions (source_id, url, kind, until, created_by)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING ` + alertSuppressionColumns + `;`
+
+const qAlertSuppressionsList = `SELECT ` + alertSuppressionColumns + ` FROM alert_suppressions ORDER BY created DESC;`
+
+const qAlertSuppressionRead = `SELECT ` + alertSuppressionColumns + ` FROM alert_suppressions WHERE id = $1;`
+
+const qAlertSuppressionDelete = `DELETE FROM alert_suppressions WHERE id = $1;`
+
+// urlNextDue is when url u, scheduled as x under source s, is next due.
+// $2 is the most its interval can be multiplied by, doubling for each fetch
+// that found the same content
+const urlNextDue = `CASE
+    WHEN u.last_get IS NULL THEN u.created
+    ELSE u.last_get + ` + sourceStaleAfter + ` * least(power(2, least(coalesce(x.unchanged_checks, 0), 30)), $2::integer)
+  END`
+
+// schedule urls under sources, see refreshUrlSchedules. if $1 is true every
+// url is matched to the most specific source it's under & rescheduled.
+// otherwise only new urls are matched, & scheduled urls keep their source:
+// they're rescheduled if they've been fetched since they were scheduled, or
+// their source has been updated since $4. $3 is the stale duration in
+// seconds for sources that don't set one
+const qUrlSchedulesRefresh = `
+WITH unscheduled AS (
+  SELECT u.url, u.created, u.last_get
+  FROM urls u
+  LEFT JOIN url_schedules x ON x.url = u.url
+  WHERE $1::boolean OR x.url IS NULL
+)
+INSERT INTO url_schedules (url, source_id, last_get, unchanged_checks, next_due, scheduled)
+SELECT u.url, s.id, u.last_get, coalesce(x.unchanged_checks, 0), ` + urlNextDue + `, (now() at time zone 'utc')
+FROM unscheduled u
+JOIN LATERAL (
+  SELECT id, stale_duration FROM sources
+  WHERE deleted = false AND u.url ILIKE '%' || sources.url || '%'
+  ORDER BY length(sources.url) DESC
+  LIMIT 1
+) s ON true
+LEFT JOIN url_schedules x ON x.url = u.url
+UNION ALL
+SELECT u.url, s.id, u.last_get, x.unchanged_checks, ` + urlNextDue + `, (now() at time zone 'utc')
+FROM url_schedules x
+JOIN urls u ON u.url = x.url
+JOIN sources s ON s.id = x.source_id AND s.deleted = false
+WHERE
+  NOT $1::boolean AND
+  (x.last_get IS DISTINCT FROM u.last_get OR s.updated > $4::timestamp)
+ON CONFLICT (url) DO UPDATE SET
+  source_id = EXCLUDED.source_id,
+  last_get = EXCLUDED.last_get,
+  next_due = EXCLUDED.next_due,
+  scheduled = EXCLUDED.scheduled;`
+
+// url schedule columns, in the order UrlSchedule.UnmarshalSQL reads them
+const urlScheduleColumns = `x.url, x.source_id, x.last_get, x.unchanged_checks, x.next_due`
+
+// a page of urls that are due, most overdue first
+const qUrlSchedulesDue = `
+SELECT ` + urlScheduleColumns + `
+FROM url_schedules x
+JOIN sources s ON s.id = x.source_id AND s.deleted = false
+WHERE x.next_due <= (now() at time zone 'utc')
+ORDER BY x.next_due, x.url
+LIMIT $1 OFFSET $2;`
+
+// a page of a source's urls that are due, most overdue first
+const qUrlSchedulesSourceDue = `
+SELECT ` + urlScheduleColumns + `
+FROM url_schedules x
+WHERE
+  x.source_id = $1 AND
+  x.next_due <= (now() at time zone 'utc')
+ORDER BY x.next_due, x.url
+LIMIT $2 OFFSET $3;`
+
+// take or check for the session-level advisory lock held by the leader
+const qLeaderTryLock = `SELECT pg_try_advisory_lock(hashtext($1));`
+
+// check the leader's connection is still alive
+const qLeaderCheck = `SELECT pg_backend_pid();`
+
+// job columns, in the order Job.UnmarshalSQL reads them
+const jobColumns = `id, created, updated, type, status, params, result, error, progress,
+  progress_message, attempts, max_attempts, run_after, started, finished,
+  cancel_requested, created_by`
+
+const qJobInsert = `
+INSERT INTO jobs (id, created, updated, type, params, max_attempts, run_after, created_by)
+VALUES ($1, $2, $2, $3, $4, $5, $2, $6)
+RETURNING ` + jobColumns + `;`
+
+const qJobRead = `SELECT ` + jobColumns + ` FROM jobs WHERE id = $1;`
+
+// the oldest queued or running job of type $1
+const qJobPending = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE type = $1 AND status IN ('queued', 'running')
+ORDER BY created
+LIMIT 1;`
+
+// finish running jobs whose lease expired if they were asked to stop or
+// have used up their attempts, so they aren't claimed again. $1 & $2 are
+// the errors recorded on failed & canceled jobs
+const qJobsExpire = `
+UPDATE jobs
+SET
+  status = CASE WHEN cancel_requested THEN 'canceled' ELSE 'failed' END,
+  error = CASE WHEN cancel_requested THEN $2 ELSE $1 END,
+  finished = (now() at time zone 'utc'),
+  lease_until = NULL,
+  claim = NULL,
+  updated = (now() at time zone 'utc')
+WHERE
+  status = 'running' AND
+  lease_until < (now() at time zone 'utc') AND
+  (cancel_requested OR attempts >= max_attempts);`
+
+// claim up to $2 jobs of type $1 for $3 seconds with the token $5. jobs
+// whose lease has expired are claimed again if they have attempts left &
+// weren't canceled, see qJobsExpire. if $4 is true, nothing is claimed
+// while another job of the type holds a lease
+const qJobsClaim = `
+UPDATE jobs
+SET
+  status = 'running',
+  claim = $5,
+  attempts = attempts + 1,
+  started = (now() at time zone 'utc'),
+  updated = (now() at time zone 'utc'),
+  lease_until = (now() at time zone 'utc') + $3 * interval '1 second'
+WHERE id IN (
+  SELECT id FROM jobs
+  WHERE
+    type = $1 AND
+    (
+      (status = 'queued' AND run_after <= (now() at time zone 'utc')) OR
+      (status = 'running' AND lease_until < (now() at time zone 'utc') AND
+        NOT cancel_requested AND attempts < max_attempts)
+    ) AND
+    (NOT $4::boolean OR NOT EXISTS (
+      SELECT 1 FROM jobs r
+      WHERE
+        r.type = $1 AND
+        r.status = 'running' AND
+        r.lease_until >= (now() at time zone 'utc')
+    ))
+  ORDER BY run_after, created
+  LIMIT $2
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + jobColumns + `;`
+
+// renew the lease on a running job claimed with token $5 for $2 seconds,
+// optionally reporting progress. returns whether the job should be
+// canceled, no rows if the job isn't running under the claim anymore
+const qJobHeartbeat = `
+UPDATE jobs
+SET
+  lease_until = (now() at time zone 'utc') + $2 * interval '1 second',
+  progress = coalesce($3::double precision, progress),
+  progress_message = coalesce($4::text, progress_message),
+  updated = (now() at time zone 'utc')
+WHERE id = $1 AND status = 'running' AND claim = $5
+RETURNING cancel_requested;`
+
+// record how a job run claimed with token $7 ended. $2 is the new status:
+// queued to retry the job at $6, or a finished status
+const qJobFinish = `
+UPDATE jobs
+SET
+  status = $2::text,
+  result = $3::jsonb,
+  error = $4,
+  progress = CASE WHEN $2::text = 'succeeded' THEN 1 ELSE progress END,
+  finished = CASE WHEN $2::text = 'queued' THEN NULL ELSE $5::timestamp END,
+  run_after = $6,
+  lease_until = NULL,
+  claim = NULL,
+  updated = $5::timestamp
+WHERE id = $1 AND status = 'running' AND claim = $7;`
+
+// put a job claimed with token $2 that was interrupted by shutdown back in
+// the queue without counting the attempt
+const qJobRelease = `
+UPDATE jobs
+SET status = 'queued', attempts = attempts - 1, lease_until = NULL, claim = NULL, updated = (now() at time zone 'utc')
+WHERE id = $1 AND status = 'running' AND claim = $2;`
+
+// cancel a queued job, or ask a running job to stop
+const qJobCancel = `
+UPDATE jobs
+SET
+  status = CASE WHEN status = 'queued' THEN 'canceled' ELSE status END,
+  finished = CASE WHEN status = 'queued' THEN $2::timestamp ELSE finished END,
+  cancel_requested = true,
+  updated = $2::timestamp
+WHERE id = $1 AND status IN ('queued', 'running')
+RETURNING ` + jobColumns + `;`
+
+// delete jobs that finished more than $1 seconds ago
+const qJobsPrune = `
+DELETE FROM jobs
+WHERE finished < (now() at time zone 'utc') - $1 * interval '1 second';`
+
+// contentUrl is a condition on urls u that have content other than html,
+// matching how core counts content urls
+const contentUrl = `
+  u.hash != '' AND
+  u.hash != '1220e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855' AND
+  u.content_sniff != 'text/html; charset=utf-8'`
+
+// recompute stats for every source, only writing stats that changed.
+// archived urls are urls with a stored copy of their content
+const qSourcesStatsRefresh = `
+UPDATE sources SET stats = x.stats
+FROM (
+  SELECT s.id, json_build_object(
+    'urlCount', count(u.url),
+    'archivedUrlCount', count(u.url) FILTER (WHERE u.hash != ''),
+    'contentUrlCount', count(u.url) FILTER (WHERE ` + contentUrl + `),
+    'contentMetadataCount', count(u.url) FILTER (WHERE ` + contentUrl + ` AND
+      EXISTS (SELECT 1 FROM metadata m WHERE m.subject = u.hash))
+  ) AS stats
+  FROM sources s
+  LEFT JOIN urls u ON u.url ILIKE '%' || s.url || '%'
+  WHERE s.deleted = false
+  GROUP BY s.id
+) x
+WHERE sources.id = x.id AND sources.stats::jsonb IS DISTINCT FROM x.stats::jsonb;`
+
+// uncrawlableCount counts the uncrawlables under source s
+const uncrawlableCount = `
+  (SELECT count(*) FROM uncrawlables un WHERE un.deleted = false AND un.url ILIKE '%' || s.url || '%')`
+
+// totals of the stats of each primer's own sources, with their uncrawlables
+const qPrimersSourceStats = `
+SELECT
+  p.id, p.parent_id,
+  coalesce(sum((s.stats->>'urlCount')::bigint), 0),
+  coalesce(sum((s.stats->>'archivedUrlCount')::bigint), 0),
+  coalesce(sum((s.stats->>'contentUrlCount')::bigint), 0),
+  coalesce(sum((s.stats->>'contentMetadataCount')::bigint), 0),
+  coalesce(sum(un.count), 0)
+FROM primers p
+LEFT JOIN sources s ON s.primer_id = p.id AND s.deleted = false
+LEFT JOIN LATERAL (SELECT ` + uncrawlableCount + ` AS count) un ON true
+WHERE p.deleted = false
+GROUP BY p.id, p.parent_id;`
+
+// set a primer's stats if they've changed
+const qPrimerStatsUpdate = `
+UPDATE primers SET stats = $2::text::json
+WHERE id = $1 AND stats::jsonb IS DISTINCT FROM $2::text::jsonb;`
+
+const statsHistoryColumns = `url_count, archived_url_count, content_url_count, content_metadata_count, uncrawlable_count`
+
+// snapshot every source's stored stats for day $1
+const qSourcesStatsSnapshot = `
+INSERT INTO stats_history (day, kind, resource_id, ` + statsHistoryColumns + `)
+SELECT
+  $1::date, 'source', s.id,
+  coalesce((s.stats->>'urlCount')::bigint, 0),
+  coalesce((s.stats->>'archivedUrlCount')::bigint, 0),
+  coalesce((s.stats->>'contentUrlCount')::bigint, 0),
+  coalesce((s.stats->>'contentMetadataCount')::bigint, 0),
+  ` + uncrawlableCount + `
+FROM sources s
+WHERE s.deleted = false
+ON CONFLICT (kind, resource_id, day) DO UPDATE SET ` + statsHistorySetExcluded + `;`
+
+// snapshot a primer's stats, $1 day, $2 primer id, $3-$7 stats
+const qPrimerStatsSnapshot = `
+INSERT INTO stats_history (day, kind, resource_id, ` + statsHistoryColumns + `)
+VALUES ($1::date, 'primer', $2, $3, $4, $5, $6, $7)
+ON CONFLICT (kind, resource_id, day) DO UPDATE SET ` + statsHistorySetExcluded + `;`
+
+const statsHistorySetExcluded = `
+  url_count = excluded.url_count,
+  archived_url_count = excluded.archived_url_count,
+  content_url_count = excluded.content_url_count,
+  content_metadata_count = excluded.content_metadata_count,
+  uncrawlable_count = excluded.uncrawlable_count`
+
+// the last snapshot in each bucket of a resource's history, oldest first.
+// $1 kind, $2 resource id, $3 & $4 the first & last days, $5 the bucket,
+// one of day, week or month
+const qStatsHistory = `
+SELECT DISTINCT ON (bucket)
+  date_trunc($5::text, day::timestamp)::date AS bucket, ` + statsHistoryColumns + `
+FROM stats_history
+WHERE kind = $1 AND resource_id = $2 AND day BETWEEN $3::date AND $4::date
+ORDER BY bucket, day DESC;`
+
+// primerNodeColumns are read by PrimerNode.UnmarshalSQL. hierarchy queries
+// walk primers in a cte with a path of the ids they've passed through, so
+// a cycle in parent_id stops the walk instead of looping forever
+const primerNodeColumns = `id, parent_id, short_title, title, stats, depth`
+
+// every primer that isn't deleted, by depth from the top of the hierarchy.
+// primers whose parent is missing or deleted are at the top
+const qPrimersTree = `
+WITH RECURSIVE tree AS (
+  SELECT p.id::text AS id, p.parent_id, p.short_title, p.title, p.stats, p.created, 0 AS depth, ARRAY[p.id::text] AS path
+  FROM primers p
+  WHERE p.deleted = false AND NOT EXISTS (
+    SELECT 1 FROM primers parent WHERE parent.id::text = p.parent_id AND parent.deleted = false
+  )
+  UNION ALL
+  SELECT p.id::text, p.parent_id, p.short_title, p.title, p.stats, p.created, tree.depth + 1, tree.path || p.id::text
+  FROM primers p
+  JOIN tree ON p.parent_id = tree.id
+  WHERE p.deleted = false AND NOT p.id::text = ANY(tree.path)
+)
+SELECT ` + primerNodeColumns + ` FROM tree ORDER BY depth, created;`
+
+// primer $1 & the primers under it, down to depth $2 below it. a negative
+// depth has no limit
+const qPrimerSubtree = `
+WITH RECURSIVE tree AS (
+  SELECT p.id::text AS id, p.parent_id, p.short_title, p.title, p.stats, p.created, 0 AS depth, ARRAY[p.id::text] AS path
+  FROM primers p
+  WHERE p.id = $1 AND p.deleted = false
+  UNION ALL
+  SELECT p.id::text, p.parent_id, p.short_title, p.title, p.stats, p.created, tree.depth + 1, tree.path || p.id::text
+  FROM primers p
+  JOIN tree ON p.parent_id = tree.id
+  WHERE p.deleted = false AND NOT p.id::text = ANY(tree.path) AND ($2::integer < 0 OR tree.depth < $2::integer)
+)
+SELECT ` + primerNodeColumns + ` FROM tree ORDER BY depth, created;`
+
+// primer $1 & its ancestors, nearest first. depth counts the steps up from
+// primer $1
+const qPrimerAncestors = `
+WITH RECURSIVE up AS (
+  SELECT p.id::text AS id, p.parent_id, p.short_title, p.title, p.stats, 0 AS depth, ARRAY[p.id::text] AS path
+  FROM primers p
+  WHERE p.id = $1 AND p.deleted = false
+  UNION ALL
+  SELECT p.id::text, p.parent_id, p.short_title, p.title, p.stats, up.depth + 1, up.path || p.id::text
+  FROM primers p
+  JOIN up ON p.id::text = up.parent_id
+  WHERE p.deleted = false AND NOT p.id::text = ANY(up.path)
+)
+SELECT ` + primerNodeColumns + ` FROM up ORDER BY depth;`
+
+// whether primer $2 is primer $1 or one of its ancestors, deleted or not.
+// making $1 the parent of $2 would close a cycle
+const qPrimerIsAncestor = `
+WITH RECURSIVE up AS (
+  SELECT p.id::text AS id, p.parent_id, ARRAY[p.id::text] AS path
+  FROM primers p
+  WHERE p.id::text = $1
+  UNION ALL
+  SELECT p.id::text, p.parent_id, up.path || p.id::text
+  FROM primers p
+  JOIN up ON p.id::text = up.parent_id
+  WHERE NOT p.id::text = ANY(up.path)
+)
+SELECT exists(SELECT 1 FROM up WHERE id = $2);`
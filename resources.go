@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+)
+
+// resource describes how a model is stored & which fields clients can
+// filter & sort lists of it by. Field names match the model's json names,
+// columns are only ever taken from these whitelists, never from requests
+type resource struct {
+	Name  string
+	Table string
+	// Columns is the select list, in the order the model's UnmarshalSQL
+	// method expects
+	Columns string
+	// Where is a condition every listed row must match, eg: excluding
+	// deleted rows. optional
+	Where       string
+	Fields      []*apiutil.Field
+	DefaultSort string
+	// Model is a zero value of the type a row is read into, used to name
+	// export columns
+	Model interface{}
+	// Scan reads a row into a new Model
+	Scan func(row sqlutil.Scannable) (interface{}, error)
+	// Expand embeds related resources in a batch of scanned models, optional
+	Expand func(db sqlutil.Queryable, models []interface{}, exp apiutil.Expansions) error
+	// URL reads a scanned model's url, set for resources with unique urls
+	// so they can be batch read by url. optional
+	URL func(m interface{}) string
+}
+
+// ListQuery parses filter & sort params from a request
+func (res *resource) ListQuery(r *http.Request) (*apiutil.ListQuery, error) {
+	return apiutil.ParseListQuery(r.URL.RawQuery, res.Fields, res.DefaultSort)
+}
+
+// Params documents the filter & sort query params a resource accepts
+func (res *resource) Params() []Param {
+	var sortable []string
+	for _, f := range res.Fields {
+		if f.Sortable {
+			sortable = append(sortable, f.Name)
+		}
+	}
+	params := []Param{{
+		Name: "sort",
+		Type: "string",
+		Description: fmt.Sprintf("comma-separated fields to sort by, prefix a field with - for descending order. default: %s. sortable fields: %s",
+			res.DefaultSort, strings.Join(sortable, ", ")),
+	}, {
+		Name:        "format",
+		Type:        "string",
+		Description: "response format, one of json, csv or ndjson. overrides the Accept header. csv & ndjson stream every result unless page or pageSize is set",
+	}}
+
+	for _, f := range res.Fields {
+		if !f.Filterable {
+			continue
+		}
+		desc := "filter by " + f.Name
+		switch {
+		case f.Condition != "" || f.Type == apiutil.FieldBool || f.Type == apiutil.FieldUUID:
+		case f.Type == apiutil.FieldTime:
+			desc += ". accepts a date or RFC3339 timestamp, compare with name>=value, name<value, etc."
+		default:
+			desc += ". compare with name>=value, name!=value, etc."
+		}
+		params = append(params, Param{Name: f.Name, Type: f.Type.String(), Description: desc})
+	}
+	return params
+}
+
+// ListSQL builds a select statement for a page of results matching q. a
+// limit of 0 or less selects every result
+func (res *resource) ListSQL(q *apiutil.ListQuery, limit, offset int) (string, []interface{}) {
+	where, orderBy, args := q.SQL(2)
+	if res.Where != "" {
+		if where != "" {
+			where = res.Where + " AND " + where
+		} else {
+			where = res.Where
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", res.Columns, res.Table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if orderBy != "" {
+		query += " ORDER BY " + orderBy
+	}
+	query += " LIMIT $1 OFFSET $2;"
+	// LIMIT NULL is the same as no limit
+	var lim interface{}
+	if limit > 0 {
+		lim = limit
+	}
+	return query, append([]interface{}{lim, offset}, args...)
+}
+
+// queryList runs a list query against db, calling scan for each row
+func queryList(db sqlutil.Queryable, res *resource, q *apiutil.ListQuery, limit, offset int, scan func(row sqlutil.Scannable) error) error {
+	if q == nil {
+		q = &apiutil.ListQuery{}
+	}
+	query, args := res.ListSQL(q, limit, offset)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// writeListQueryErr responds to a failed ListQuery parse
+func writeListQueryErr(w http.ResponseWriter, err error) {
+	if _, ok := err.(*apiutil.ListQueryError); ok {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+}
+
+// field constructors to keep whitelists readable
+func sortField(name, column string, t apiutil.FieldType) *apiutil.Field {
+	return &apiutil.Field{Name: name, Column: column, Type: t, Sortable: true, Filterable: true}
+}
+
+func filterField(name, column string, t apiutil.FieldType) *apiutil.Field {
+	return &apiutil.Field{Name: name, Column: column, Type: t, Filterable: true}
+}
+
+var urlsResource = &resource{
+	Name:  "urls",
+	Table: "urls",
+	Columns: `url, created, updated, last_head, last_get, status, content_type, content_sniff,
+  content_length, file_name, title, id, headers_took, download_took, headers, meta, hash`,
+	DefaultSort: "-created",
+	Model:       core.Url{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		m := &core.Url{}
+		return m, m.UnmarshalSQL(row)
+	},
+	URL: func(m interface{}) string {
+		return m.(*core.Url).Url
+	},
+	Fields: []*apiutil.Field{
+		filterField("id", "id", apiutil.FieldString),
+		sortField("url", "url", apiutil.FieldString),
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		sortField("lastGet", "last_get", apiutil.FieldTime),
+		sortField("lastHead", "last_head", apiutil.FieldTime),
+		sortField("status", "status", apiutil.FieldInt),
+		sortField("contentType", "content_type", apiutil.FieldString),
+		sortField("contentLength", "content_length", apiutil.FieldInt),
+		sortField("fileName", "file_name", apiutil.FieldString),
+		sortField("title", "title", apiutil.FieldString),
+		filterField("hash", "hash", apiutil.FieldString),
+		// urls that fall under one of a primer's sources, matched the way
+		// core & the stats queries match them
+		{Name: "primer", Type: apiutil.FieldUUID, Filterable: true,
+			Condition: "EXISTS (SELECT 1 FROM sources WHERE sources.primer_id = {} AND sources.deleted = false AND urls.url ILIKE '%' || sources.url || '%')"},
+	},
+}
+
+var primersResource = &resource{
+	Name:  "primers",
+	Table: "primers",
+	Columns: `id, created, updated, short_title, title, description,
+  parent_id, stats, meta`,
+	Where:       "deleted = false",
+	DefaultSort: "-created",
+	Model:       core.Primer{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		m := &core.Primer{}
+		return m, m.UnmarshalSQL(row)
+	},
+	Expand: func(db sqlutil.Queryable, models []interface{}, exp apiutil.Expansions) error {
+		list := make([]*core.Primer, len(models))
+		for i, m := range models {
+			list[i] = m.(*core.Primer)
+		}
+		return expandPrimers(db, list, exp)
+	},
+	Fields: []*apiutil.Field{
+		filterField("id", "id", apiutil.FieldUUID),
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		sortField("shortTitle", "short_title", apiutil.FieldString),
+		sortField("title", "title", apiutil.FieldString),
+		// parent_id is text, "parent=" lists primers without a parent
+		filterField("parent", "parent_id", apiutil.FieldString),
+	},
+}
+
+var sourcesResource = &resource{
+	Name:  "sources",
+	Table: "sources",
+	Columns: `id, created, updated, title, description, url, primer_id, crawl, stale_duration,
+  last_alert_sent, meta, stats`,
+	Where:       "deleted = false",
+	DefaultSort: "-created",
+	Model:       core.Source{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		m := &core.Source{}
+		return m, m.UnmarshalSQL(row)
+	},
+	Expand: func(db sqlutil.Queryable, models []interface{}, exp apiutil.Expansions) error {
+		list := make([]*core.Source, len(models))
+		for i, m := range models {
+			list[i] = m.(*core.Source)
+		}
+		return expandSources(db, list, exp)
+	},
+	Fields: []*apiutil.Field{
+		filterField("id", "id", apiutil.FieldUUID),
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		sortField("title", "title", apiutil.FieldString),
+		sortField("url", "url", apiutil.FieldString),
+		filterField("primer", "primer_id", apiutil.FieldUUID),
+		filterField("crawl", "crawl", apiutil.FieldBool),
+		sortField("lastAlertSent", "last_alert_sent", apiutil.FieldTime),
+	},
+}
+
+var collectionsResource = &resource{
+	Name:        "collections",
+	Table:       "collections",
+	Columns:     `id, created, updated, creator, title, description, url`,
+	DefaultSort: "-created",
+	Model:       core.Collection{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		m := &core.Collection{}
+		return m, m.UnmarshalSQL(row)
+	},
+	Fields: []*apiutil.Field{
+		filterField("id", "id", apiutil.FieldUUID),
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		sortField("creator", "creator", apiutil.FieldString),
+		sortField("title", "title", apiutil.FieldString),
+		sortField("url", "url", apiutil.FieldString),
+	},
+}
+
+var uncrawlablesResource = &resource{
+	Name:  "uncrawlables",
+	Table: "uncrawlables",
+	Columns: `id, url, created, updated, creator_key_id,
+  name, email, event_name, agency_name,
+  agency_id, subagency_id, org_id, suborg_id, subprimer_id,
+  ftp, database, interactive, many_files,
+  comments`,
+	Where:       "deleted = false",
+	DefaultSort: "-created",
+	Model:       core.Uncrawlable{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		m := &core.Uncrawlable{}
+		return m, m.UnmarshalSQL(row)
+	},
+	URL: func(m interface{}) string {
+		return m.(*core.Uncrawlable).Url
+	},
+	Fields: []*apiutil.Field{
+		filterField("id", "id", apiutil.FieldString),
+		sortField("url", "url", apiutil.FieldString),
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		filterField("creator", "creator_key_id", apiutil.FieldString),
+		sortField("name", "name", apiutil.FieldString),
+		filterField("email", "email", apiutil.FieldString),
+		sortField("eventName", "event_name", apiutil.FieldString),
+		sortField("agency", "agency_name", apiutil.FieldString),
+		filterField("agencyId", "agency_id", apiutil.FieldString),
+		filterField("subagencyId", "subagency_id", apiutil.FieldString),
+		filterField("subprimerId", "subprimer_id", apiutil.FieldString),
+		filterField("ftp", "ftp", apiutil.FieldBool),
+		filterField("database", "database", apiutil.FieldBool),
+		filterField("interactive", "interactive", apiutil.FieldBool),
+		filterField("manyFiles", "many_files", apiutil.FieldBool),
+	},
+}
+
+var customCrawlsResource = &resource{
+	Name:  "customcrawls",
+	Table: "custom_crawls",
+	Columns: `id, created, updated,
+  jwt, morphRunId, dateCompleted, githubRepo, originalUrl,
+  sqliteChecksum`,
+	DefaultSort: "-created",
+	Model:       core.CustomCrawl{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		m := &core.CustomCrawl{}
+		return m, m.UnmarshalSQL(row)
+	},
+	Fields: []*apiutil.Field{
+		filterField("id", "id", apiutil.FieldUUID),
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		filterField("morphRunId", "morphRunId", apiutil.FieldString),
+		// CustomCrawl.DateCompleted has no json tag, so it keeps its go name
+		sortField("DateCompleted", "dateCompleted", apiutil.FieldTime),
+		sortField("githubRepo", "githubRepo", apiutil.FieldString),
+		sortField("originalUrl", "originalUrl", apiutil.FieldString),
+	},
+}
+
+var auditEventsResource = &resource{
+	Name:        "audit",
+	Table:       "audit_events",
+	Columns:     `id, created, actor_id, actor_name, ip, resource_type, resource_id, action, diff`,
+	DefaultSort: "-created",
+	Model:       AuditEvent{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		e := &AuditEvent{}
+		return e, e.UnmarshalSQL(row)
+	},
+	Fields: []*apiutil.Field{
+		sortField("id", "id", apiutil.FieldInt),
+		sortField("created", "created", apiutil.FieldTime),
+		// matches either the user's id or username
+		{Name: "actor", Type: apiutil.FieldString, Filterable: true,
+			Condition: "actor_id = {} OR actor_name = {}"},
+		filterField("actorId", "actor_id", apiutil.FieldString),
+		filterField("ip", "ip", apiutil.FieldString),
+		sortField("resourceType", "resource_type", apiutil.FieldString),
+		filterField("resourceId", "resource_id", apiutil.FieldString),
+		filterField("action", "action", apiutil.FieldString),
+	},
+}
+
+var alertsResource = &resource{
+	Name:        "alerts",
+	Table:       "alerts",
+	Columns:     alertColumns,
+	DefaultSort: "-created",
+	Model:       Alert{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		a := &Alert{}
+		return a, a.UnmarshalSQL(row)
+	},
+	Fields: []*apiutil.Field{
+		sortField("id", "id", apiutil.FieldInt),
+		sortField("created", "created", apiutil.FieldTime),
+		filterField("source", "source_id", apiutil.FieldUUID),
+		sortField("url", "url", apiutil.FieldString),
+		filterField("kind", "kind", apiutil.FieldString),
+		sortField("dismissedAt", "dismissed_at", apiutil.FieldTime),
+		// dismissed=false lists open alerts
+		{Name: "dismissed", Type: apiutil.FieldBool, Filterable: true,
+			Condition: "(dismissed_at IS NOT NULL) = {}"},
+	},
+}
+
+var jobsResource = &resource{
+	Name:        "jobs",
+	Table:       "jobs",
+	Columns:     jobColumns,
+	DefaultSort: "-created",
+	Model:       Job{},
+	Scan: func(row sqlutil.Scannable) (interface{}, error) {
+		j := &Job{}
+		return j, j.UnmarshalSQL(row)
+	},
+	Fields: []*apiutil.Field{
+		sortField("created", "created", apiutil.FieldTime),
+		sortField("updated", "updated", apiutil.FieldTime),
+		sortField("type", "type", apiutil.FieldString),
+		sortField("status", "status", apiutil.FieldString),
+		sortField("finished", "finished", apiutil.FieldTime),
+		filterField("createdBy", "created_by", apiutil.FieldString),
+	},
+}
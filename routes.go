@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/datatogether/core"
+	"github.com/datatogether/coverage/tree"
+	"github.com/datatogether/identity/user"
+)
+
+// apiVersion prefixes all versioned routes. Routes are also served at
+// their unprefixed paths as deprecated aliases, see NewServerRoutes
+const apiVersion = "/v1"
+
+// Route describes a single api endpoint. apiRoutes is the source of truth
+// for what the api exposes: the router is built from it, the OpenAPI spec
+// is generated from it (see openapi.go) and in test mode every request &
+// response is checked against it (see spec_validation.go)
+type Route struct {
+	Method string
+	// Path is a pattern for apiutil.Router, without the version prefix.
+	// wildcards can be typed, eg: {id:uuid}
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+	// Tag groups routes in generated documentation
+	Tag         string
+	QueryParams []Param
+	// Body is a value of the request body type, nil if the route doesn't
+	// accept a body
+	Body interface{}
+	// Response is a value of the type returned in the "data" field of the
+	// response envelope
+	Response interface{}
+	// Paginated routes accept page & pageSize params & respond with a
+	// list of Response values plus pagination info
+	Paginated bool
+	// List routes respond with a list of Response values
+	List bool
+	// Resource, if set, is the resource a list route filters & sorts
+	Resource *resource
+	// Export list routes without a Resource also respond with csv or
+	// ndjson when asked, see writeListExport
+	Export bool
+	// Expand lists the related resources clients can embed with expand=
+	Expand []string
+	// Batch routes respond with a list of BatchResults holding Response
+	// values, see writeBatchGet & writeBatchUpsert
+	Batch bool
+	// Idempotent POST routes honor the Idempotency-Key header, see
+	// withIdempotency
+	Idempotent bool
+	// Admin routes are only served to users listed in cfg.AdminUsers
+	Admin bool
+	// SignedIn routes are only served to users that aren't anonymous
+	SignedIn bool
+	// Stream routes hold the connection open & write Response values as
+	// Server-Sent Events, so they skip wrappers that buffer the response.
+	// see EventsHandler
+	Stream bool
+	// Raw routes respond with Response directly instead of wrapping it in
+	// the standard envelope
+	Raw bool
+	// Unversioned routes are served at Path only, without the version
+	// prefix. Used for infrastructure endpoints like health checks
+	Unversioned bool
+	// SkipMiddleware routes don't go through middleware, so they're
+	// served while the db is unavailable
+	SkipMiddleware bool
+	// CacheControl is the Cache-Control header for successful GET
+	// responses, defaultCacheControl if empty
+	CacheControl string
+}
+
+// Param is a query string parameter
+type Param struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// PathParam is a wildcard segment in a route path
+type PathParam struct {
+	Name string
+	// Type is the apiutil.Router type of the wildcard, "" for any string
+	Type string
+}
+
+// PathParams lists the {wildcard} segments in the route's path
+func (rt *Route) PathParams() (params []PathParam) {
+	for _, seg := range strings.Split(rt.Path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			p := PathParam{Name: seg[1 : len(seg)-1]}
+			if i := strings.Index(p.Name, ":"); i != -1 {
+				p.Name, p.Type = p.Name[:i], p.Name[i+1:]
+			}
+			params = append(params, p)
+		}
+	}
+	return
+}
+
+// Params lists every query param the route accepts
+func (rt *Route) Params() (params []Param) {
+	if rt.Paginated {
+		params = append(params, pageParams...)
+	}
+	if rt.Resource != nil {
+		params = append(params, rt.Resource.Params()...)
+	}
+	if rt.Selectable() {
+		params = append(params, fieldsParam)
+	}
+	if rt.Admin || rt.SignedIn {
+		params = append(params, apiTokenParam)
+	}
+	if len(rt.Expand) > 0 {
+		params = append(params, Param{
+			Name:        "expand",
+			Type:        "string",
+			Description: "comma-separated related resources to embed. expandable: " + strings.Join(rt.Expand, ", "),
+		})
+	}
+	return append(params, rt.QueryParams...)
+}
+
+// CacheControlPolicy is the Cache-Control header the route responds with
+func (rt *Route) CacheControlPolicy() string {
+	if rt.CacheControl == "" {
+		return defaultCacheControl
+	}
+	return rt.CacheControl
+}
+
+// Conditional routes modify existing resources, & require an If-Match
+// header to do so. see conditionalWrite. batch upserts check each item's
+// updated time instead
+func (rt *Route) Conditional() bool {
+	return !rt.Batch && (rt.Method == "PUT" || rt.Method == "PATCH" || rt.Method == "DELETE")
+}
+
+// Selectable routes let clients choose which fields of Response they get
+// with fields=
+func (rt *Route) Selectable() bool {
+	return rt.Method == "GET" && rt.Response != nil && !rt.Raw && !rt.Stream
+}
+
+// VersionedPath is the route's canonical path pattern
+func (rt *Route) VersionedPath() string {
+	if rt.Unversioned {
+		return rt.Path
+	}
+	return apiVersion + rt.Path
+}
+
+// SpecPath is the route's canonical path with wildcard types removed, in
+// the form OpenAPI expects
+func (rt *Route) SpecPath() string {
+	path := rt.VersionedPath()
+	for _, p := range rt.PathParams() {
+		if p.Type != "" {
+			path = strings.Replace(path, "{"+p.Name+":"+p.Type+"}", "{"+p.Name+"}", 1)
+		}
+	}
+	return path
+}
+
+var pageParams = []Param{
+	{Name: "page", Type: "integer", Description: "page number, starting at 1"},
+	{Name: "pageSize", Type: "integer", Description: "number of results per page, default 100"},
+}
+
+var statsHistoryParams = []Param{
+	{Name: "from", Type: "string", Description: "first day to include, as YYYY-MM-DD. default is a year before to"},
+	{Name: "to", Type: "string", Description: "last day to include, as YYYY-MM-DD. default is today"},
+	{Name: "bucket", Type: "string", Description: "period to group snapshots by, one of day, week or month. default is day"},
+	{Name: "format", Type: "string", Description: "response format, one of json, csv or ndjson. overrides the Accept header"},
+}
+
+var apiTokenParam = Param{
+	Name:        "api_token",
+	Type:        "string",
+	Description: "identity service access token of the user making the request",
+}
+
+var fieldsParam = Param{
+	Name:        "fields",
+	Type:        "string",
+	Description: "comma-separated fields to include in results, eg: id,title. use dots for fields of embedded resources, eg: primer.title",
+}
+
+// patchBody is the Body of PATCH routes. patches are documents in one of
+// the acceptPatch formats, which don't have a single schema
+var patchBody = json.RawMessage{}
+
+// apiRoutes lists every documented endpoint
+var apiRoutes = []*Route{
+	{Method: "GET", Path: "/healthz/live", Handler: LiveHandler, Unversioned: true, SkipMiddleware: true, CacheControl: "no-store", Tag: "health", Raw: true, Response: HealthReport{},
+		Summary: "Liveness check, 200 whenever the process is able to serve requests"},
+	{Method: "GET", Path: "/healthz/ready", Handler: ReadyHandler, Unversioned: true, SkipMiddleware: true, CacheControl: "no-store", Tag: "health", Raw: true, Response: HealthReport{},
+		Summary: "Readiness check, probes the database & backing services. 503 if any are failing"},
+
+	{Method: "GET", Path: "/users", Handler: ListUsersHandler, Tag: "users", List: true, Response: user.User{},
+		Summary: "List users", QueryParams: pageParams},
+	{Method: "GET", Path: "/users/{id}", Handler: GetUserHandler, Tag: "users", Response: user.User{},
+		Summary: "Get a user"},
+
+	{Method: "GET", Path: "/primers", Handler: ListPrimersHandler, Tag: "primers", Paginated: true, Resource: primersResource, Expand: primerExpansions, Response: core.Primer{},
+		Summary: "List primers"},
+	{Method: "POST", Path: "/primers/batch", Handler: BatchGetPrimersHandler, Tag: "primers", Batch: true, Body: BatchGetRequest{}, Response: core.Primer{},
+		Summary: "Get up to 500 primers by id in one request"},
+	{Method: "PUT", Path: "/primers/batch", Handler: BatchUpsertPrimersHandler, Tag: "primers", Batch: true, Body: []core.Primer{}, Response: core.Primer{},
+		Summary: "Create or update up to 500 primers in one transaction"},
+	{Method: "GET", Path: "/primers/tree", Handler: PrimerTreeHandler, Tag: "primers", List: true, Response: PrimerNode{},
+		Summary: "Get the whole primer hierarchy, primers at the top with their sub-primers nested as children"},
+	{Method: "GET", Path: "/primers/{id:uuid}", Handler: GetPrimerHandler, Tag: "primers", Expand: primerExpansions, Response: core.Primer{},
+		Summary: "Get a primer"},
+	{Method: "PUT", Path: "/primers/{id:uuid}", Handler: SavePrimerHandler, Tag: "primers", Body: core.Primer{}, Response: core.Primer{},
+		Summary: "Update a primer"},
+	{Method: "PATCH", Path: "/primers/{id:uuid}", Handler: PatchPrimerHandler, Tag: "primers", Body: patchBody, Response: core.Primer{},
+		Summary: "Partially update a primer with a merge patch or json patch"},
+	{Method: "DELETE", Path: "/primers/{id:uuid}", Handler: DeletePrimerHandler, Tag: "primers", Response: core.Primer{},
+		Summary: "Move a primer to the trash"},
+	{Method: "POST", Path: "/primers/{id:uuid}/restore", Handler: RestorePrimerHandler, Tag: "primers", Response: core.Primer{},
+		Summary: "Restore a primer from the trash"},
+	{Method: "GET", Path: "/primers/{id:uuid}/sources", Handler: ListPrimerSourcesHandler, Tag: "primers", List: true, Expand: sourceExpansions, Response: core.Source{},
+		Summary: "List a primer's sources"},
+	{Method: "GET", Path: "/primers/{id:uuid}/stats", Handler: GetPrimerStatsHandler, Tag: "primers", Response: core.PrimerStats{},
+		Summary: "Get a primer's stats, totaled with its sub-primers as of the last stats refresh"},
+	{Method: "GET", Path: "/primers/{id:uuid}/stats/history", Handler: GetPrimerStatsHistoryHandler, Tag: "primers", List: true, Export: true, Response: StatsSnapshot{},
+		Summary: "Get a primer's daily stats over time, the last snapshot in each bucket oldest first", QueryParams: statsHistoryParams},
+	{Method: "GET", Path: "/primers/{id:uuid}/ancestors", Handler: PrimerAncestorsHandler, Tag: "primers", List: true, Response: PrimerNode{},
+		Summary: "List a primer's ancestors for breadcrumbs, from the top of the hierarchy down to its parent"},
+	{Method: "GET", Path: "/primers/{id:uuid}/subtree", Handler: PrimerSubtreeHandler, Tag: "primers", Response: PrimerNode{},
+		Summary: "Get a primer with its sub-primers nested as children",
+		QueryParams: []Param{
+			{Name: "depth", Type: "integer", Description: "levels of sub-primers to include, 0 for none. default is every level"},
+		}},
+
+	{Method: "GET", Path: "/sources", Handler: ListSourcesHandler, Tag: "sources", Paginated: true, Resource: sourcesResource, Expand: sourceExpansions, Response: core.Source{},
+		Summary: "List sources"},
+	{Method: "POST", Path: "/sources/batch", Handler: BatchGetSourcesHandler, Tag: "sources", Batch: true, Body: BatchGetRequest{}, Response: core.Source{},
+		Summary: "Get up to 500 sources by id in one request"},
+	{Method: "PUT", Path: "/sources/batch", Handler: BatchUpsertSourcesHandler, Tag: "sources", Batch: true, Body: []core.Source{}, Response: core.Source{},
+		Summary: "Create or update up to 500 sources in one transaction"},
+	{Method: "GET", Path: "/sources/{id:uuid}", Handler: GetSourceHandler, Tag: "sources", Expand: sourceExpansions, Response: core.Source{},
+		Summary: "Get a source"},
+	{Method: "PUT", Path: "/sources/{id:uuid}", Handler: SaveSourceHandler, Tag: "sources", Body: core.Source{}, Response: core.Source{},
+		Summary: "Update a source"},
+	{Method: "PATCH", Path: "/sources/{id:uuid}", Handler: PatchSourceHandler, Tag: "sources", Body: patchBody, Response: core.Source{},
+		Summary: "Partially update a source with a merge patch or json patch"},
+	{Method: "DELETE", Path: "/sources/{id:uuid}", Handler: DeleteSourceHandler, Tag: "sources", Response: core.Source{},
+		Summary: "Move a source to the trash"},
+	{Method: "POST", Path: "/sources/{id:uuid}/restore", Handler: RestoreSourceHandler, Tag: "sources", Response: core.Source{},
+		Summary: "Restore a source from the trash"},
+	{Method: "GET", Path: "/sources/{id:uuid}/stale", Handler: ListSourceStaleUrlsHandler, Tag: "sources", Paginated: true, Response: UrlSchedule{},
+		Summary: "List urls the source schedules that are due to be fetched, most overdue first"},
+	{Method: "GET", Path: "/sources/{id:uuid}/stats", Handler: GetSourceStatsHandler, Tag: "sources", Response: core.SourceStats{},
+		Summary: "Get a source's stats as of the last stats refresh"},
+	{Method: "GET", Path: "/sources/{id:uuid}/stats/history", Handler: GetSourceStatsHistoryHandler, Tag: "sources", List: true, Export: true, Response: StatsSnapshot{},
+		Summary: "Get a source's daily stats over time, the last snapshot in each bucket oldest first", QueryParams: statsHistoryParams},
+
+	{Method: "GET", Path: "/urls", Handler: ListUrlsHandler, Tag: "urls", Paginated: true, Resource: urlsResource, Response: core.Url{},
+		Summary: "List urls"},
+	{Method: "POST", Path: "/urls/batch", Handler: BatchGetUrlsHandler, Tag: "urls", Batch: true, Body: BatchGetRequest{}, Response: core.Url{},
+		Summary: "Get up to 500 urls by id or url in one request"},
+	{Method: "GET", Path: "/urls/due", Handler: ListDueUrlsHandler, Tag: "urls", Paginated: true, Response: UrlSchedule{},
+		Summary: "List urls that are due to be fetched across all sources, most overdue first"},
+	{Method: "GET", Path: "/urls/{id}", Handler: GetUrlHandler, Tag: "urls", Response: core.Url{},
+		Summary: "Get a url by id, or by url or hash query param",
+		QueryParams: []Param{
+			{Name: "url", Type: "string", Description: "look up by url instead of id"},
+			{Name: "hash", Type: "string", Description: "look up by content hash instead of id"},
+		}},
+
+	{Method: "GET", Path: "/coverage", Handler: CoverageTreeHandler, Tag: "coverage", CacheControl: "public, max-age=300", Response: tree.Node{},
+		Summary: "Archive coverage tree for a set of url patterns",
+		QueryParams: []Param{
+			{Name: "patterns", Type: "string", Description: "comma-separated url patterns"},
+			{Name: "primer", Type: "string", Description: "primer id, uses the primer's source urls as patterns"},
+			{Name: "root", Type: "string", Description: "url to root the tree at"},
+			{Name: "depth", Type: "integer", Description: "maximum tree depth"},
+			{Name: "repos", Type: "string", Description: "comma-separated repository ids to limit coverage to"},
+		}},
+
+	{Method: "GET", Path: "/repositories", Handler: ListRepositoriesHandler, Tag: "repositories", List: true, Response: core.DataRepo{},
+		Summary: "List data repositories"},
+	{Method: "GET", Path: "/repositories/{id}", Handler: GetRepositoryHandler, Tag: "repositories", Response: core.DataRepo{},
+		Summary: "Get a data repository"},
+
+	{Method: "GET", Path: "/collections", Handler: ListCollectionsHandler, Tag: "collections", Paginated: true, Resource: collectionsResource, Response: core.Collection{},
+		Summary: "List collections"},
+	{Method: "GET", Path: "/collections/{id:uuid}", Handler: GetCollectionHandler, Tag: "collections", Response: core.Collection{},
+		Summary: "Get a collection"},
+	{Method: "PUT", Path: "/collections/{id:uuid}", Handler: SaveCollectionHandler, Tag: "collections", Body: core.Collection{}, Response: core.Collection{},
+		Summary: "Update a collection"},
+	{Method: "PATCH", Path: "/collections/{id:uuid}", Handler: PatchCollectionHandler, Tag: "collections", Body: patchBody, Response: core.Collection{},
+		Summary: "Partially update a collection with a merge patch or json patch"},
+	{Method: "DELETE", Path: "/collections/{id:uuid}", Handler: DeleteCollectionHandler, Tag: "collections", Response: core.Collection{},
+		Summary: "Delete a collection"},
+
+	{Method: "GET", Path: "/uncrawlables", Handler: ListUncrawlablesHandler, Tag: "uncrawlables", Paginated: true, Resource: uncrawlablesResource, Response: core.Uncrawlable{},
+		Summary: "List uncrawlables"},
+	{Method: "POST", Path: "/uncrawlables", Handler: SaveUncrawlableHandler, Tag: "uncrawlables", Idempotent: true, Body: core.Uncrawlable{}, Response: core.Uncrawlable{},
+		Summary: "Create an uncrawlable"},
+	{Method: "PUT", Path: "/uncrawlables", Handler: SaveUncrawlableHandler, Tag: "uncrawlables", Body: core.Uncrawlable{}, Response: core.Uncrawlable{},
+		Summary: "Create or update an uncrawlable"},
+	{Method: "POST", Path: "/uncrawlables/batch", Handler: BatchGetUncrawlablesHandler, Tag: "uncrawlables", Batch: true, Body: BatchGetRequest{}, Response: core.Uncrawlable{},
+		Summary: "Get up to 500 uncrawlables by id or url in one request"},
+	{Method: "PUT", Path: "/uncrawlables/batch", Handler: BatchUpsertUncrawlablesHandler, Tag: "uncrawlables", Batch: true, Body: []core.Uncrawlable{}, Response: core.Uncrawlable{},
+		Summary: "Create or update up to 500 uncrawlables in one transaction"},
+	{Method: "GET", Path: "/uncrawlables/{id:uuid}", Handler: GetUncrawlableHandler, Tag: "uncrawlables", Response: core.Uncrawlable{},
+		Summary: "Get an uncrawlable by id, or by url query param",
+		QueryParams: []Param{
+			{Name: "url", Type: "string", Description: "look up by url instead of id"},
+		}},
+	{Method: "PUT", Path: "/uncrawlables/{id:uuid}", Handler: SaveUncrawlableHandler, Tag: "uncrawlables", Body: core.Uncrawlable{}, Response: core.Uncrawlable{},
+		Summary: "Update an uncrawlable"},
+	{Method: "PATCH", Path: "/uncrawlables/{id:uuid}", Handler: PatchUncrawlableHandler, Tag: "uncrawlables", Body: patchBody, Response: core.Uncrawlable{},
+		Summary: "Partially update an uncrawlable with a merge patch or json patch"},
+	{Method: "DELETE", Path: "/uncrawlables/{id:uuid}", Handler: DeleteUncrawlableHandler, Tag: "uncrawlables", Response: core.Uncrawlable{},
+		Summary: "Move an uncrawlable to the trash"},
+	{Method: "POST", Path: "/uncrawlables/{id:uuid}/restore", Handler: RestoreUncrawlableHandler, Tag: "uncrawlables", Response: core.Uncrawlable{},
+		Summary: "Restore an uncrawlable from the trash"},
+
+	{Method: "GET", Path: "/customcrawls", Handler: ListCustomCrawlsHandler, Tag: "customcrawls", Paginated: true, Resource: customCrawlsResource, Response: core.CustomCrawl{},
+		Summary: "List custom crawls"},
+	{Method: "POST", Path: "/customcrawls", Handler: SaveCustomCrawlHandler, Tag: "customcrawls", Idempotent: true, Body: core.CustomCrawl{}, Response: core.CustomCrawl{},
+		Summary: "Create a custom crawl"},
+	{Method: "PUT", Path: "/customcrawls", Handler: SaveCustomCrawlHandler, Tag: "customcrawls", Body: core.CustomCrawl{}, Response: core.CustomCrawl{},
+		Summary: "Create or update a custom crawl"},
+	{Method: "GET", Path: "/customcrawls/{id:uuid}", Handler: GetCustomCrawlHandler, Tag: "customcrawls", Response: core.CustomCrawl{},
+		Summary: "Get a custom crawl"},
+	{Method: "PUT", Path: "/customcrawls/{id:uuid}", Handler: SaveCustomCrawlHandler, Tag: "customcrawls", Body: core.CustomCrawl{}, Response: core.CustomCrawl{},
+		Summary: "Update a custom crawl"},
+	{Method: "PATCH", Path: "/customcrawls/{id:uuid}", Handler: PatchCustomCrawlHandler, Tag: "customcrawls", Body: patchBody, Response: core.CustomCrawl{},
+		Summary: "Partially update a custom crawl with a merge patch or json patch"},
+	{Method: "DELETE", Path: "/customcrawls/{id:uuid}", Handler: DeleteCustomCrawlHandler, Tag: "customcrawls", Response: core.CustomCrawl{},
+		Summary: "Delete a custom crawl"},
+
+	{Method: "GET", Path: "/trash", Handler: ListTrashHandler, Tag: "trash", Paginated: true, Response: TrashItem{},
+		Summary: "List deleted resources of one type, most recently deleted first",
+		QueryParams: []Param{
+			{Name: "type", Type: "string", Required: true, Description: "type of deleted resources to list, one of primers, sources or uncrawlables"},
+		}},
+	{Method: "POST", Path: "/trash/purge", Handler: PurgeTrashHandler, Tag: "trash", Admin: true, List: true, Response: TrashPurge{},
+		Summary: "Permanently delete resources that have been in the trash longer than the retention period. admins only"},
+
+	{Method: "GET", Path: "/audit", Handler: ListAuditEventsHandler, Tag: "audit", Admin: true, Paginated: true, Resource: auditEventsResource, Response: AuditEvent{},
+		Summary: "List audit events for changes made through the api, most recent first. admins only"},
+
+	{Method: "GET", Path: "/webhooks", Handler: ListWebhooksHandler, Tag: "webhooks", SignedIn: true, List: true, Response: Webhook{},
+		Summary: "List the webhooks you registered, or every webhook for admins"},
+	{Method: "POST", Path: "/webhooks", Handler: CreateWebhookHandler, Tag: "webhooks", SignedIn: true, Body: Webhook{}, Response: Webhook{},
+		Summary: "Register a webhook. the response is the only one that includes its secret"},
+	{Method: "GET", Path: "/webhooks/{id:uuid}", Handler: GetWebhookHandler, Tag: "webhooks", SignedIn: true, Response: Webhook{},
+		Summary: "Get a webhook. admins & whoever registered it only"},
+	{Method: "DELETE", Path: "/webhooks/{id:uuid}", Handler: DeleteWebhookHandler, Tag: "webhooks", SignedIn: true, Response: Webhook{},
+		Summary: "Delete a webhook & its delivery log. admins & whoever registered it only"},
+	{Method: "GET", Path: "/webhooks/{id:uuid}/deliveries", Handler: ListWebhookDeliveriesHandler, Tag: "webhooks", SignedIn: true, Paginated: true, Response: WebhookDelivery{},
+		Summary: "List a webhook's deliveries, most recent first. admins & whoever registered the webhook only"},
+	{Method: "POST", Path: "/webhooks/{id:uuid}/deliveries/{deliveryId:int}/redeliver", Handler: RedeliverWebhookHandler, Tag: "webhooks", SignedIn: true, Response: WebhookDelivery{},
+		Summary: "Queue a past delivery to be sent again. admins & whoever registered the webhook only"},
+
+	{Method: "GET", Path: "/alerts", Handler: ListAlertsHandler, Tag: "alerts", Paginated: true, Resource: alertsResource, Response: Alert{},
+		Summary: "List alerts raised about content under sources, most recent first"},
+	{Method: "GET", Path: "/alerts/suppressions", Handler: ListAlertSuppressionsHandler, Tag: "alerts", Admin: true, List: true, Response: AlertSuppression{},
+		Summary: "List alert suppressions. admins only"},
+	{Method: "DELETE", Path: "/alerts/suppressions/{id:int}", Handler: DeleteAlertSuppressionHandler, Tag: "alerts", Admin: true, Response: AlertSuppression{},
+		Summary: "Delete an alert suppression so its alerts are raised again. admins only"},
+	{Method: "GET", Path: "/alerts/{id:int}", Handler: GetAlertHandler, Tag: "alerts", Response: Alert{},
+		Summary: "Get an alert"},
+	{Method: "POST", Path: "/alerts/{id:int}/dismiss", Handler: DismissAlertHandler, Tag: "alerts", Admin: true, Response: Alert{},
+		Summary: "Dismiss an alert. admins only"},
+	{Method: "POST", Path: "/alerts/{id:int}/suppress", Handler: SuppressAlertHandler, Tag: "alerts", Admin: true, Body: AlertSuppressRequest{}, Response: AlertSuppression{},
+		Summary: "Dismiss an alert & stop alerts like it from being raised. admins only"},
+
+	{Method: "GET", Path: "/jobs", Handler: ListJobsHandler, Tag: "jobs", Paginated: true, Resource: jobsResource, Response: Job{},
+		Summary: "List background jobs, most recent first"},
+	{Method: "POST", Path: "/jobs", Handler: CreateJobHandler, Tag: "jobs", Idempotent: true, Body: JobRequest{}, Response: Job{},
+		Summary: "Start a background job. poll the job for its progress & result"},
+	{Method: "GET", Path: "/jobs/{id:uuid}", Handler: GetJobHandler, Tag: "jobs", Response: Job{},
+		Summary: "Get a background job's status, progress & result"},
+	{Method: "POST", Path: "/jobs/{id:uuid}/cancel", Handler: CancelJobHandler, Tag: "jobs", Response: Job{},
+		Summary: "Cancel a background job. running jobs stop the next time they check in. admins & whoever started the job only"},
+	{Method: "POST", Path: "/stats/refresh", Handler: RefreshStatsHandler, Tag: "jobs", Admin: true, Response: Job{},
+		Summary: "Queue a refresh of primer & source stats, or get the refresh that's already queued. admins only"},
+
+	{Method: "GET", Path: "/events", Handler: EventsHandler, Tag: "events", Stream: true, Response: ChangeEvent{},
+		Summary: "Stream inserts, updates & deletes of resources as Server-Sent Events",
+		QueryParams: []Param{
+			{Name: "type", Type: "string", Description: "comma-separated resource types to stream, one of primers, sources, urls, collections, uncrawlables or customcrawls"},
+			{Name: "id", Type: "string", Description: "only stream changes to the resource with this id"},
+		}},
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// rpcDialTimeout bounds how long we'll wait to connect to an rpc service
+const rpcDialTimeout = 5 * time.Second
+
+var (
+	// coverageRPC is a shared connection to the coverage service
+	coverageRPC = &rpcClient{addr: func() string { return cfg.CoverageServiceUrl }}
+	// identityRPC is a shared connection to the identity service
+	identityRPC = &rpcClient{addr: func() string { return cfg.IdentityServiceUrl }}
+)
+
+// rpcClient lazily dials an rpc service, reusing the connection across
+// requests & reconnecting if the connection has been shut down
+type rpcClient struct {
+	// addr is a func so the client picks up configuration that's read in
+	// after package initialization
+	addr func() string
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+// conn returns the current client, dialing if necessary
+func (c *rpcClient) conn() (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", c.addr(), rpcDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.client = rpc.NewClient(conn)
+	return c.client, nil
+}
+
+// reset drops a broken client so the next call will redial
+func (c *rpcClient) reset(broken *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == broken {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// Call invokes the named function, retrying once on a fresh connection if
+// the existing one has been closed by the remote end
+func (c *rpcClient) Call(method string, args, reply interface{}) error {
+	cli, err := c.conn()
+	if err != nil {
+		return err
+	}
+
+	err = cli.Call(method, args, reply)
+	if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF {
+		c.reset(cli)
+		if cli, err = c.conn(); err != nil {
+			return err
+		}
+		return cli.Call(method, args, reply)
+	}
+	return err
+}
+
+// Close shuts down the underlying connection, if any
+func (c *rpcClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	if err == rpc.ErrShutdown {
+		return nil
+	}
+	return err
+}
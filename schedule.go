@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+)
+
+// UrlSchedule is when a url is next due to be fetched
+type UrlSchedule struct {
+	Url string `json:"url"`
+	// SourceId is the most specific source the url is under, whose stale
+	// duration sets how often it's fetched
+	SourceId string     `json:"sourceId"`
+	LastGet  *time.Time `json:"lastGet"`
+	// UnchangedChecks counts the fetches in a row that found the same
+	// content. with backoff enabled each one doubles the wait until the
+	// url is due
+	UnchangedChecks int       `json:"unchangedChecks"`
+	NextDue         time.Time `json:"nextDue"`
+}
+
+// UnmarshalSQL reads a schedule from a row of urlScheduleColumns
+func (s *UrlSchedule) UnmarshalSQL(row sqlutil.Scannable) error {
+	lastGet := pq.NullTime{}
+	if err := row.Scan(&s.Url, &s.SourceId, &lastGet, &s.UnchangedChecks, &s.NextDue); err != nil {
+		return err
+	}
+	if lastGet.Valid {
+		s.LastGet = &lastGet.Time
+	}
+	return nil
+}
+
+// scheduleUrls keeps url schedules up to date every interval until ctx is
+// done. everything is rescheduled on the first pass, so changes to
+// cfg.StaleBackoffMax & to the urls under each source apply at startup
+func scheduleUrls(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// one instance is enough to keep schedules, see leader.go
+		if !isDBReady() || !leader.isLeader() {
+			continue
+		}
+		start := time.Now().UTC()
+		n, err := refreshUrlSchedules(since)
+		if err != nil {
+			log.Infof("error scheduling urls: %s", err)
+			continue
+		}
+		since = start
+		if n > 0 {
+			log.Infof("scheduled %d urls", n)
+		}
+	}
+}
+
+// refreshUrlSchedules schedules new urls, urls that have been fetched since
+// they were last scheduled & urls under sources updated after since. a zero
+// since matches every url to its source again & reschedules it. returns the
+// number of urls scheduled
+func refreshUrlSchedules(since time.Time) (int64, error) {
+	res, err := appDB.Exec(qUrlSchedulesRefresh, since.IsZero(), cfg.staleBackoffMax(), core.StaleDuration.Seconds(), since)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ListDueUrlsHandler lists a page of urls that are due to be fetched
+// across all sources, most overdue first
+func ListDueUrlsHandler(w http.ResponseWriter, r *http.Request) {
+	p := apiutil.PageFromRequest(r)
+	writeUrlSchedules(w, r, p, qUrlSchedulesDue, p.Limit(), p.Offset())
+}
+
+// ListSourceStaleUrlsHandler lists a page of a source's urls that are due
+// to be fetched, most overdue first
+func ListSourceStaleUrlsHandler(w http.ResponseWriter, r *http.Request) {
+	s := &core.Source{Id: apiutil.PathParam(r, "id")}
+	if err := s.Read(store); isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	p := apiutil.PageFromRequest(r)
+	writeUrlSchedules(w, r, p, qUrlSchedulesSourceDue, s.Id, p.Limit(), p.Offset())
+}
+
+// writeUrlSchedules responds with a page of schedules read by query
+func writeUrlSchedules(w http.ResponseWriter, r *http.Request, p apiutil.Page, query string, args ...interface{}) {
+	rows, err := appDB.Query(query, args...)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	schedules := make([]*UrlSchedule, 0, p.Size)
+	for rows.Next() {
+		s := &UrlSchedule{}
+		if err := s.UnmarshalSQL(rows); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		schedules = append(schedules, s)
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, schedules, r, p)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/datatogether/core"
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/sqlutil"
 	_ "github.com/lib/pq"
@@ -19,8 +23,9 @@ var (
 	cfg *config
 	// log output handled by logrus package
 	log = logrus.New()
-	// application database connection
-	appDB = &sql.DB{}
+	// application database connection, set by initPostgres. check isDBReady
+	// before using
+	appDB *sql.DB
 	// elevate default store
 	store = sql_datastore.DefaultStore
 )
@@ -43,10 +48,59 @@ func main() {
 		panic(fmt.Errorf("server configuration error: %s", err.Error()))
 	}
 
-	go initPostgres()
+	// "api migrate [command]" manages the database schema & exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(os.Args[2:], os.Stdout))
+	}
+	// "api openapi" prints the generated api spec & exits
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		os.Exit(openAPICommand(os.Stdout))
+	}
+
+	// listen for shutdown signals before doing anything else so a SIGTERM
+	// during startup still results in an orderly exit
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// connect to postgres in the background. Readiness checks will fail &
+	// api routes will respond with 503 until the db & schema are ready
+	background.Go("postgres connect", func(ctx context.Context) {
+		if err := initPostgres(ctx); err != nil {
+			log.Infoln(err)
+		}
+	})
+
+	background.Go("prune idempotency keys", func(ctx context.Context) {
+		pruneIdempotencyKeys(ctx, time.Hour)
+	})
+	background.Go("change events", listenForChanges)
+	background.Go("deliver webhooks", func(ctx context.Context) {
+		deliverWebhooks(ctx, 5*time.Second)
+	})
+	background.Go("prune change events", func(ctx context.Context) {
+		pruneChangeEvents(ctx, time.Minute)
+	})
+	background.Go("detect alerts", func(ctx context.Context) {
+		detectAlerts(ctx, time.Minute)
+	})
+	background.Go("schedule urls", func(ctx context.Context) {
+		scheduleUrls(ctx, time.Minute)
+	})
+	background.Go("leader election", func(ctx context.Context) {
+		electLeader(ctx, 10*time.Second)
+	})
+	background.Go("run jobs", func(ctx context.Context) {
+		runJobs(ctx, time.Second)
+	})
+	background.Go("queue stats refreshes", func(ctx context.Context) {
+		queueStatsRefreshes(ctx, cfg.statsInterval())
+	})
 
 	// base server
 	s := &http.Server{}
+	// /events streams stay open until the client leaves, end them so
+	// shutdown doesn't wait on them
+	s.RegisterOnShutdown(changes.close)
 	// connect mux routes to server
 	s.Handler = NewServerRoutes()
 
@@ -55,10 +109,22 @@ func main() {
 
 	// fire it up!
 	log.Infoln("starting server on port", cfg.Port)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- StartServer(cfg, s)
+	}()
+
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-sigs:
+		log.Infof("received %s, shutting down", sig)
+	}
 
-	// start server wrapped in a log.Fatal b/c http.ListenAndServe will not
-	// return unless there's an error
-	log.Fatal(StartServer(cfg, s))
+	if err := shutdown(s, cfg.shutdownTimeout()); err != nil {
+		log.Fatal(err)
+	}
+	log.Infoln("shutdown complete")
 }
 
 // NewServerRoutes returns a Muxer that has all API routes.
@@ -66,88 +132,103 @@ func main() {
 func NewServerRoutes() *http.ServeMux {
 	m := http.NewServeMux()
 
-	m.Handle("/", middleware(NotFoundHandler))
-	m.Handle("/healthcheck", middleware(HealthCheckHandler))
+	// the old, basic health check stays outside the router for load
+	// balancers that already point at it
+	m.HandleFunc("/healthcheck", HealthCheckHandler)
 
 	// serve static content for api documentation
-	m.Handle("/docs/", http.StripPrefix("/docs/", http.FileServer(http.Dir(packagePath("docs")))))
+	m.Handle("/docs/", DocsHandler())
+	m.HandleFunc("/openapi.yaml", OpenAPIYAMLHandler)
+	m.HandleFunc("/openapi.json", OpenAPIJSONHandler)
 	// m.Handle("/javascripts", http.FileServer(http.Dir("public/javascripts")))
 	// m.Handle("/stylesheets", http.FileServer(http.Dir("public/stylesheets")))
 
-	m.Handle("/users", middleware(UsersHandler))
-	m.Handle("/users/", middleware(UserHandler))
-
-	m.Handle("/primers", middleware(PrimersHandler))
-	m.Handle("/primers/", middleware(PrimerHandler))
-
-	m.Handle("/sources", middleware(SourcesHandler))
-	m.Handle("/sources/", middleware(SourceHandler))
-
-	m.Handle("/urls", middleware(UrlsHandler))
-	m.Handle("/urls/", middleware(UrlHandler))
-
-	// m.Handle("/links", middleware(LinksHandler))
-	// m.Handle("/links/", middleware(LinkHandler))
-
-	// m.Handle("/snapshots", middleware(SnapshotsHandler))
-
-	m.Handle("/coverage", middleware(CoverageHandler))
-
-	m.Handle("/repositories", middleware(RepositoriesHandler))
-	m.Handle("/repositories/", middleware(RepositoryHandler))
-
-	// m.Handle("/content", middleware())
-	// m.Handle("/content/", middleware())
-
-	// m.Handle("/metadata", middleware())
-	// m.Handle("/metadata/", middleware())
-
-	m.Handle("/collections", middleware(CollectionsHandler))
-	m.Handle("/collections/", middleware(CollectionHandler))
-
-	m.Handle("/uncrawlables", middleware(UncrawlablesHandler))
-	m.Handle("/uncrawlables/", middleware(UncrawlableHandler))
-
-	m.Handle("/customcrawls", middleware(CustomCrawlsHandler))
-	m.Handle("/customcrawls/", middleware(CustomCrawlHandler))
-
 	m.HandleFunc("/.well-known/acme-challenge/", CertbotHandler)
 
+	m.Handle("/", NewAPIRouter(apiRoutes))
 	return m
 }
 
-func initPostgres() {
-	log.Infoln("connecting to postgres db")
-	if err := sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB); err != nil {
-		panic(err)
+// NewAPIRouter builds a router from a list of routes. Versioned routes are
+// also served at their unprefixed paths as deprecated aliases
+func NewAPIRouter(routes []*Route) *apiutil.Router {
+	r := apiutil.NewRouter()
+	r.NotFound = middleware(NotFoundHandler)
+	r.Options = http.HandlerFunc(OptionsHandler)
+
+	for _, rt := range routes {
+		handler := rt.Handler
+		if rt.Selectable() {
+			handler = withFields(rt, handler)
+		}
+		if rt.Idempotent {
+			handler = withIdempotency(rt, handler)
+		}
+		// in test mode check all traffic against the api spec
+		if cfg != nil && cfg.Mode == TEST_MODE && !rt.Stream {
+			handler = validateSpec(rt, handler)
+		}
+		if rt.Method == "GET" && !rt.Stream {
+			handler = withCaching(rt, handler)
+		}
+		if rt.Admin {
+			handler = requireAdmin(handler)
+		} else if rt.SignedIn {
+			handler = requireSignIn(handler)
+		}
+		if !rt.SkipMiddleware {
+			handler = middleware(handler)
+		}
+
+		r.HandleFunc(rt.Method, rt.VersionedPath(), handler)
+		if !rt.Unversioned {
+			r.HandleFunc(rt.Method, rt.Path, deprecatedAlias(handler))
+		}
 	}
-	log.Infoln("connecteded to postgres db")
-	created, err := sqlutil.EnsureTables(appDB, packagePath("sql/schema.sql"),
-		"primers",
-		"sources",
-		"urls",
-		"links",
-		"metadata",
-		"snapshots",
-		"collections",
-		"collection_contents",
-		"uncrawlables",
-		"archive_requests")
+	return r
+}
+
+// initPostgres connects to the application database & applies any pending
+// migrations, retrying with backoff until it succeeds or ctx is cancelled
+func initPostgres(ctx context.Context) error {
+	log.Infoln("connecting to postgres db")
+	err := retryWithBackoff(ctx, "postgres connect", time.Second, 30*time.Second, func() error {
+		db, err := sqlutil.SetupConnection("postgres", cfg.PostgresDbUrl)
+		if err != nil {
+			if db != nil {
+				db.Close()
+			}
+			return err
+		}
+
+		if !cfg.SkipMigrations {
+			m, err := newMigrator(db)
+			if err != nil {
+				db.Close()
+				return err
+			}
+			if err := m.Up(ctx); err != nil {
+				db.Close()
+				return err
+			}
+		}
+
+		appDB = db
+		return nil
+	})
 	if err != nil {
-		log.Infoln(err)
-	}
-	if len(created) > 0 {
-		log.Infoln("created tables:", created)
+		return err
 	}
 
-	sql_datastore.SetDB(appDB)
-	sql_datastore.Register(
-		&core.Collection{},
-		&core.Link{},
-		&core.Primer{},
-		&core.Source{},
-		&core.Uncrawlable{},
-		&core.CustomCrawl{},
-		&core.Url{},
-	)
+	log.Infoln("connected to postgres db")
+	initDatastore(appDB)
+	setDBReady(true)
+	return nil
+}
+
+// initDatastore points the default sql store at db & registers
+// datastoreModels
+func initDatastore(db *sql.DB) {
+	sql_datastore.SetDB(db)
+	sql_datastore.Register(datastoreModels...)
 }
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/pborman/uuid"
 )
 
 func TestServer(t *testing.T) {
@@ -20,3 +36,1766 @@ func TestServer(t *testing.T) {
 		t.Errorf("status code mismatch. expected: %d, got: %d", http.StatusOK, res.StatusCode)
 	}
 }
+
+func TestHealthChecks(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/healthz/live")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("live status code mismatch. expected: %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+
+	res, err = http.Get(s.URL + "/healthz/ready")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer res.Body.Close()
+
+	report := &HealthReport{}
+	if err := json.NewDecoder(res.Body).Decode(report); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"postgres", "schema", "coverage", "identity"} {
+		if report.Checks[name] == nil {
+			t.Errorf("expected ready report to include a %s check", name)
+		}
+	}
+	if report.Status == checkStatusOk && res.StatusCode != http.StatusOK {
+		t.Errorf("ready status code mismatch. expected: %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if report.Status != checkStatusOk && res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ready status code mismatch. expected: %d, got: %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+}
+
+func TestOpenAPISpecUpToDate(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeAPISpecYAML(buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadFile("open_api.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("open_api.yaml is out of date. regenerate it with: api openapi > open_api.yaml")
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	cases := []struct {
+		method, path, body string
+		handler            http.HandlerFunc
+		code               int
+	}{
+		{"GET", "/primers/{id:uuid}", "", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"meta":{"code":200},"data":{"id":"a","title":"primer"}}`))
+		}, http.StatusOK},
+		{"GET", "/primers/{id:uuid}", "", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"meta":{"code":200},"data":{"id":5}}`))
+		}, http.StatusInternalServerError},
+		{"GET", "/primers", "", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"meta":{"code":200},"data":[]}`))
+		}, http.StatusInternalServerError},
+		{"POST", "/uncrawlables", `{"url":false}`, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"meta":{"code":200},"data":{}}`))
+		}, http.StatusInternalServerError},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, bytes.NewBufferString(c.body))
+		w := httptest.NewRecorder()
+		validateSpec(testRoute(t, c.method, c.path), c.handler)(w, req)
+		if w.Code != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d. body: %s", i, c.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+
+	cases := []struct {
+		path, accept string
+		contentType  string
+		lines        int
+		firstLine    string
+	}{
+		{"/v1/sources?fields=id,title&sort=title", "text/csv", "text/csv; charset=utf-8", 4, "id,title"},
+		{"/v1/sources?format=ndjson&fields=title&sort=-created", "", "application/x-ndjson; charset=utf-8", 3, `{"title":"Hazardous Air Pollutants"}`},
+		{"/v1/sources?format=csv&pageSize=1&fields=title", "", "text/csv; charset=utf-8", 2, "title"},
+		// sources match urls anywhere in the url, ignoring case
+		{"/v1/urls?format=csv&fields=url&primer=5b1031f4-38a8-40b3-be91-c324bf686a87", "", "text/csv; charset=utf-8", 2, "url"},
+		{"/v1/sources?format=csv&primer=4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1", "", "text/csv; charset=utf-8", 1, "id,created,updated,title,description,url,primer,crawl,staleDuration,lastAlertSent,meta,stats"},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", s.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Accept", c.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d. body: %s", i, http.StatusOK, res.StatusCode, string(body))
+			continue
+		}
+		if got := res.Header.Get("Content-Type"); got != c.contentType {
+			t.Errorf("case %d content type mismatch. expected: %s, got: %s", i, c.contentType, got)
+		}
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		if len(lines) != c.lines {
+			t.Errorf("case %d line count mismatch. expected: %d, got: %d", i, c.lines, len(lines))
+		}
+		if lines[0] != c.firstLine {
+			t.Errorf("case %d first line mismatch. expected: %s, got: %s", i, c.firstLine, lines[0])
+		}
+	}
+}
+
+func TestWithCaching(t *testing.T) {
+	primer := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"meta":{"code":200},"data":{"id":"a","updated":"2017-01-01T10:00:00Z"}}`))
+	}
+	primers := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"meta":{"code":200},"data":[{"id":"a","updated":"2017-01-01T10:00:00Z"}],"pagination":{}}`))
+	}
+	etag := apiutil.ETag([]byte(`{"meta":{"code":200},"data":{"id":"a","updated":"2017-01-01T10:00:00Z"}}`))
+
+	cases := []struct {
+		path         string
+		handler      http.HandlerFunc
+		header, val  string
+		code         int
+		lastModified string
+		cacheControl string
+	}{
+		{"/primers/{id:uuid}", primer, "", "", http.StatusOK, "Sun, 01 Jan 2017 10:00:00 GMT", "no-cache"},
+		{"/primers/{id:uuid}", primer, "If-None-Match", etag, http.StatusNotModified, "Sun, 01 Jan 2017 10:00:00 GMT", "no-cache"},
+		{"/primers/{id:uuid}", primer, "If-None-Match", `"stale"`, http.StatusOK, "Sun, 01 Jan 2017 10:00:00 GMT", "no-cache"},
+		{"/primers/{id:uuid}", primer, "If-Modified-Since", "Sun, 01 Jan 2017 10:00:00 GMT", http.StatusNotModified, "Sun, 01 Jan 2017 10:00:00 GMT", "no-cache"},
+		{"/primers/{id:uuid}", primer, "If-Modified-Since", "Sat, 31 Dec 2016 10:00:00 GMT", http.StatusOK, "Sun, 01 Jan 2017 10:00:00 GMT", "no-cache"},
+		{"/primers", primers, "", "", http.StatusOK, "", "no-cache"},
+		{"/coverage", primers, "", "", http.StatusOK, "", "public, max-age=300"},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest("GET", "/v1/things", nil)
+		if c.header != "" {
+			req.Header.Set(c.header, c.val)
+		}
+		w := httptest.NewRecorder()
+		withCaching(testRoute(t, "GET", c.path), c.handler)(w, req)
+
+		if w.Code != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d", i, c.code, w.Code)
+		}
+		if c.code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("case %d expected an empty body for a 304, got: %s", i, w.Body.String())
+		}
+		if w.Header().Get("ETag") == "" {
+			t.Errorf("case %d missing ETag", i)
+		}
+		if got := w.Header().Get("Last-Modified"); got != c.lastModified {
+			t.Errorf("case %d Last-Modified mismatch. expected: '%s', got: '%s'", i, c.lastModified, got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != c.cacheControl {
+			t.Errorf("case %d Cache-Control mismatch. expected: '%s', got: '%s'", i, c.cacheControl, got)
+		}
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+
+	path := s.URL + "/v1/uncrawlables/55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e"
+	do := func(method, ifMatch, body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		env := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&env); err != nil {
+			t.Fatal(err.Error())
+		}
+		return res, env
+	}
+
+	res, env := do("GET", "", "")
+	etag := res.Header.Get("ETag")
+	data, err := json.Marshal(env["data"])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body := string(data)
+
+	cases := []struct {
+		method, ifMatch string
+		code            int
+	}{
+		{"PUT", "", http.StatusPreconditionRequired},
+		{"PUT", `"stale"`, http.StatusPreconditionFailed},
+		{"DELETE", `"stale"`, http.StatusPreconditionFailed},
+		{"PUT", etag, http.StatusOK},
+		// the first update changed the etag
+		{"PUT", etag, http.StatusPreconditionFailed},
+	}
+	for i, c := range cases {
+		res, env = do(c.method, c.ifMatch, body)
+		if res.StatusCode != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d. body: %v", i, c.code, res.StatusCode, env)
+		}
+		if c.code == http.StatusPreconditionFailed && env["data"] == nil {
+			t.Errorf("case %d expected a 412 to include the current resource", i)
+		}
+	}
+
+	// retrying with the etag from a 412 succeeds, & responds with the etag
+	// a GET would
+	res, env = do("PUT", res.Header.Get("ETag"), body)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("retry status code mismatch. expected: %d, got: %d. body: %v", http.StatusOK, res.StatusCode, env)
+	}
+	etag = res.Header.Get("ETag")
+	if get, _ := do("GET", "", ""); etag == "" || get.Header.Get("ETag") != etag {
+		t.Errorf("update etag mismatch. expected: %s, got: %s", get.Header.Get("ETag"), etag)
+	}
+	res, env = do("DELETE", etag, "")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("delete status code mismatch. expected: %d, got: %d. body: %v", http.StatusOK, res.StatusCode, env)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+
+	path := s.URL + "/v1/uncrawlables/55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e"
+	res, err := http.Get(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+
+	cases := []struct {
+		contentType, ifMatch, body string
+		code                       int
+		comments                   string
+	}{
+		{"application/json", etag, `{"comments":"nope"}`, http.StatusUnsupportedMediaType, ""},
+		{"application/merge-patch+json", "", `{"comments":"nope"}`, http.StatusPreconditionRequired, ""},
+		{"application/merge-patch+json", etag, `{"comments":`, http.StatusBadRequest, ""},
+		{"application/merge-patch+json", etag, `{"ftp":"yes"}`, http.StatusUnprocessableEntity, ""},
+		{"application/json-patch+json", etag, `[{"op":"test","path":"/comments","value":"nope"}]`, http.StatusConflict, ""},
+		{"application/json-patch+json", etag, `[{"op":"remove","path":"/nope"}]`, http.StatusConflict, ""},
+		{"application/merge-patch+json", etag, `{"comments":"merged","name":null}`, http.StatusOK, "merged"},
+		// the merge patch changed the etag
+		{"application/json-patch+json", etag, `[{"op":"replace","path":"/comments","value":"stale"}]`, http.StatusPreconditionFailed, ""},
+		{"application/json-patch+json", "*", `[{"op":"test","path":"/comments","value":"merged"},{"op":"replace","path":"/comments","value":"patched"}]`, http.StatusOK, "patched"},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("PATCH", path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		if c.ifMatch != "" {
+			req.Header.Set("If-Match", c.ifMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		env := map[string]interface{}{}
+		err = json.NewDecoder(res.Body).Decode(&env)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if res.StatusCode != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d. body: %v", i, c.code, res.StatusCode, env)
+			continue
+		}
+		if c.code == http.StatusUnsupportedMediaType && res.Header.Get("Accept-Patch") == "" {
+			t.Errorf("case %d expected an Accept-Patch header", i)
+		}
+		if c.comments != "" {
+			data, _ := env["data"].(map[string]interface{})
+			if data["comments"] != c.comments {
+				t.Errorf("case %d comments mismatch. expected: %s, got: %v", i, c.comments, data["comments"])
+			}
+			if data["name"] != "" {
+				t.Errorf("case %d expected null to clear name, got: %v", i, data["name"])
+			}
+		}
+	}
+}
+
+func TestBodyValidation(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables", "sources")
+
+	cases := []struct {
+		method, path, body string
+		code               int
+		errors             []string
+	}{
+		{"POST", "/v1/uncrawlables", `{"url":"nope","email":"nope"}`, http.StatusUnprocessableEntity, []string{"url:invalid_url", "email:invalid_email"}},
+		{"POST", "/v1/uncrawlables", `{"url":"https://example.com","nope":1}`, http.StatusUnprocessableEntity, []string{"nope:unknown_field"}},
+		{"POST", "/v1/uncrawlables", `{"comments":"` + strings.Repeat("a", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge, nil},
+		{"POST", "/v1/customcrawls", `{}`, http.StatusUnprocessableEntity, []string{"originalUrl:required"}},
+		{"PUT", "/v1/sources/00000000-0000-0000-0000-000000000000", `{"url":"https://example.com","primer":{"id":"00000000-0000-0000-0000-000000000000"}}`, http.StatusUnprocessableEntity, []string{"primer.id:not_found"}},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest(c.method, s.URL+c.path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		env := struct {
+			Errors []*apiutil.FieldError
+		}{}
+		err = json.NewDecoder(res.Body).Decode(&env)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if res.StatusCode != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d", i, c.code, res.StatusCode)
+			continue
+		}
+		got := []string{}
+		for _, fe := range env.Errors {
+			got = append(got, fe.Field+":"+fe.Code)
+		}
+		if len(c.errors) > 0 && !reflect.DeepEqual(got, c.errors) {
+			t.Errorf("case %d errors mismatch. expected: %v, got: %v", i, c.errors, got)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+
+	do := func(method, path, body string) (*http.Response, []*BatchResult) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		env := struct {
+			Data []*BatchResult
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(&env); err != nil {
+			t.Fatal(err.Error())
+		}
+		return res, env.Data
+	}
+	statuses := func(results []*BatchResult) []int {
+		codes := []int{}
+		for _, r := range results {
+			codes = append(codes, r.Status)
+		}
+		return codes
+	}
+
+	id := "55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e"
+	res, results := do("POST", "/v1/uncrawlables/batch", `{"ids":["`+id+`","nope","00000000-0000-0000-0000-000000000000"],"urls":["https://www.census.gov/topics/economy/classification-codes.html"]}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("batch get status code mismatch. expected: %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if got, expect := statuses(results), []int{200, 404, 404, 200}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("batch get statuses mismatch. expected: %v, got: %v", expect, got)
+	}
+	if res, _ := do("POST", "/v1/primers/batch", `{"urls":["https://example.com"]}`); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("batch get by url status code mismatch. expected: %d, got: %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+
+	data, err := json.Marshal(results[0].Data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	current := string(data)
+
+	// an invalid item fails the whole batch
+	res, results = do("PUT", "/v1/uncrawlables/batch", `[`+current+`,{"url":"nope"},{"url":"https://example.com/new"}]`)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("failed batch status code mismatch. expected: %d, got: %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+	if got, expect := statuses(results), []int{424, 422, 424}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("failed batch statuses mismatch. expected: %v, got: %v", expect, got)
+	}
+
+	// ids have to be uuids, & items the database refuses get their own result
+	res, results = do("PUT", "/v1/uncrawlables/batch", `[{"id":"nope","url":"https://example.com/nope"},{"url":"https://www.census.gov/topics/economy/classification-codes.html"},{"url":"https://example.com/other"}]`)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("refused batch status code mismatch. expected: %d, got: %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+	if got, expect := statuses(results), []int{422, 409, 424}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("refused batch statuses mismatch. expected: %v, got: %v", expect, got)
+	}
+
+	// orgId is accepted & ignored, see uncrawlableBody
+	res, results = do("PUT", "/v1/uncrawlables/batch", `[`+current+`,{"url":"https://example.com/new","orgId":"ignored"}]`)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("batch upsert status code mismatch. expected: %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if got, expect := statuses(results), []int{200, 201}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("batch upsert statuses mismatch. expected: %v, got: %v", expect, got)
+	}
+
+	// the first upsert changed the updated time
+	_, results = do("PUT", "/v1/uncrawlables/batch", `[`+current+`]`)
+	if got, expect := statuses(results), []int{412}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("stale batch statuses mismatch. expected: %v, got: %v", expect, got)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+
+	post := func(key, body string, ip ...string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", s.URL+"/v1/uncrawlables", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Idempotency-Key", key)
+		if len(ip) > 0 {
+			req.Header.Set("X-Forwarded-For", ip[0])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return res, string(data)
+	}
+
+	body := `{"url":"https://example.com/idempotent"}`
+	first, firstBody := post("retry-me", body)
+	if first.StatusCode >= 300 {
+		t.Fatalf("first request failed. status: %d, body: %s", first.StatusCode, firstBody)
+	}
+	if first.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("first response shouldn't be marked as replayed")
+	}
+
+	retry, retryBody := post("retry-me", body)
+	if retry.StatusCode != first.StatusCode || retryBody != firstBody {
+		t.Errorf("retry mismatch. expected: %d %s, got: %d %s", first.StatusCode, firstBody, retry.StatusCode, retryBody)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the retry to be marked as replayed")
+	}
+
+	if res, _ := post("retry-me", `{"url":"https://example.com/different"}`); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("reused key status code mismatch. expected: %d, got: %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+	// keys only apply to whoever sent them
+	if res, resBody := post("retry-me", `{"url":"https://example.com/someone-else"}`, "203.0.113.7"); res.StatusCode >= 300 || res.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected another requester's key to be handled anew, got: %d %s", res.StatusCode, resBody)
+	}
+	if res, _ := post(strings.Repeat("a", 256), body); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("long key status code mismatch. expected: %d, got: %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "primers", "sources", "uncrawlables")
+
+	do := func(method, path, ifMatch, body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		env := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&env); err != nil {
+			t.Fatal(err.Error())
+		}
+		return res, env
+	}
+
+	for _, kind := range []struct{ name, id, body string }{
+		{"uncrawlables", "55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e", `"url":"https://www.epa.gov/trashed"`},
+		// NOAA has no sources or sub-primers
+		{"primers", "0f28f814-ec4c-4a75-b26e-4de435deb218", `"title":"NOAA"`},
+		{"sources", "590e001b-7060-4e54-bc81-c20c305a8155", `"url":"https://www.epa.gov/haps","title":"HAPs"`},
+	} {
+		path := "/v1/" + kind.name + "/" + kind.id
+		res, _ := do("GET", path, "", "")
+		etag := res.Header.Get("ETag")
+		// writes to something in the trash would update a row nobody can see
+		put := "{" + kind.body + "}"
+		batch := `[{"id":"` + kind.id + `",` + kind.body + "}]"
+
+		cases := []struct {
+			method, path, ifMatch, body string
+			code                        int
+		}{
+			{"POST", path + "/restore", "", "", http.StatusNotFound},
+			{"DELETE", path, etag, "", http.StatusOK},
+			{"GET", path, "", "", http.StatusNotFound},
+			{"DELETE", path, etag, "", http.StatusNotFound},
+			{"PUT", path, "", put, http.StatusConflict},
+			{"PUT", "/v1/" + kind.name + "/batch", "", batch, http.StatusUnprocessableEntity},
+			{"GET", "/v1/trash", "", "", http.StatusBadRequest},
+			{"GET", "/v1/trash?type=nope", "", "", http.StatusBadRequest},
+			{"GET", "/v1/trash?type=" + kind.name, "", "", http.StatusOK},
+			{"POST", "/v1/trash/purge", "", "", http.StatusForbidden},
+			{"POST", path + "/restore", "", "", http.StatusOK},
+			{"GET", path, "", "", http.StatusOK},
+		}
+		for i, c := range cases {
+			res, env := do(c.method, c.path, c.ifMatch, c.body)
+			if res.StatusCode != c.code {
+				t.Errorf("%s case %d %s %s status code mismatch. expected: %d, got: %d. body: %v", kind.name, i, c.method, c.path, c.code, res.StatusCode, env)
+			}
+			if c.body == batch {
+				items, _ := env["data"].([]interface{})
+				if len(items) != 1 || items[0].(map[string]interface{})["status"] != float64(http.StatusConflict) {
+					t.Errorf("%s case %d expected a 409 item result, got: %v", kind.name, i, env["data"])
+				}
+			}
+			if c.path == "/v1/trash?type="+kind.name {
+				if items, _ := env["data"].([]interface{}); len(items) != 1 {
+					t.Errorf("%s case %d expected 1 item in the trash, got: %v", kind.name, i, env["data"])
+				}
+			}
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+	if _, err := appDB.Exec("DELETE FROM audit_events"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	id := "55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e"
+	path := "/v1/uncrawlables/" + id
+	res, err := http.Get(s.URL + path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+
+	for _, method := range []string{"DELETE", "POST"} {
+		p := path
+		if method == "POST" {
+			p += "/restore"
+		}
+		req, err := http.NewRequest(method, s.URL+p, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if method == "DELETE" {
+			req.Header.Set("If-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s status code mismatch. expected: %d, got: %d", method, p, http.StatusOK, res.StatusCode)
+		}
+	}
+
+	rows, err := appDB.Query(`SELECT action, diff FROM audit_events WHERE resource_type = 'uncrawlables' AND resource_id = $1 ORDER BY id`, id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rows.Close()
+	actions := []string{}
+	for rows.Next() {
+		var (
+			action string
+			data   []byte
+		)
+		if err := rows.Scan(&action, &data); err != nil {
+			t.Fatal(err.Error())
+		}
+		diff := map[string]*apiutil.Change{}
+		if err := json.Unmarshal(data, &diff); err != nil {
+			t.Fatal(err.Error())
+		}
+		if diff["url"] == nil {
+			t.Errorf("expected %s diff to include url, got: %s", action, string(data))
+		}
+		actions = append(actions, action)
+	}
+	if strings.Join(actions, ",") != "delete,restore" {
+		t.Errorf("audit actions mismatch. expected: delete,restore, got: %v", actions)
+	}
+
+	res, err = http.Get(s.URL + "/v1/audit")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("anonymous audit list status code mismatch. expected: %d, got: %d", http.StatusForbidden, res.StatusCode)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+
+	var last int64
+	if err := appDB.QueryRow(qChangeEventsLatest).Scan(&last); err != nil {
+		t.Fatal(err.Error())
+	}
+	id := "55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e"
+	res, err := http.Get(s.URL + "/v1/uncrawlables/" + id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	req, err := http.NewRequest("DELETE", s.URL+"/v1/uncrawlables/"+id, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("If-Match", res.Header.Get("ETag"))
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	res, err = http.Get(s.URL + "/v1/events?type=nope")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad type status code mismatch. expected: %d, got: %d", http.StatusBadRequest, res.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err = http.NewRequest("GET", s.URL+"/v1/events?type=uncrawlables&id="+id, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(last, 10))
+	res, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type mismatch. expected: text/event-stream, got: %s", ct)
+	}
+
+	// the delete was made before connecting, so it's replayed from the log
+	e := &ChangeEvent{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e); err != nil {
+				t.Fatal(err.Error())
+			}
+			break
+		}
+	}
+	if e.ResourceType != "uncrawlables" || e.ResourceId != id || e.Action != "update" {
+		t.Errorf("replayed event mismatch. expected an update of uncrawlable %s, got: %#v", id, e)
+	}
+	if e.Id <= last {
+		t.Errorf("expected replayed event id to be after %d, got: %d", last, e.Id)
+	}
+}
+
+func TestChangeCursor(t *testing.T) {
+	c := &changeCursor{}
+	if err := appDB.QueryRow(qChangeEventsLatest).Scan(&c.last); err != nil {
+		t.Fatal(err.Error())
+	}
+	ch, _ := changes.subscribe()
+	defer changes.unsubscribe(ch)
+
+	insert := "INSERT INTO change_events (resource_type, resource_id, action) VALUES ('uncrawlables', $1, 'update');"
+	tx, err := appDB.Begin()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tx.Rollback()
+	// the first event is still in a transaction when the second one commits
+	if _, err := tx.Exec(insert, "first"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(insert, "second"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c.publish()
+	if c.horizon == 0 {
+		t.Errorf("expected the cursor to wait on the gap")
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("expected no events while the first is uncommitted, got: %#v", e)
+	default:
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	c.publish()
+	for _, id := range []string{"first", "second"} {
+		select {
+		case e := <-ch:
+			if e.ResourceId != id {
+				t.Errorf("event order mismatch. expected: %s, got: %s", id, e.ResourceId)
+			}
+		default:
+			t.Fatalf("expected event %s to be published", id)
+		}
+	}
+	if c.horizon != 0 {
+		t.Errorf("expected the gap to be cleared, got horizon: %d", c.horizon)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "uncrawlables")
+	defer appDB.Exec("DELETE FROM webhooks")
+	// the receiver is on loopback
+	cfg.WebhookAllowPrivate = true
+	defer func() { cfg.WebhookAllowPrivate = false }()
+
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	received := make(chan delivery, 1)
+	status := http.StatusOK
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := status
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- delivery{r.Header, body}
+		w.WriteHeader(code)
+	}))
+	defer receiver.Close()
+
+	// webhook routes need a signed in user, serve them with the user named
+	// in a header instead
+	users := apiutil.NewRouter()
+	for _, rt := range apiRoutes {
+		if rt.Tag != "webhooks" {
+			continue
+		}
+		handler := rt.Handler
+		users.HandleFunc(rt.Method, "/v1"+rt.Path, func(w http.ResponseWriter, r *http.Request) {
+			name := r.Header.Get("X-Test-User")
+			u := &User{Id: name, Username: name}
+			handler(w, r.WithContext(context.WithValue(r.Context(), "user", u)))
+		})
+	}
+	hooks := httptest.NewServer(users)
+	defer hooks.Close()
+	as := func(user, method, path, body string, code int) map[string]interface{} {
+		req, err := http.NewRequest(method, hooks.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("X-Test-User", user)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		env := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&env); err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.StatusCode != code {
+			t.Fatalf("%s %s %s status code mismatch. expected: %d, got: %d. body: %v", user, method, path, code, res.StatusCode, env)
+		}
+		return env
+	}
+
+	secret := "0123456789abcdef0123456789abcdef"
+	body := `{"url":"` + receiver.URL + `","events":["uncrawlable.created"],"secret":"` + secret + `"}`
+	created, _ := as("partner", "POST", "/v1/webhooks", body, http.StatusOK)["data"].(map[string]interface{})
+	if created["createdBy"] != "partner" {
+		t.Errorf("webhook createdBy mismatch. expected: partner, got: %v", created["createdBy"])
+	}
+	path := fmt.Sprintf("/v1/webhooks/%s", created["id"])
+
+	create := func(url string) {
+		res, err := http.Post(s.URL+"/v1/uncrawlables", "application/json", strings.NewReader(`{"url":"`+url+`"}`))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("create uncrawlable status code mismatch. expected: %d, got: %d", http.StatusOK, res.StatusCode)
+		}
+	}
+	deliver := func() delivery {
+		if n, err := deliverDueWebhooks(webhookClient); err != nil {
+			t.Fatal(err.Error())
+		} else if n != 1 {
+			t.Fatalf("expected 1 due delivery, got: %d", n)
+		}
+		return <-received
+	}
+	lastDelivery := func() (status string, attempts int) {
+		if err := appDB.QueryRow("SELECT status, attempts FROM webhook_deliveries ORDER BY id DESC LIMIT 1").Scan(&status, &attempts); err != nil {
+			t.Fatal(err.Error())
+		}
+		return
+	}
+
+	create("https://example.com/webhooks/delivered")
+	d := deliver()
+	if event := d.header.Get("X-Webhook-Event"); event != "uncrawlable.created" {
+		t.Errorf("event header mismatch. expected: uncrawlable.created, got: %s", event)
+	}
+	if sig := signWebhook(secret, d.header.Get("X-Webhook-Timestamp"), d.body); d.header.Get("X-Webhook-Signature") != sig {
+		t.Errorf("signature mismatch. expected: %s, got: %s", sig, d.header.Get("X-Webhook-Signature"))
+	}
+	if !strings.Contains(string(d.body), "https://example.com/webhooks/delivered") {
+		t.Errorf("expected payload to include the uncrawlable, got: %s", string(d.body))
+	}
+	if st, _ := lastDelivery(); st != deliveryDelivered {
+		t.Errorf("delivery status mismatch. expected: %s, got: %s", deliveryDelivered, st)
+	}
+
+	// failed deliveries stay queued for a retry
+	status = http.StatusInternalServerError
+	create("https://example.com/webhooks/failed")
+	deliver()
+	if st, attempts := lastDelivery(); st != deliveryPending || attempts != 1 {
+		t.Errorf("failed delivery mismatch. expected: %s after 1 attempt, got: %s after %d", deliveryPending, st, attempts)
+	}
+	if n, err := deliverDueWebhooks(webhookClient); err != nil || n != 0 {
+		t.Errorf("expected the retry to wait, got %d due deliveries. err: %v", n, err)
+	}
+
+	// webhooks are only visible to whoever registered them
+	if list, _ := as("partner", "GET", "/v1/webhooks", "", http.StatusOK)["data"].([]interface{}); len(list) != 1 {
+		t.Errorf("expected partner to list 1 webhook, got: %d", len(list))
+	}
+	if list, _ := as("someone", "GET", "/v1/webhooks", "", http.StatusOK)["data"].([]interface{}); len(list) != 0 {
+		t.Errorf("expected someone else to list 0 webhooks, got: %d", len(list))
+	}
+	as("partner", "GET", path, "", http.StatusOK)
+	as("someone", "GET", path, "", http.StatusForbidden)
+	deliveries, _ := as("partner", "GET", path+"/deliveries", "", http.StatusOK)["data"].([]interface{})
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got: %d", len(deliveries))
+	}
+	as("someone", "GET", path+"/deliveries", "", http.StatusForbidden)
+	first, _ := deliveries[0].(map[string]interface{})
+	as("someone", "POST", fmt.Sprintf("%s/deliveries/%v/redeliver", path, first["id"]), "", http.StatusForbidden)
+	as("partner", "POST", fmt.Sprintf("%s/deliveries/%v/redeliver", path, first["id"]), "", http.StatusOK)
+
+	res, err := http.Get(s.URL + "/v1/webhooks")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("anonymous webhook list status code mismatch. expected: %d, got: %d", http.StatusForbidden, res.StatusCode)
+	}
+
+	// redirects aren't followed
+	redirect := httptest.NewServer(http.RedirectHandler(receiver.URL, http.StatusFound))
+	defer redirect.Close()
+	if code, err := sendWebhook(webhookClient, redirect.URL, secret, 1, "uncrawlable.created", []byte("{}")); err == nil || code != http.StatusFound {
+		t.Errorf("expected a redirect to fail with status %d, got: %d. err: %v", http.StatusFound, code, err)
+	}
+
+	// private addresses are refused, both when registering & sending
+	cfg.WebhookAllowPrivate = false
+	webhookClient.CloseIdleConnections()
+	as("partner", "POST", "/v1/webhooks", body, http.StatusUnprocessableEntity)
+	for _, u := range []string{receiver.URL, "http://localhost/", "http://169.254.169.254/", "http://[::1]/"} {
+		if _, err := sendWebhook(webhookClient, u, secret, 1, "uncrawlable.created", []byte("{}")); err == nil || !strings.Contains(err.Error(), errWebhookPrivate.Error()) {
+			t.Errorf("expected delivery to %s to be refused, got: %v", u, err)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "urls")
+	clear := func() {
+		for _, table := range []string{"alerts", "alert_suppressions", "url_alert_checks"} {
+			if _, err := appDB.Exec("DELETE FROM " + table); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	clear()
+	defer clear()
+
+	// dismiss & suppress are admin only, serve them without the check
+	admin := apiutil.NewRouter()
+	admin.HandleFunc("POST", "/alerts/{id:int}/dismiss", DismissAlertHandler)
+	admin.HandleFunc("POST", "/alerts/{id:int}/suppress", SuppressAlertHandler)
+
+	const epa = "326fcfa0-d3e6-4b2d-8f95-e77220e16109"
+	changeHash := func(hash string) []*Alert {
+		if _, err := appDB.Exec("UPDATE urls SET hash = $1 WHERE url = 'http://www.epa.gov'", hash); err != nil {
+			t.Fatal(err.Error())
+		}
+		alerts, err := raiseAlerts()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		changed := []*Alert{}
+		for _, a := range alerts {
+			if a.Kind == alertChanged {
+				changed = append(changed, a)
+			}
+		}
+		return changed
+	}
+	post := func(path, body string) {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s status code mismatch. expected: %d, got: %d. body: %s", path, http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+
+	alerts := changeHash("1220aaaa")
+	if len(alerts) != 1 {
+		t.Fatalf("expected 1 changed alert, got: %d", len(alerts))
+	}
+	if a := alerts[0]; a.SourceId != epa || a.Url != "http://www.epa.gov" {
+		t.Errorf("alert mismatch. expected source %s & url http://www.epa.gov, got: %s & %s", epa, a.SourceId, a.Url)
+	}
+
+	res, err := http.Get(s.URL + "/v1/alerts?kind=changed&dismissed=false")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	env := &struct {
+		Data []*Alert
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(env); err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if len(env.Data) != 1 || env.Data[0].Id != alerts[0].Id {
+		t.Errorf("expected open alerts to list alert %d, got: %d alerts", alerts[0].Id, len(env.Data))
+	}
+
+	// open alerts aren't raised twice
+	if alerts := changeHash("1220bbbb"); len(alerts) != 0 {
+		t.Errorf("expected the open alert to absorb the change, got %d new alerts", len(alerts))
+	}
+
+	post(fmt.Sprintf("/alerts/%d/dismiss", alerts[0].Id), "")
+	if a, err := readAlert(appDB, alerts[0].Id); err != nil {
+		t.Fatal(err.Error())
+	} else if a.DismissedAt == nil {
+		t.Errorf("expected alert %d to be dismissed", a.Id)
+	}
+
+	// once dismissed, the next change is a new alert. suppressing it stops
+	// the one after
+	alerts = changeHash("1220cccc")
+	if len(alerts) != 1 {
+		t.Fatalf("expected 1 changed alert after dismissing, got: %d", len(alerts))
+	}
+	post(fmt.Sprintf("/alerts/%d/suppress", alerts[0].Id), "{}")
+	if alerts := changeHash("1220dddd"); len(alerts) != 0 {
+		t.Errorf("expected suppressed alerts not to be raised, got: %d", len(alerts))
+	}
+
+	res, err = http.Post(s.URL+fmt.Sprintf("/v1/alerts/%d/dismiss", alerts[0].Id), "application/json", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("anonymous dismiss status code mismatch. expected: %d, got: %d", http.StatusForbidden, res.StatusCode)
+	}
+}
+
+func TestUrlSchedules(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "urls", "sources")
+	defer func(backoff string) { cfg.StaleBackoffMax = backoff }(cfg.StaleBackoffMax)
+	defer appDB.Exec("DELETE FROM alerts")
+	if _, err := appDB.Exec("DELETE FROM url_schedules"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := refreshUrlSchedules(time.Time{}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	due := func(path string) []*UrlSchedule {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s status code mismatch. expected: %d, got: %d", path, http.StatusOK, res.StatusCode)
+		}
+		env := &struct {
+			Data []*UrlSchedule
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(env); err != nil {
+			t.Fatal(err.Error())
+		}
+		return env.Data
+	}
+
+	// the epa url has never been fetched, so it's been due since it was
+	// created, before the census urls went stale
+	all := due("/v1/urls/due")
+	if len(all) != 3 {
+		t.Fatalf("expected 3 due urls, got: %d", len(all))
+	}
+	if all[0].Url != "http://www.epa.gov" {
+		t.Errorf("expected the most overdue url to be http://www.epa.gov, got: %s", all[0].Url)
+	}
+
+	census := due("/v1/sources/440d9779-406c-4015-8f2d-404b04ead3a2/stale")
+	if len(census) != 2 {
+		t.Fatalf("expected 2 stale census urls, got: %d", len(census))
+	}
+	for _, u := range census {
+		if u.SourceId != "440d9779-406c-4015-8f2d-404b04ead3a2" {
+			t.Errorf("expected %s to be scheduled by census.gov, got: %s", u.Url, u.SourceId)
+		}
+	}
+
+	// refetching without a change backs the url off to twice the census
+	// source's 12 hour stale duration
+	cfg.StaleBackoffMax = "8"
+	fetched := time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := appDB.Exec("UPDATE urls SET last_get = $1 WHERE url = 'https://www.census.gov/nometa.pdf'", fetched); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := refreshUrlSchedules(time.Now().UTC()); err != nil {
+		t.Fatal(err.Error())
+	}
+	var (
+		unchanged int
+		next      time.Time
+	)
+	if err := appDB.QueryRow("SELECT unchanged_checks, next_due FROM url_schedules WHERE url = 'https://www.census.gov/nometa.pdf'").Scan(&unchanged, &next); err != nil {
+		t.Fatal(err.Error())
+	}
+	if unchanged != 1 || !next.Equal(fetched.Add(24*time.Hour)) {
+		t.Errorf("backoff mismatch. expected 1 unchanged check & due %s, got: %d & %s", fetched.Add(24*time.Hour), unchanged, next)
+	}
+
+	// urls under a source that's been updated since the last pass are
+	// rescheduled with its new stale duration
+	since := time.Now().UTC().Add(-time.Second)
+	if _, err := appDB.Exec("UPDATE sources SET stale_duration = 86400000, updated = (now() at time zone 'utc') WHERE id = '440d9779-406c-4015-8f2d-404b04ead3a2'"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := refreshUrlSchedules(since); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := appDB.QueryRow("SELECT next_due FROM url_schedules WHERE url = 'https://www.census.gov/nometa.pdf'").Scan(&next); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !next.Equal(fetched.Add(48 * time.Hour)) {
+		t.Errorf("updated source due mismatch. expected: %s, got: %s", fetched.Add(48*time.Hour), next)
+	}
+
+	// stale alerts count the urls each source schedules
+	stale, err := queryAlerts(appDB, qAlertsRaiseStale, "", alertStale, core.StaleDuration.Seconds())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(stale) != 1 || stale[0].SourceId != "440d9779-406c-4015-8f2d-404b04ead3a2" || !strings.HasPrefix(stale[0].Message, "2 urls") {
+		t.Errorf("expected 1 stale alert for 2 census urls, got: %v", stale)
+	}
+
+	res, err := http.Get(s.URL + "/v1/sources/00000000-0000-0000-0000-000000000000/stale")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing source status code mismatch. expected: %d, got: %d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	if _, err := appDB.Exec("DELETE FROM jobs"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer func(types []*jobType) { jobTypes = types }(jobTypes)
+	jobTypes = append(jobTypes[:len(jobTypes):len(jobTypes)], &jobType{
+		Name:        "test.echo",
+		Concurrency: 2,
+		MaxAttempts: 1,
+		Run: func(ctx context.Context, run *jobRun) (interface{}, error) {
+			if err := run.Progress(0.5, "halfway"); err != nil {
+				return nil, err
+			}
+			return run.Params, nil
+		},
+	}, &jobType{
+		Name:        "test.fail",
+		Concurrency: 1,
+		MaxAttempts: 2,
+		Run: func(ctx context.Context, run *jobRun) (interface{}, error) {
+			return nil, fmt.Errorf("nope")
+		},
+	}, &jobType{
+		Name:        "test.lost",
+		Concurrency: 1,
+		MaxAttempts: 1,
+		Run: func(ctx context.Context, run *jobRun) (interface{}, error) {
+			// as if the lease ran out & another worker claimed the job
+			if _, err := appDB.Exec("UPDATE jobs SET claim = $2 WHERE id = $1", run.Id, uuid.New()); err != nil {
+				return nil, err
+			}
+			if err := run.Progress(0.5, "halfway"); err != errJobCanceled {
+				t.Errorf("expected progress on a lost job to be errJobCanceled, got: %v", err)
+			}
+			if ctx.Err() == nil {
+				t.Errorf("expected a lost job's run to be canceled")
+			}
+			return "done", nil
+		},
+	})
+
+	do := func(method, path, body string, code int) *Job {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != code {
+			t.Fatalf("%s %s status code mismatch. expected: %d, got: %d", method, path, code, res.StatusCode)
+		}
+		env := &struct {
+			Data *Job
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(env); err != nil {
+			t.Fatal(err.Error())
+		}
+		return env.Data
+	}
+	work := func() {
+		w := newJobWorker()
+		if err := w.claim(context.Background()); err != nil {
+			t.Fatal(err.Error())
+		}
+		w.wg.Wait()
+	}
+
+	echo := do("POST", "/v1/jobs", `{"type":"test.echo","params":{"n":1}}`, http.StatusOK)
+	if echo.Status != jobQueued {
+		t.Errorf("new job status mismatch. expected: %s, got: %s", jobQueued, echo.Status)
+	}
+	fail := do("POST", "/v1/jobs", `{"type":"test.fail"}`, http.StatusOK)
+	work()
+
+	echo = do("GET", "/v1/jobs/"+echo.Id, "", http.StatusOK)
+	if echo.Status != jobSucceeded || echo.Progress != 1 || string(echo.Result) != `{"n":1}` {
+		t.Errorf("finished job mismatch. expected succeeded with result {\"n\":1}, got: %s with %s", echo.Status, string(echo.Result))
+	}
+	if echo.ProgressMessage != "halfway" {
+		t.Errorf("progress message mismatch. expected: halfway, got: %s", echo.ProgressMessage)
+	}
+
+	// failed jobs with attempts left are retried later
+	fail = do("GET", "/v1/jobs/"+fail.Id, "", http.StatusOK)
+	if fail.Status != jobQueued || fail.Attempts != 1 || fail.Error != "nope" || !fail.RunAfter.After(time.Now()) {
+		t.Errorf("failed job mismatch. expected to be queued for a retry after 1 attempt, got: %s after %d, error: %s", fail.Status, fail.Attempts, fail.Error)
+	}
+
+	queued := do("POST", "/v1/jobs", `{"type":"test.echo"}`, http.StatusOK)
+	if canceled := do("POST", "/v1/jobs/"+queued.Id+"/cancel", "", http.StatusOK); canceled.Status != jobCanceled {
+		t.Errorf("canceled job status mismatch. expected: %s, got: %s", jobCanceled, canceled.Status)
+	}
+	work()
+	if queued = do("GET", "/v1/jobs/"+queued.Id, "", http.StatusOK); queued.Status != jobCanceled {
+		t.Errorf("canceled jobs shouldn't run. expected: %s, got: %s", jobCanceled, queued.Status)
+	}
+
+	// a worker that has lost its claim on a job can't finish it
+	lost := do("POST", "/v1/jobs", `{"type":"test.lost"}`, http.StatusOK)
+	work()
+	if lost = do("GET", "/v1/jobs/"+lost.Id, "", http.StatusOK); lost.Status != jobRunning {
+		t.Errorf("lost job status mismatch. expected to still be running for the other worker, got: %s", lost.Status)
+	}
+
+	// jobs whose lease runs out aren't run again once they've used up their
+	// attempts or were asked to stop
+	stopped := do("POST", "/v1/jobs", `{"type":"test.echo"}`, http.StatusOK)
+	if _, err := appDB.Exec("UPDATE jobs SET status = 'running', attempts = 1, cancel_requested = $2 WHERE id = $1", stopped.Id, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec("UPDATE jobs SET lease_until = (now() at time zone 'utc') - interval '1 minute' WHERE id IN ($1, $2)", lost.Id, stopped.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	work()
+	if lost = do("GET", "/v1/jobs/"+lost.Id, "", http.StatusOK); lost.Status != jobFailed || lost.Attempts != 1 || lost.Error != errJobLost.Error() {
+		t.Errorf("expired job mismatch. expected: %s after 1 attempt, got: %s after %d, error: %s", jobFailed, lost.Status, lost.Attempts, lost.Error)
+	}
+	if stopped = do("GET", "/v1/jobs/"+stopped.Id, "", http.StatusOK); stopped.Status != jobCanceled || stopped.Attempts != 1 {
+		t.Errorf("expired canceled job mismatch. expected: %s after 1 attempt, got: %s after %d", jobCanceled, stopped.Status, stopped.Attempts)
+	}
+
+	do("POST", "/v1/jobs", `{"type":"nope"}`, http.StatusUnprocessableEntity)
+	do("POST", "/v1/jobs", `{"type":"urls.schedule"}`, http.StatusForbidden)
+}
+
+func TestWithFields(t *testing.T) {
+	source := func(w http.ResponseWriter, r *http.Request) {
+		title := ""
+		if requestExpansions(r).Has("primer") {
+			title = "primer"
+		}
+		w.Write([]byte(`{"meta":{"code":200},"data":{"id":"a","url":"b","primer":{"id":"c","title":"` + title + `"}}}`))
+	}
+
+	cases := []struct {
+		query string
+		code  int
+		data  string
+	}{
+		{"", http.StatusOK, `{"id":"a","url":"b","primer":{"id":"c","title":""}}`},
+		{"?fields=id,url", http.StatusOK, `{"id":"a","url":"b"}`},
+		{"?fields=id,primer.title&expand=primer.parent", http.StatusOK, `{"id":"a","primer":{"title":"primer"}}`},
+		{"?fields=nope", http.StatusBadRequest, ""},
+		{"?fields=primer.nope", http.StatusBadRequest, ""},
+		{"?expand=subPrimers", http.StatusBadRequest, ""},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest("GET", "/v1/sources/a"+c.query, nil)
+		w := httptest.NewRecorder()
+		withFields(testRoute(t, "GET", "/sources/{id:uuid}"), source)(w, req)
+		if w.Code != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d. body: %s", i, c.code, w.Code, w.Body.String())
+			continue
+		}
+		if c.data == "" {
+			continue
+		}
+
+		env := struct {
+			Data json.RawMessage `json:"data"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err.Error())
+		}
+		var got, expect interface{}
+		json.Unmarshal(env.Data, &got)
+		json.Unmarshal([]byte(c.data), &expect)
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("case %d data mismatch. expected: %s, got: %s", i, c.data, string(env.Data))
+		}
+	}
+}
+
+// testRoute finds a registered route by method & path pattern
+func testRoute(t *testing.T, method, path string) *Route {
+	for _, rt := range apiRoutes {
+		if rt.Method == method && rt.Path == path {
+			return rt
+		}
+	}
+	t.Fatalf("no route for %s %s", method, path)
+	return nil
+}
+
+func TestRouting(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+
+	cases := []struct {
+		method, path string
+		code         int
+		allow        string
+		deprecated   bool
+	}{
+		{"GET", "/v1/primers", http.StatusOK, "", false},
+		{"GET", "/primers", http.StatusOK, "", true},
+		{"DELETE", "/v1/primers", http.StatusMethodNotAllowed, "GET, OPTIONS", false},
+		{"OPTIONS", "/v1/uncrawlables", http.StatusOK, "GET, OPTIONS, POST, PUT", false},
+		{"OPTIONS", "/v1/uncrawlables/55dd07ac-54cb-4f9d-b0a6-77d3d55c0d9e", http.StatusOK, "DELETE, GET, OPTIONS, PATCH, PUT", false},
+		// ids that aren't uuids don't match a route
+		{"GET", "/v1/uncrawlables/abc", http.StatusNotFound, "", false},
+		{"PUT", "/v1/sources/abc", http.StatusNotFound, "", false},
+		{"OPTIONS", "/v1/primers/batch", http.StatusOK, "OPTIONS, POST, PUT", false},
+		{"GET", "/v1/nope", http.StatusNotFound, "", false},
+		{"GET", "/v1/urls?status=200&created>=2017-01-01&sort=-updated,title", http.StatusOK, "", false},
+		{"GET", "/v1/sources?primer=4b0d3d9e-8d51-4b2e-9a8e-2a4f27c2b6a1", http.StatusOK, "", false},
+		{"GET", "/v1/urls?nope=1", http.StatusBadRequest, "", false},
+		{"GET", "/v1/urls?sort=nope", http.StatusBadRequest, "", false},
+		{"GET", "/v1/primers?fields=id,title,sources.url&expand=sources,subPrimers,parent", http.StatusOK, "", false},
+		{"GET", "/v1/sources/326fcfa0-d3e6-4b2d-8f95-e77220e16109?expand=primer.parent,stats", http.StatusOK, "", false},
+		{"GET", "/v1/sources?expand=nope", http.StatusBadRequest, "", false},
+		{"GET", "/v1/uncrawlables?format=csv", http.StatusOK, "", false},
+		{"GET", "/v1/urls?format=xml", http.StatusBadRequest, "", false},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest(c.method, s.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != c.code {
+			t.Errorf("case %d status code mismatch. expected: %d, got: %d", i, c.code, res.StatusCode)
+		}
+		if got := res.Header.Get("Allow"); got != c.allow {
+			t.Errorf("case %d Allow header mismatch. expected: '%s', got: '%s'", i, c.allow, got)
+		}
+		if got := res.Header.Get("Deprecation") == "true"; got != c.deprecated {
+			t.Errorf("case %d deprecation mismatch. expected: %t, got: %t", i, c.deprecated, got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+	defer resetTestData(appDB, "primers", "sources")
+	if _, err := appDB.Exec("DELETE FROM stats_history"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// put the census source under Sub-EPA so its urls roll up into EPA
+	if _, err := appDB.Exec("UPDATE sources SET primer_id = 'd99891f3-cfd9-4410-aaa4-6e90d792a20a' WHERE id = '440d9779-406c-4015-8f2d-404b04ead3a2'"); err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := refreshStats(context.Background(), func(float64, string) error { return nil })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.SourcesUpdated == 0 || res.PrimersUpdated == 0 {
+		t.Errorf("expected stats to be updated, got: %d sources & %d primers", res.SourcesUpdated, res.PrimersUpdated)
+	}
+
+	get := func(path string, v interface{}) {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s status code mismatch. expected: %d, got: %d", path, http.StatusOK, res.StatusCode)
+		}
+		env := &struct {
+			Data interface{}
+		}{Data: v}
+		if err := json.NewDecoder(res.Body).Decode(env); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	census := &core.SourceStats{}
+	get("/v1/sources/440d9779-406c-4015-8f2d-404b04ead3a2/stats", census)
+	if census.UrlCount != 2 || census.ArchivedUrlCount != 2 {
+		t.Errorf("census stats mismatch. expected 2 urls & 2 archived, got: %d & %d", census.UrlCount, census.ArchivedUrlCount)
+	}
+
+	sub := &core.PrimerStats{}
+	get("/v1/primers/d99891f3-cfd9-4410-aaa4-6e90d792a20a/stats", sub)
+	if sub.UrlCount != 2 || sub.SourcesUrlCount != 2 {
+		t.Errorf("sub-epa stats mismatch. expected 2 urls & 2 source urls, got: %d & %d", sub.UrlCount, sub.SourcesUrlCount)
+	}
+
+	epa := &core.PrimerStats{}
+	get("/v1/primers/5b1031f4-38a8-40b3-be91-c324bf686a87/stats", epa)
+	if epa.UrlCount != 3 || epa.SourcesUrlCount != 1 {
+		t.Errorf("epa stats mismatch. expected 3 urls & 1 source url, got: %d & %d", epa.UrlCount, epa.SourcesUrlCount)
+	}
+
+	history := []*StatsSnapshot{}
+	get("/v1/primers/5b1031f4-38a8-40b3-be91-c324bf686a87/stats/history", &history)
+	if len(history) != 1 || history[0].Day != res.Day || history[0].UrlCount != 3 {
+		t.Errorf("epa history mismatch. expected one snapshot on %s with 3 urls, got: %#v", res.Day, history)
+	}
+
+	csvRes, err := http.Get(s.URL + "/v1/primers/5b1031f4-38a8-40b3-be91-c324bf686a87/stats/history?format=csv&bucket=month")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(csvRes.Body)
+	csvRes.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "day,urlCount,archivedUrlCount,contentUrlCount,contentMetadataCount,uncrawlableCount" || !strings.HasPrefix(lines[1], res.Day[:8]+"01,3,") {
+		t.Errorf("csv history mismatch, got:\n%s", data)
+	}
+
+	// nothing changed, so a second refresh writes nothing
+	if res, err = refreshStats(context.Background(), func(float64, string) error { return nil }); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.SourcesUpdated != 0 || res.PrimersUpdated != 0 {
+		t.Errorf("expected an unchanged refresh to write nothing, got: %d sources & %d primers", res.SourcesUpdated, res.PrimersUpdated)
+	}
+}
+
+func TestPrimerTree(t *testing.T) {
+	s := httptest.NewServer(NewServerRoutes())
+	defer s.Close()
+
+	get := func(path string, v interface{}) int {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode
+		}
+		env := &struct {
+			Data interface{}
+		}{Data: v}
+		if err := json.NewDecoder(res.Body).Decode(env); err != nil {
+			t.Fatal(err.Error())
+		}
+		return res.StatusCode
+	}
+
+	roots := []*PrimerNode{}
+	get("/v1/primers/tree", &roots)
+	if len(roots) != 5 {
+		t.Fatalf("expected 5 top level primers, got: %d", len(roots))
+	}
+	for _, n := range roots {
+		if n.Id == "d99891f3-cfd9-4410-aaa4-6e90d792a20a" {
+			t.Errorf("expected Sub-EPA to be nested under EPA")
+		}
+		if n.Id == "5b1031f4-38a8-40b3-be91-c324bf686a87" && (len(n.Children) != 1 || n.Children[0].Depth != 1) {
+			t.Errorf("expected EPA to have Sub-EPA as a child at depth 1, got: %#v", n.Children)
+		}
+	}
+
+	ancestors := []*PrimerNode{}
+	get("/v1/primers/d99891f3-cfd9-4410-aaa4-6e90d792a20a/ancestors", &ancestors)
+	if len(ancestors) != 1 || ancestors[0].Id != "5b1031f4-38a8-40b3-be91-c324bf686a87" {
+		t.Errorf("expected EPA to be Sub-EPA's only ancestor, got: %#v", ancestors)
+	}
+
+	sub := &PrimerNode{}
+	get("/v1/primers/5b1031f4-38a8-40b3-be91-c324bf686a87/subtree?depth=0", sub)
+	if sub.Id != "5b1031f4-38a8-40b3-be91-c324bf686a87" || len(sub.Children) != 0 {
+		t.Errorf("expected a depth 0 subtree to be EPA alone, got: %#v", sub)
+	}
+	if code := get("/v1/primers/00000000-0000-0000-0000-000000000000/subtree", sub); code != http.StatusNotFound {
+		t.Errorf("missing primer status code mismatch. expected: %d, got: %d", http.StatusNotFound, code)
+	}
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tx.Rollback()
+	epa := &core.Primer{Id: "5b1031f4-38a8-40b3-be91-c324bf686a87", Title: "EPA", Parent: &core.Primer{Id: "d99891f3-cfd9-4410-aaa4-6e90d792a20a"}}
+	if _, ok := validatePrimer(tx, epa).(*apiutil.ValidationError); !ok {
+		t.Errorf("expected moving EPA under Sub-EPA to fail validation")
+	}
+	census := &core.Primer{Id: "d9deff9d-15e8-43f1-9d00-51160c0bffbe", Title: "US Census", Parent: &core.Primer{Id: "d99891f3-cfd9-4410-aaa4-6e90d792a20a"}}
+	if err := validatePrimer(tx, census); err != nil {
+		t.Errorf("expected moving Census under Sub-EPA to pass validation, got: %s", err)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	// without the cap the waits would add up to 5+10+20+40+80ms
+	calls := 0
+	start := time.Now()
+	err := retryWithBackoff(context.Background(), "test", 5*time.Millisecond, 10*time.Millisecond, func() error {
+		if calls++; calls <= 5 {
+			return fmt.Errorf("not yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if calls != 6 {
+		t.Errorf("expected 6 calls, got: %d", calls)
+	}
+	if took := time.Since(start); took > 120*time.Millisecond {
+		t.Errorf("expected waits to be capped at 10ms, retrying took: %s", took)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	err = retryWithBackoff(ctx, "test", time.Millisecond, time.Hour, func() error {
+		calls++
+		return fmt.Errorf("never")
+	})
+	if err == nil {
+		t.Errorf("expected an error once ctx is done")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected retrying to stop when ctx is done, took: %s", took)
+	}
+	if calls == 0 {
+		t.Errorf("expected fn to be called before ctx was done")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer func(b *backgroundGroup, ready bool) {
+		background = b
+		setDBReady(ready)
+		atomic.StoreInt32(&shuttingDown, 0)
+	}(background, isDBReady())
+	// leave the test db open for other tests
+	setDBReady(false)
+
+	stopped := make(chan struct{})
+	background = newBackgroundGroup()
+	background.Go("test waits for ctx", func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	if err := shutdown(&http.Server{}, time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("expected background jobs to be stopped")
+	}
+	if !isShuttingDown() {
+		t.Errorf("expected the server to be marked as shutting down")
+	}
+
+	// a job that ignores ctx can't hold shutdown past its deadline
+	block := make(chan struct{})
+	defer close(block)
+	background = newBackgroundGroup()
+	background.Go("test ignores ctx", func(ctx context.Context) {
+		<-block
+	})
+	start := time.Now()
+	if err := shutdown(&http.Server{}, 50*time.Millisecond); err == nil {
+		t.Errorf("expected an error when background jobs don't stop in time")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected shutdown to give up at its deadline, took: %s", took)
+	}
+}
+
+func TestMiddlewareNotReady(t *testing.T) {
+	defer setDBReady(isDBReady())
+	setDBReady(false)
+
+	called := false
+	h := middleware(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/v1/primers", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code mismatch. expected: %d, got: %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+	if called {
+		t.Errorf("expected the handler not to be called before the db is ready")
+	}
+}
+
+func TestEmailNotifierSubject(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	// a bare smtp server that hands back the message it's sent
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost\r\n")
+		msg := &bytes.Buffer{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "DATA":
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					msg.WriteString(line)
+				}
+				received <- msg.String()
+				fmt.Fprintf(conn, "250 ok\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	n := &emailNotifier{addr: l.Addr().String(), from: "api@example.com", to: []string{"ops@example.com"}}
+	a := &Alert{Id: 1, Kind: "gone", Message: "404 not found"}
+	s := &core.Source{Id: "src", Title: "EPA\r\nBcc: someone@example.com", Url: "epa.gov"}
+	if err := n.Notify(a, s); err != nil {
+		t.Fatal(err.Error())
+	}
+	msg := <-received
+	headers := strings.SplitN(msg, "\r\n\r\n", 2)[0]
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("expected the source title not to add headers, got:\n%s", headers)
+	}
+	if !strings.Contains(headers, "\r\nSubject: =?utf-8?q?") {
+		t.Errorf("expected an encoded subject, got:\n%s", headers)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	defer leader.set(false)
+
+	conn, err := campaign(ctx, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !leader.isLeader() {
+		t.Fatal("expected to be the leader")
+	}
+
+	other, err := appDB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Close()
+	tryLock := func() (held bool) {
+		if err := other.QueryRowContext(ctx, qLeaderTryLock, leaderLockName).Scan(&held); err != nil {
+			t.Fatal(err.Error())
+		}
+		return
+	}
+	if tryLock() {
+		t.Fatal("expected the leader lock to be taken")
+	}
+
+	// the lock has to go with the connection, not back to the pool
+	discardConn(conn)
+	leader.set(false)
+	// postgres ends the session a moment after the connection closes
+	free := false
+	for i := 0; i < 50 && !free; i++ {
+		if free = tryLock(); !free {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if !free {
+		t.Fatal("expected the leader lock to be free once the connection is discarded")
+	}
+	if _, err := other.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1));", leaderLockName); err != nil {
+		t.Fatal(err.Error())
+	}
+}
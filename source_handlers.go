@@ -3,36 +3,22 @@ package main
 import (
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
 	"net/http"
+	"time"
 )
 
-func SourceHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetSourceHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func SourcesHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		ListSourcesHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func GetSourceHandler(w http.ResponseWriter, r *http.Request) {
 	res := &core.Source{}
 	args := &SourcesGetParams{
-		Id: r.URL.Path[len("/sources/"):],
+		Id:     apiutil.PathParam(r, "id"),
+		Expand: requestExpansions(r),
 	}
 	err := new(Sources).Get(args, res)
-	if err != nil {
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -40,17 +26,83 @@ func GetSourceHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, sourcesResource) {
+		return
+	}
 	p := apiutil.PageFromRequest(r)
+	q, err := sourcesResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
 	res := make([]*core.Source, p.Size)
 	args := &SourcesListParams{
-		Limit:   p.Limit(),
-		Offset:  p.Offset(),
-		OrderBy: "created",
+		Query:  q,
+		Limit:  p.Limit(),
+		Offset: p.Offset(),
+		Expand: requestExpansions(r),
 	}
-	err := new(Sources).List(args, &res)
+	err = new(Sources).List(args, &res)
 	if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
 	apiutil.WritePageResponse(w, res, r, p)
 }
+
+func SaveSourceHandler(w http.ResponseWriter, r *http.Request) {
+	m := &core.Source{}
+	if !decodeBody(w, r, m) {
+		return
+	}
+	m.Id = apiutil.PathParam(r, "id")
+	if !conditionalWrite(w, r, "sources", m.Id, currentSource(m.Id), func(ts txStore) (sql_datastore.Model, error) {
+		if err := validateSource(ts.tx, m); err != nil {
+			return nil, err
+		}
+		return m, saveSource(ts, m)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, m)
+}
+
+func PatchSourceHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	m := &core.Source{}
+	if !patchResource(w, r, "sources", id, currentSource(id), m, func(ts txStore, current interface{}) error {
+		m.Id = id
+		if err := validateSource(ts.tx, m); err != nil {
+			return err
+		}
+		return saveSource(ts, m)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, m)
+}
+
+func DeleteSourceHandler(w http.ResponseWriter, r *http.Request) {
+	writeSoftDelete(w, r, sourcesResource, currentSource(apiutil.PathParam(r, "id")))
+}
+
+func RestoreSourceHandler(w http.ResponseWriter, r *http.Request) {
+	writeRestore(w, r, sourcesResource, currentSource(apiutil.PathParam(r, "id")))
+}
+
+func BatchGetSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchGet(w, r, sourcesResource)
+}
+
+func BatchUpsertSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchUpsert(w, r, "sources", upsertSource)
+}
+
+// currentSource reads a source for conditionalWrite, as GET responds with it
+func currentSource(id string) readCurrent {
+	return func() (interface{}, time.Time, error) {
+		res := &core.Source{}
+		err := new(Sources).Get(&SourcesGetParams{Id: id}, res)
+		return res, res.Updated, err
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	datastore "github.com/ipfs/go-datastore"
 )
 
 type Sources int
@@ -10,6 +13,8 @@ type SourcesGetParams struct {
 	Id     string
 	Source string
 	Hash   string
+	// Expand lists related resources to embed, see expandSources
+	Expand apiutil.Expansions
 }
 
 func (u Sources) Get(args *SourcesGetParams, res *core.Source) (err error) {
@@ -21,8 +26,7 @@ func (u Sources) Get(args *SourcesGetParams, res *core.Source) (err error) {
 		return err
 	}
 
-	err = s.Primer.Read(store)
-	if err != nil {
+	if err = expandSources(appDB, []*core.Source{s}, args.Expand); err != nil {
 		return err
 	}
 
@@ -31,16 +35,65 @@ func (u Sources) Get(args *SourcesGetParams, res *core.Source) (err error) {
 }
 
 type SourcesListParams struct {
-	OrderBy string
-	Limit   int
-	Offset  int
+	// Query holds filters & sort order, nil lists everything in the
+	// resource's default order
+	Query  *apiutil.ListQuery
+	Limit  int
+	Offset int
+	Expand apiutil.Expansions
 }
 
 func (u Sources) List(p *SourcesListParams, res *[]*core.Source) (err error) {
-	urls, err := core.ListSources(store, p.Limit, p.Offset)
+	list := make([]*core.Source, 0, p.Limit)
+	err = queryList(appDB, sourcesResource, p.Query, p.Limit, p.Offset, func(row sqlutil.Scannable) error {
+		m := &core.Source{}
+		if err := m.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = expandSources(appDB, list, p.Expand); err != nil {
+		return err
+	}
+	*res = list
+	return nil
+}
+
+// Save writes a source, keeping its stored stats if model has none. see
+// Primers.Save
+func (u Sources) Save(model *core.Source, res *core.Source) (err error) {
+	err = saveSource(store, model)
+	if err != nil {
+		return err
+	}
+
+	*res = *model
+	return nil
+}
+
+// saveSource saves a source to st, keeping its stored stats if it doesn't
+// have any
+func saveSource(st datastore.Datastore, model *core.Source) error {
+	if model.Stats == nil && model.Id != "" {
+		stored := &core.Source{Id: model.Id}
+		if err := stored.Read(st); err == nil {
+			model.Stats = stored.Stats
+		}
+	}
+	return model.Save(st)
+}
+
+// Delete moves a source to the trash, see softDelete
+func (u Sources) Delete(model *core.Source, res *core.Source) (err error) {
+	err = softDelete(appDB, sourcesResource, model.Id)
 	if err != nil {
 		return err
 	}
-	*res = urls
+
+	*res = *model
 	return nil
 }
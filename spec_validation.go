@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/datatogether/api/apiutil"
+)
+
+// validateSpec wraps a route's handler, checking each request & response
+// against the generated api spec. Any mismatch replaces the response with a
+// 500 listing what's wrong, so tests fail loudly when handlers & the spec
+// drift apart. only used in test mode, it buffers every response
+func validateSpec(rt *Route, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		problems := validateSpecRequest(rt, r)
+
+		rec := &responseRecorder{header: http.Header{}, code: http.StatusOK}
+		handler(rec, r)
+		problems = append(problems, validateSpecResponse(rt, rec)...)
+
+		if len(problems) > 0 {
+			err := fmt.Errorf("spec validation failed for %s %s:\n%s", r.Method, r.URL.Path, strings.Join(problems, "\n"))
+			log.Info(err)
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		rec.flush(w)
+	}
+}
+
+// validateSpecRequest checks query params & the request body. The body is
+// replaced so handlers can still read it
+func validateSpecRequest(rt *Route, r *http.Request) (problems []string) {
+	params := rt.Params()
+	query := r.URL.Query()
+	for _, p := range params {
+		val := query.Get(p.Name)
+		if val == "" {
+			if p.Required {
+				problems = append(problems, fmt.Sprintf("request: missing required query param '%s'", p.Name))
+			}
+			continue
+		}
+		if p.Type == "integer" {
+			if _, err := strconv.Atoi(val); err != nil {
+				problems = append(problems, fmt.Sprintf("request: query param '%s' must be an integer", p.Name))
+			}
+		}
+	}
+
+	if r.Body == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return append(problems, fmt.Sprintf("request: reading body: %s", err))
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return
+	}
+	if rt.Body == nil {
+		return append(problems, "request: route doesn't accept a body")
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return append(problems, fmt.Sprintf("request: body isn't valid JSON: %s", err))
+	}
+	_, schemas := getAPISpec()
+	for _, err := range schemas.Validate(schemas.SchemaFor(rt.Body), v, "") {
+		problems = append(problems, fmt.Sprintf("request body: %s", err))
+	}
+	return
+}
+
+// validateSpecResponse checks a recorded response against the route's
+// success or error response schema
+func validateSpecResponse(rt *Route, rec *responseRecorder) (problems []string) {
+	spec, schemas := getAPISpec()
+	op := spec.Paths[rt.SpecPath()][strings.ToLower(rt.Method)]
+
+	res := op.Responses[strconv.Itoa(rec.code)]
+	if res == nil {
+		res = op.Responses["default"]
+	}
+	if res == nil {
+		return []string{fmt.Sprintf("response: status %d isn't in the api spec", rec.code)}
+	}
+
+	switch strings.Split(rec.header.Get("Content-Type"), ";")[0] {
+	case apiutil.FormatCSV.ContentType():
+		return nil
+	case apiutil.FormatNDJSON.ContentType():
+		// each line is a single result
+		body := bytes.TrimSpace(rec.body.Bytes())
+		if len(body) == 0 {
+			return nil
+		}
+		for i, line := range bytes.Split(body, []byte("\n")) {
+			var v interface{}
+			if err := json.Unmarshal(line, &v); err != nil {
+				return append(problems, fmt.Sprintf("response: line %d isn't valid JSON: %s", i+1, err))
+			}
+			for _, err := range schemas.Validate(schemas.SchemaFor(rt.Response), v, fmt.Sprintf("[%d]", i)) {
+				problems = append(problems, fmt.Sprintf("response body: %s", err))
+			}
+		}
+		return
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(rec.body.Bytes(), &v); err != nil {
+		return []string{fmt.Sprintf("response: body isn't valid JSON: %s", err)}
+	}
+	for _, err := range schemas.Validate(res.Schema, v, "") {
+		problems = append(problems, fmt.Sprintf("response body: %s", err))
+	}
+	return
+}
+
+// responseRecorder buffers a response so it can be inspected before it's
+// sent
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header         { return rec.header }
+func (rec *responseRecorder) Write(p []byte) (int, error) { return rec.body.Write(p) }
+func (rec *responseRecorder) WriteHeader(code int)        { rec.code = code }
+
+// flush writes the recorded response to w
+func (rec *responseRecorder) flush(w http.ResponseWriter) {
+	for key, vals := range rec.header {
+		w.Header()[key] = vals
+	}
+	w.WriteHeader(rec.code)
+	w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS
+  archive_requests,
+  uncrawlables,
+  collection_contents,
+  collections,
+  snapshots,
+  metadata,
+  links,
+  urls,
+  sources,
+  primers;
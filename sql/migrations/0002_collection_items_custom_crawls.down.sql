@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS custom_crawls, collection_items;
+
+ALTER TABLE collections
+  DROP COLUMN IF EXISTS description,
+  DROP COLUMN IF EXISTS url;
@@ -0,0 +1,27 @@
+-- bring collections in line with the columns github.com/datatogether/core
+-- reads & writes. environments created from sql/schema.sql never got these
+ALTER TABLE collections
+  ADD COLUMN IF NOT EXISTS description text NOT NULL default '',
+  ADD COLUMN IF NOT EXISTS url         text NOT NULL default '';
+
+-- core stores collection membership in collection_items, not collection_contents
+CREATE TABLE IF NOT EXISTS collection_items (
+  collection_id    UUID NOT NULL,
+  url_id           text NOT NULL default '',
+  index            integer NOT NULL default -1,
+  description      text NOT NULL default '',
+  PRIMARY KEY      (collection_id, url_id)
+);
+
+-- custom_crawls was only ever created by hand
+CREATE TABLE IF NOT EXISTS custom_crawls (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  jwt              text NOT NULL default '',
+  morphRunId       text NOT NULL default '',
+  dateCompleted    timestamp NOT NULL default (now() at time zone 'utc'),
+  githubRepo       text NOT NULL default '',
+  originalUrl      text NOT NULL default '',
+  sqliteChecksum   text NOT NULL default ''
+);
@@ -0,0 +1,14 @@
+-- responses to POSTs sent with an Idempotency-Key header, replayed when a
+-- client retries with the same key. see withIdempotency
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key              text PRIMARY KEY NOT NULL,
+  -- hash of the method, path, query & body of the first request
+  fingerprint      text NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  -- 0 while the first request is still being handled
+  status           integer NOT NULL default 0,
+  header           jsonb,
+  body             bytea
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created ON idempotency_keys (created);
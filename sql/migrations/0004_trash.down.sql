@@ -0,0 +1,3 @@
+ALTER TABLE primers DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE sources DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE uncrawlables DROP COLUMN IF EXISTS deleted_at;
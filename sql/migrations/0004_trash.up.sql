@@ -0,0 +1,10 @@
+-- when primers, sources & uncrawlables were moved to the trash, so they can
+-- be purged once they've been there longer than the retention period
+ALTER TABLE primers ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+ALTER TABLE sources ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+ALTER TABLE uncrawlables ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+
+-- rows deleted before this migration count from their last update
+UPDATE primers SET deleted_at = updated WHERE deleted = true AND deleted_at IS NULL;
+UPDATE sources SET deleted_at = updated WHERE deleted = true AND deleted_at IS NULL;
+UPDATE uncrawlables SET deleted_at = updated WHERE deleted = true AND deleted_at IS NULL;
@@ -0,0 +1,20 @@
+-- every create, update & delete made through the api, written in the same
+-- transaction as the change. see recordAudit
+CREATE TABLE IF NOT EXISTS audit_events (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  -- identity service id of the user, empty for anonymous requests
+  actor_id         text NOT NULL default '',
+  -- username of the user, or the ip of anonymous requests
+  actor_name       text NOT NULL default '',
+  ip               text NOT NULL default '',
+  resource_type    text NOT NULL,
+  resource_id      text NOT NULL,
+  action           text NOT NULL,
+  -- changed fields, {"field": {"before": ..., "after": ...}}
+  diff             jsonb
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_created ON audit_events (created);
+CREATE INDEX IF NOT EXISTS audit_events_resource ON audit_events (resource_type, resource_id);
+CREATE INDEX IF NOT EXISTS audit_events_actor ON audit_events (actor_id);
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS log_change ON primers;
+DROP TRIGGER IF EXISTS log_change ON sources;
+DROP TRIGGER IF EXISTS log_change ON urls;
+DROP TRIGGER IF EXISTS log_change ON collections;
+DROP TRIGGER IF EXISTS log_change ON uncrawlables;
+DROP TRIGGER IF EXISTS log_change ON custom_crawls;
+DROP FUNCTION IF EXISTS log_change();
+DROP TABLE IF EXISTS change_events;
@@ -0,0 +1,60 @@
+-- a log of inserts, updates & deletes to the core tables, written by
+-- triggers so changes made outside the api are included. the api streams
+-- new events over /events & replays them for clients resuming with
+-- Last-Event-ID, see changes.go. pruned to cfg.EventLogSize events
+CREATE TABLE IF NOT EXISTS change_events (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  resource_type    text NOT NULL,
+  resource_id      text NOT NULL,
+  action           text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS change_events_resource ON change_events (resource_type, resource_id);
+
+-- log_change records a change to a row & wakes up listeners. the resource
+-- type is the trigger's argument. notifications only carry the event id,
+-- listeners read events from change_events
+CREATE OR REPLACE FUNCTION log_change() RETURNS trigger AS $$
+DECLARE
+  row_id   text;
+  event_id bigint;
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    row_id := OLD.id::text;
+  ELSE
+    row_id := NEW.id::text;
+  END IF;
+
+  INSERT INTO change_events (resource_type, resource_id, action)
+  VALUES (TG_ARGV[0], row_id, lower(TG_OP))
+  RETURNING id INTO event_id;
+
+  PERFORM pg_notify('change_events', event_id::text);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS log_change ON primers;
+CREATE TRIGGER log_change AFTER INSERT OR UPDATE OR DELETE ON primers
+  FOR EACH ROW EXECUTE PROCEDURE log_change('primers');
+
+DROP TRIGGER IF EXISTS log_change ON sources;
+CREATE TRIGGER log_change AFTER INSERT OR UPDATE OR DELETE ON sources
+  FOR EACH ROW EXECUTE PROCEDURE log_change('sources');
+
+DROP TRIGGER IF EXISTS log_change ON urls;
+CREATE TRIGGER log_change AFTER INSERT OR UPDATE OR DELETE ON urls
+  FOR EACH ROW EXECUTE PROCEDURE log_change('urls');
+
+DROP TRIGGER IF EXISTS log_change ON collections;
+CREATE TRIGGER log_change AFTER INSERT OR UPDATE OR DELETE ON collections
+  FOR EACH ROW EXECUTE PROCEDURE log_change('collections');
+
+DROP TRIGGER IF EXISTS log_change ON uncrawlables;
+CREATE TRIGGER log_change AFTER INSERT OR UPDATE OR DELETE ON uncrawlables
+  FOR EACH ROW EXECUTE PROCEDURE log_change('uncrawlables');
+
+DROP TRIGGER IF EXISTS log_change ON custom_crawls;
+CREATE TRIGGER log_change AFTER INSERT OR UPDATE OR DELETE ON custom_crawls
+  FOR EACH ROW EXECUTE PROCEDURE log_change('customcrawls');
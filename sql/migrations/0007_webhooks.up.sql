@@ -0,0 +1,35 @@
+-- webhook subscriptions registered by admins for partner projects, see
+-- webhooks.go
+CREATE TABLE IF NOT EXISTS webhooks (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  url              text NOT NULL,
+  -- event types to deliver, eg: uncrawlable.created
+  events           text[] NOT NULL default '{}',
+  -- if set, only uncrawlable events for this agency are delivered
+  agency_id        text NOT NULL default '',
+  -- key deliveries are signed with
+  secret           text NOT NULL
+);
+
+-- the delivery queue & log. deliveries are queued in the same transaction
+-- as the change they describe, & retried with backoff until they succeed
+-- or run out of attempts
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  webhook_id       UUID NOT NULL references webhooks(id) ON DELETE CASCADE,
+  event            text NOT NULL,
+  payload          jsonb NOT NULL,
+  -- one of pending, delivered or failed
+  status           text NOT NULL default 'pending',
+  attempts         integer NOT NULL default 0,
+  next_attempt     timestamp NOT NULL default (now() at time zone 'utc'),
+  last_attempt     timestamp,
+  response_code    integer NOT NULL default 0,
+  error            text NOT NULL default ''
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook_id, created);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS queue_url_alert_check ON urls;
+DROP FUNCTION IF EXISTS queue_url_alert_check();
+DROP TABLE IF EXISTS url_alert_checks;
+DROP TABLE IF EXISTS alert_suppressions;
+DROP TABLE IF EXISTS alerts;
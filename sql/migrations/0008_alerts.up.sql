@@ -0,0 +1,58 @@
+-- alerts about content under a source, see alerts.go. an alert stays open
+-- until it's dismissed, & a source only has one open alert of each kind per
+-- url, so repeat detections don't pile up
+CREATE TABLE IF NOT EXISTS alerts (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  source_id        UUID NOT NULL references sources(id) ON DELETE CASCADE,
+  -- url the alert is about, empty for alerts about the whole source
+  url              text NOT NULL default '',
+  -- one of changed, gone or stale
+  kind             text NOT NULL,
+  message          text NOT NULL default '',
+  dismissed_at     timestamp,
+  dismissed_by     text NOT NULL default ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS alerts_open ON alerts (source_id, url, kind) WHERE dismissed_at IS NULL;
+CREATE INDEX IF NOT EXISTS alerts_created ON alerts (created);
+
+-- alerts matching a suppression aren't raised. empty url & kind match any
+-- url & kind, a null until suppresses forever
+CREATE TABLE IF NOT EXISTS alert_suppressions (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  source_id        UUID NOT NULL references sources(id) ON DELETE CASCADE,
+  url              text NOT NULL default '',
+  kind             text NOT NULL default '',
+  until            timestamp,
+  created_by       text NOT NULL default ''
+);
+
+CREATE INDEX IF NOT EXISTS alert_suppressions_source ON alert_suppressions (source_id);
+
+-- urls whose content changed or went missing since they were last fetched,
+-- waiting to be checked against sources for alerts
+CREATE TABLE IF NOT EXISTS url_alert_checks (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  url              text NOT NULL,
+  previous_hash    text NOT NULL default '',
+  hash             text NOT NULL default '',
+  previous_status  integer NOT NULL default 0,
+  status           integer NOT NULL default 0
+);
+
+CREATE OR REPLACE FUNCTION queue_url_alert_check() RETURNS trigger AS $$
+BEGIN
+  IF (OLD.hash <> '' AND NEW.hash <> OLD.hash) OR (NEW.status >= 400 AND OLD.status < 400) THEN
+    INSERT INTO url_alert_checks (url, previous_hash, hash, previous_status, status)
+    VALUES (NEW.url, OLD.hash, NEW.hash, OLD.status, NEW.status);
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS queue_url_alert_check ON urls;
+CREATE TRIGGER queue_url_alert_check AFTER UPDATE OF hash, status ON urls
+  FOR EACH ROW EXECUTE PROCEDURE queue_url_alert_check();
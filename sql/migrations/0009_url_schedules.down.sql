@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS count_unchanged_fetches ON urls;
+DROP FUNCTION IF EXISTS count_unchanged_fetches();
+DROP TABLE IF EXISTS url_schedules;
@@ -0,0 +1,35 @@
+-- when each url is next due to be fetched, see schedule.go. a url is
+-- scheduled by the most specific source it's under, & is due its source's
+-- stale duration after it was last fetched, backing off for urls whose
+-- content doesn't change. urls that have never been fetched are due as
+-- soon as they're created
+CREATE TABLE IF NOT EXISTS url_schedules (
+  url              text PRIMARY KEY NOT NULL references urls(url) ON DELETE CASCADE,
+  source_id        UUID NOT NULL references sources(id) ON DELETE CASCADE,
+  -- last_get of the url when it was scheduled
+  last_get         timestamp,
+  -- fetches in a row that found the same content
+  unchanged_checks integer NOT NULL default 0,
+  next_due         timestamp NOT NULL,
+  scheduled        timestamp NOT NULL default (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS url_schedules_next_due ON url_schedules (next_due);
+CREATE INDEX IF NOT EXISTS url_schedules_source_next_due ON url_schedules (source_id, next_due);
+
+CREATE OR REPLACE FUNCTION count_unchanged_fetches() RETURNS trigger AS $$
+BEGIN
+  IF NEW.last_get IS DISTINCT FROM OLD.last_get THEN
+    UPDATE url_schedules SET unchanged_checks = CASE
+      WHEN NEW.hash = OLD.hash THEN unchanged_checks + 1
+      ELSE 0
+    END
+    WHERE url = NEW.url;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS count_unchanged_fetches ON urls;
+CREATE TRIGGER count_unchanged_fetches AFTER UPDATE OF last_get ON urls
+  FOR EACH ROW EXECUTE PROCEDURE count_unchanged_fetches();
@@ -0,0 +1,28 @@
+-- background jobs for operations too slow for a request, see jobs.go.
+-- workers claim queued jobs with a lease they renew while the job runs, so
+-- jobs held by an instance that dies are picked up again once it expires
+CREATE TABLE IF NOT EXISTS jobs (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  type             text NOT NULL,
+  -- one of queued, running, succeeded, failed or canceled
+  status           text NOT NULL default 'queued',
+  params           jsonb NOT NULL default '{}',
+  result           jsonb,
+  error            text NOT NULL default '',
+  -- fraction of the job that's done, from 0 to 1
+  progress         double precision NOT NULL default 0,
+  progress_message text NOT NULL default '',
+  attempts         integer NOT NULL default 0,
+  max_attempts     integer NOT NULL default 1,
+  run_after        timestamp NOT NULL default (now() at time zone 'utc'),
+  started          timestamp,
+  finished         timestamp,
+  lease_until      timestamp,
+  cancel_requested boolean NOT NULL default false,
+  created_by       text NOT NULL default ''
+);
+
+CREATE INDEX IF NOT EXISTS jobs_claim ON jobs (type, status, run_after);
+CREATE INDEX IF NOT EXISTS jobs_created ON jobs (created);
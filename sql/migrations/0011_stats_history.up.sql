@@ -0,0 +1,14 @@
+-- daily snapshots of primer & source stats, see stats.go. each stats
+-- refresh overwrites the day's snapshot, so a day keeps its last counts
+CREATE TABLE IF NOT EXISTS stats_history (
+  day                    date NOT NULL,
+  -- primer or source
+  kind                   text NOT NULL,
+  resource_id            text NOT NULL,
+  url_count              bigint NOT NULL default 0,
+  archived_url_count     bigint NOT NULL default 0,
+  content_url_count      bigint NOT NULL default 0,
+  content_metadata_count bigint NOT NULL default 0,
+  uncrawlable_count      bigint NOT NULL default 0,
+  PRIMARY KEY (kind, resource_id, day)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS webhooks_created_by;
+ALTER TABLE webhooks DROP COLUMN IF EXISTS created_by;
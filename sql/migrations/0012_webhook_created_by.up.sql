@@ -0,0 +1,5 @@
+-- who registered each webhook. webhooks are listed & managed by whoever
+-- registered them, & by admins. webhooks from before this are admin only
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS created_by text NOT NULL default '';
+
+CREATE INDEX IF NOT EXISTS webhooks_created_by ON webhooks (created_by);
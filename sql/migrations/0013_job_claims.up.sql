@@ -0,0 +1,4 @@
+-- claim is a token set each time a worker claims a job. heartbeats & the
+-- end of a run only apply while the worker's token still matches, so a
+-- worker whose lease expired can't touch the job after another takes it
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS claim UUID;
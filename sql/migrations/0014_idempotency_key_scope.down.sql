@@ -0,0 +1,6 @@
+-- keys can repeat across scopes & are short lived, drop them all rather
+-- than pick one per key
+DELETE FROM idempotency_keys;
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key);
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS scope;
@@ -0,0 +1,5 @@
+-- scope is the route & requester a key was sent with, so clients can't
+-- see or collide with each other's keys. see idempotencyScope
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (scope, key);
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+)
+
+// StatsRefresh is the result of recomputing primer & source stats
+type StatsRefresh struct {
+	// SourcesUpdated & PrimersUpdated count the stats that changed
+	SourcesUpdated int64 `json:"sourcesUpdated"`
+	PrimersUpdated int64 `json:"primersUpdated"`
+	// Day is the day of the stats history the counts were written to
+	Day string `json:"day"`
+}
+
+// StatsSnapshot is a primer or source's stats on a day. stats history
+// buckets hold the last snapshot in the bucket
+type StatsSnapshot struct {
+	// Day is the first day of the bucket, as YYYY-MM-DD
+	Day                  string `json:"day"`
+	UrlCount             int    `json:"urlCount"`
+	ArchivedUrlCount     int    `json:"archivedUrlCount"`
+	ContentUrlCount      int    `json:"contentUrlCount"`
+	ContentMetadataCount int    `json:"contentMetadataCount"`
+	UncrawlableCount     int    `json:"uncrawlableCount"`
+}
+
+// dateLayout formats days in the stats history
+const dateLayout = "2006-01-02"
+
+// primerTotal is a primer's stats plus the count of uncrawlables under it,
+// which is only kept in the stats history
+type primerTotal struct {
+	core.PrimerStats
+	UncrawlableCount int
+}
+
+// refreshStatsJob recomputes stats for every primer & source. it's queued
+// every cfg.StatsInterval, or by hand with RefreshStatsHandler
+var refreshStatsJob = &jobType{
+	Name:        "stats.refresh",
+	Concurrency: 1,
+	MaxAttempts: 3,
+	Singleton:   true,
+	Admin:       true,
+	Run: func(ctx context.Context, run *jobRun) (interface{}, error) {
+		return refreshStats(ctx, run.Progress)
+	},
+}
+
+// queueStatsRefreshes queues a stats refresh every interval until ctx is
+// done, unless one is already waiting
+func queueStatsRefreshes(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// every instance runs jobs, but only the leader needs to queue them
+		if !isDBReady() || !leader.isLeader() {
+			continue
+		}
+		if j, err := pendingJob(appDB, refreshStatsJob); err != nil {
+			log.Infof("error checking for pending stats refresh: %s", err)
+			continue
+		} else if j != nil {
+			continue
+		}
+		if _, err := queueJob(appDB, refreshStatsJob, json.RawMessage("{}"), "api"); err != nil {
+			log.Infof("error queuing stats refresh: %s", err)
+		}
+	}
+}
+
+// refreshStats recomputes stats for every source, then totals them up the
+// primer hierarchy & writes them all to today's stats history. progress is
+// called between steps & stops the refresh if it returns an error
+func refreshStats(ctx context.Context, progress func(float64, string) error) (*StatsRefresh, error) {
+	res := &StatsRefresh{Day: time.Now().UTC().Format(dateLayout)}
+	if err := progress(0, "counting source urls"); err != nil {
+		return nil, err
+	}
+	r, err := appDB.ExecContext(ctx, qSourcesStatsRefresh)
+	if err != nil {
+		return nil, err
+	}
+	if res.SourcesUpdated, err = r.RowsAffected(); err != nil {
+		return nil, err
+	}
+	if _, err := appDB.ExecContext(ctx, qSourcesStatsSnapshot, res.Day); err != nil {
+		return nil, err
+	}
+
+	if err := progress(0.5, "totaling primers"); err != nil {
+		return nil, err
+	}
+	stats, err := primerStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for id, t := range stats {
+		data, err := json.Marshal(t.PrimerStats)
+		if err != nil {
+			return nil, err
+		}
+		r, err := appDB.ExecContext(ctx, qPrimerStatsUpdate, id, string(data))
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		res.PrimersUpdated += n
+
+		if _, err := appDB.ExecContext(ctx, qPrimerStatsSnapshot, res.Day, id, t.UrlCount, t.ArchivedUrlCount,
+			t.ContentUrlCount, t.ContentMetadataCount, t.UncrawlableCount); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, progress(1, fmt.Sprintf("updated %d sources & %d primers", res.SourcesUpdated, res.PrimersUpdated))
+}
+
+// primerStats computes stats for every primer from the stored stats of its
+// sources. Url, ArchivedUrl, ContentUrl, ContentMetadata & Uncrawlable
+// counts include sub-primers, while the Sources counts are only the
+// primer's own sources
+func primerStats(ctx context.Context) (map[string]*primerTotal, error) {
+	rows, err := appDB.QueryContext(ctx, qPrimersSourceStats)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	own := map[string]*primerTotal{}
+	children := map[string][]string{}
+	for rows.Next() {
+		var (
+			id, parentId string
+			s            = &primerTotal{}
+		)
+		if err := rows.Scan(&id, &parentId, &s.SourcesUrlCount, &s.SourcesArchivedUrlCount, &s.ContentUrlCount, &s.ContentMetadataCount, &s.UncrawlableCount); err != nil {
+			return nil, err
+		}
+		own[id] = s
+		if parentId != "" {
+			children[parentId] = append(children[parentId], id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	totals := map[string]*primerTotal{}
+	// visiting holds primers on the path being totaled, so a primer that's
+	// its own ancestor doesn't recurse forever. the loop back is skipped
+	visiting := map[string]bool{}
+	var total func(id string) *primerTotal
+	total = func(id string) *primerTotal {
+		if t := totals[id]; t != nil {
+			return t
+		}
+		if visiting[id] {
+			return &primerTotal{}
+		}
+		visiting[id] = true
+		defer delete(visiting, id)
+
+		o := own[id]
+		t := &primerTotal{
+			PrimerStats: core.PrimerStats{
+				UrlCount:                o.SourcesUrlCount,
+				ArchivedUrlCount:        o.SourcesArchivedUrlCount,
+				ContentUrlCount:         o.ContentUrlCount,
+				ContentMetadataCount:    o.ContentMetadataCount,
+				SourcesUrlCount:         o.SourcesUrlCount,
+				SourcesArchivedUrlCount: o.SourcesArchivedUrlCount,
+			},
+			UncrawlableCount: o.UncrawlableCount,
+		}
+		for _, c := range children[id] {
+			if _, ok := own[c]; !ok {
+				continue
+			}
+			ct := total(c)
+			t.UrlCount += ct.UrlCount
+			t.ArchivedUrlCount += ct.ArchivedUrlCount
+			t.ContentUrlCount += ct.ContentUrlCount
+			t.ContentMetadataCount += ct.ContentMetadataCount
+			t.UncrawlableCount += ct.UncrawlableCount
+		}
+		totals[id] = t
+		return t
+	}
+	for id := range own {
+		total(id)
+	}
+	return totals, nil
+}
+
+// GetPrimerStatsHandler responds with a primer's stored stats, as of the
+// last refresh
+func GetPrimerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	p := &core.Primer{Id: apiutil.PathParam(r, "id")}
+	if err := p.Read(store); isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if p.Stats == nil {
+		p.Stats = &core.PrimerStats{}
+	}
+	apiutil.WriteResponse(w, p.Stats)
+}
+
+// GetSourceStatsHandler responds with a source's stored stats, as of the
+// last refresh
+func GetSourceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	s := &core.Source{Id: apiutil.PathParam(r, "id")}
+	if err := s.Read(store); isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if s.Stats == nil {
+		s.Stats = &core.SourceStats{}
+	}
+	apiutil.WriteResponse(w, s.Stats)
+}
+
+// GetPrimerStatsHistoryHandler responds with a primer's stats history
+func GetPrimerStatsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	p := &core.Primer{Id: apiutil.PathParam(r, "id")}
+	if err := p.Read(store); isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeStatsHistory(w, r, "primer", p.Id)
+}
+
+// GetSourceStatsHistoryHandler responds with a source's stats history
+func GetSourceStatsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	s := &core.Source{Id: apiutil.PathParam(r, "id")}
+	if err := s.Read(store); isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeStatsHistory(w, r, "source", s.Id)
+}
+
+// writeStatsHistory responds with the stats history of the primer or source
+// with id, between the from & to days & grouped into buckets. days default
+// to the year up to today
+func writeStatsHistory(w http.ResponseWriter, r *http.Request, kind, id string) {
+	query := r.URL.Query()
+	to := time.Now().UTC()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("invalid to: '%s'. expected a date like 2017-01-31", v))
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(-1, 0, 0)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("invalid from: '%s'. expected a date like 2017-01-31", v))
+			return
+		}
+		from = t
+	}
+	if from.After(to) {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("from must be on or before to"))
+		return
+	}
+	bucket := query.Get("bucket")
+	switch bucket {
+	case "":
+		bucket = "day"
+	case "day", "week", "month":
+	default:
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("invalid bucket: '%s'. expected one of: day, week, month", bucket))
+		return
+	}
+
+	rows, err := appDB.Query(qStatsHistory, kind, id, from.Format(dateLayout), to.Format(dateLayout), bucket)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	history := []interface{}{}
+	for rows.Next() {
+		var (
+			s   = &StatsSnapshot{}
+			day time.Time
+		)
+		if err := rows.Scan(&day, &s.UrlCount, &s.ArchivedUrlCount, &s.ContentUrlCount, &s.ContentMetadataCount, &s.UncrawlableCount); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.Day = day.Format(dateLayout)
+		history = append(history, s)
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if writeListExport(w, r, kind+"-stats-history", StatsSnapshot{}, history) {
+		return
+	}
+	apiutil.WriteResponse(w, history)
+}
+
+// RefreshStatsHandler queues a stats refresh, responding with the job. if
+// one is already waiting to run that job is returned instead
+func RefreshStatsHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := pendingJob(appDB, refreshStatsJob)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if j != nil {
+		apiutil.WriteResponse(w, j)
+		return
+	}
+	writeQueuedJob(w, r, refreshStatsJob, json.RawMessage("{}"))
+}
@@ -14,11 +14,12 @@ import (
 // if config.TLS == true it'll spin up an https server using LetsEncrypt
 // that should work just fine on the raw internet (ie not behind a proxy like nginx etc)
 // it'll also redirect http traffic to it's https route counterpart if port 80 is open
+// StartServer returns nil once the server has been shut down with s.Shutdown
 func StartServer(c *config, s *http.Server) error {
-	s.Addr = fmt.Sprintf(fmt.Sprintf(":%s", c.Port))
+	s.Addr = fmt.Sprintf(":%s", c.Port)
 
 	if !c.TLS {
-		return s.ListenAndServe()
+		return ignoreServerClosed(s.ListenAndServe())
 	}
 
 	log.Infoln("using https server for url root:", c.UrlRoot)
@@ -47,7 +48,15 @@ func StartServer(c *config, s *http.Server) error {
 		},
 	}
 
-	return s.ListenAndServeTLS(cert, key)
+	return ignoreServerClosed(s.ListenAndServeTLS(cert, key))
+}
+
+// http.ErrServerClosed is the expected result of a graceful shutdown
+func ignoreServerClosed(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
 // Redirect HTTP to https if port 80 is open
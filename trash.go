@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+)
+
+// trashResources are the resources DELETE moves to the trash instead of
+// removing, see softDelete
+var trashResources = []*resource{primersResource, sourcesResource, uncrawlablesResource}
+
+// restoreChecks find trashed resources that can't be restored until
+// something they belong to is restored, by resource name
+var restoreChecks = map[string]struct {
+	query string
+	err   error
+}{
+	"primers": {qTrashPrimerParentDeleted, fmt.Errorf("this primer's parent is in the trash, restore it first")},
+	"sources": {qTrashSourcePrimerDeleted, fmt.Errorf("this source's primer is in the trash, restore it first")},
+}
+
+var (
+	errTrashType = fmt.Errorf("type must be one of: %s", strings.Join(trashTypes(), ", "))
+	errInTrash   = fmt.Errorf("this resource is in the trash, restore it first")
+)
+
+// TrashItem is a deleted resource waiting to be restored or purged
+type TrashItem struct {
+	Type      string      `json:"type"`
+	DeletedAt *time.Time  `json:"deletedAt"`
+	Data      interface{} `json:"data"`
+}
+
+// TrashPurge counts the resources of a type purged from the trash
+type TrashPurge struct {
+	Type   string `json:"type"`
+	Purged int64  `json:"purged"`
+}
+
+func trashTypes() []string {
+	names := make([]string, len(trashResources))
+	for i, res := range trashResources {
+		names[i] = res.Name
+	}
+	return names
+}
+
+// trashResource finds a trash resource by name, nil if there isn't one
+func trashResource(name string) *resource {
+	for _, res := range trashResources {
+		if res.Name == name {
+			return res
+		}
+	}
+	return nil
+}
+
+// softDelete moves the resource with id to the trash, returning
+// core.ErrNotFound if it doesn't exist or is already in the trash
+func softDelete(db sqlutil.Execable, res *resource, id string) error {
+	result, err := db.Exec(fmt.Sprintf(qTrashDelete, res.Table), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return core.ErrNotFound
+	}
+	return nil
+}
+
+// inTrash checks if the resource with id is in the trash
+func inTrash(db sqlutil.Queryable, res *resource, id string) (trashed bool, err error) {
+	err = db.QueryRow(fmt.Sprintf(qTrashHas, res.Table), id).Scan(&trashed)
+	return
+}
+
+// checkTrash finds whether the resource of kind with id is in the trash,
+// always false for kinds without one. writes to a trashed resource would
+// update a row reads can't see, so they're refused until it's restored
+func checkTrash(db sqlutil.Queryable, kind, id string) (bool, error) {
+	res := trashResource(kind)
+	if res == nil || id == "" {
+		return false, nil
+	}
+	return inTrash(db, res, id)
+}
+
+// writeSoftDelete moves a resource to the trash under the same If-Match rules
+// as updates, responding with the resource as it was before it was deleted
+func writeSoftDelete(w http.ResponseWriter, r *http.Request, res *resource, read readCurrent) {
+	id := apiutil.PathParam(r, "id")
+	var current interface{}
+	keep := func() (interface{}, time.Time, error) {
+		data, updated, err := read()
+		current = data
+		return data, updated, err
+	}
+	if !conditionalWrite(w, r, res.Name, id, keep, func(ts txStore) (sql_datastore.Model, error) {
+		return nil, softDelete(ts.tx, res, id)
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, current)
+}
+
+// writeRestore takes a resource out of the trash, responding with it as GET
+// would. Resources that aren't in the trash are a 404, & resources that
+// belong to something that's still in the trash are a 409
+func writeRestore(w http.ResponseWriter, r *http.Request, res *resource, read readCurrent) {
+	id := apiutil.PathParam(r, "id")
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(qLockResource, res.Name+":"+id); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if trashed, err := inTrash(tx, res, id); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	} else if !trashed {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, core.ErrNotFound)
+		return
+	}
+	if check, ok := restoreChecks[res.Name]; ok {
+		blocked := false
+		if err := tx.QueryRow(check.query, id).Scan(&blocked); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		if blocked {
+			apiutil.WriteErrResponse(w, http.StatusConflict, check.err)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(qTrashRestore, res.Table), id); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	after, err := auditSnapshot(txStore{tx: tx}, res.Name, id)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordAudit(tx, r, auditRestore, res.Name, id, nil, after); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	data, _, err := read()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, data)
+}
+
+// ListTrashHandler lists a page of deleted resources of one type, most
+// recently deleted first
+func ListTrashHandler(w http.ResponseWriter, r *http.Request) {
+	res := trashResource(r.FormValue("type"))
+	if res == nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, errTrashType)
+		return
+	}
+	p := apiutil.PageFromRequest(r)
+	rows, err := appDB.Query(fmt.Sprintf(qTrashList, res.Columns, res.Table), p.Limit(), p.Offset())
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	items := make([]*TrashItem, 0, p.Size)
+	for rows.Next() {
+		deletedAt := pq.NullTime{}
+		m, err := res.Scan(trashRow{rows, &deletedAt})
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		item := &TrashItem{Type: res.Name, Data: m}
+		if deletedAt.Valid {
+			item.DeletedAt = &deletedAt.Time
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, items, r, p)
+}
+
+// PurgeTrashHandler permanently deletes resources that have been in the trash
+// for longer than cfg.TrashRetention, recording an audit event for each.
+// admin only
+func PurgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	retention := cfg.trashRetention().Seconds()
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// sources go first so primers they belonged to can be purged
+	purges := []struct {
+		name, query string
+	}{
+		{"sources", qTrashPurgeSources},
+		{"uncrawlables", qTrashPurgeUncrawlables},
+		{"primers", qTrashPurgePrimers},
+	}
+
+	results := make([]*TrashPurge, len(purges))
+	for i, p := range purges {
+		ids, err := purgeIds(tx, p.query, retention)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, id := range ids {
+			if err := recordAudit(tx, r, auditPurge, p.name, id, nil, nil); err != nil {
+				apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		results[i] = &TrashPurge{Type: p.name, Purged: int64(len(ids))}
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, res := range results {
+		log.Infof("purged %d %s from the trash", res.Purged, res.Type)
+	}
+	apiutil.WriteResponse(w, results)
+}
+
+// purgeIds runs a purge query, returning the ids it deleted
+func purgeIds(db sqlutil.Queryable, query string, retention float64) ([]string, error) {
+	rows, err := db.Query(query, retention)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// trashRow reads a trash list row, scanning the trailing deleted_at column
+// into deletedAt so resources can scan the rest as usual
+type trashRow struct {
+	row       sqlutil.Scannable
+	deletedAt *pq.NullTime
+}
+
+func (t trashRow) Scan(dest ...interface{}) error {
+	return t.row.Scan(append(dest, t.deletedAt)...)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// datastoreModels are the models the api reads & writes through a datastore
+var datastoreModels = []sql_datastore.Model{
+	&core.Collection{},
+	&core.Link{},
+	&core.Primer{},
+	&core.Source{},
+	&core.Uncrawlable{},
+	&core.CustomCrawl{},
+	&core.Url{},
+}
+
+// txStore is a datastore that runs every command in a transaction, so
+// several model Save calls can be committed or rolled back together. It
+// reads & writes datastoreModels the same way store does, but doesn't
+// support queries
+type txStore struct {
+	tx *sql.Tx
+}
+
+// model allocates a datastore model for key
+func (ts txStore) model(key datastore.Key) (sql_datastore.Model, error) {
+	for _, m := range datastoreModels {
+		if m.DatastoreType() == key.Type() {
+			return m.NewSQLModel(key), nil
+		}
+	}
+	return nil, fmt.Errorf("no usable model found for key: %s", key.String())
+}
+
+func (ts txStore) exists(m sql_datastore.Model) (exists bool, err error) {
+	err = ts.tx.QueryRow(m.SQLQuery(sql_datastore.CmdExistsOne), m.SQLParams(sql_datastore.CmdExistsOne)...).Scan(&exists)
+	return
+}
+
+// Put inserts or updates value, which must be a datastore model
+func (ts txStore) Put(key datastore.Key, value interface{}) error {
+	m, ok := value.(sql_datastore.Model)
+	if !ok {
+		return fmt.Errorf("value is not a valid sql model")
+	}
+	exists, err := ts.exists(m)
+	if err != nil {
+		return err
+	}
+	cmd := sql_datastore.CmdInsertOne
+	if exists {
+		cmd = sql_datastore.CmdUpdateOne
+	}
+	_, err = ts.tx.Exec(m.SQLQuery(cmd), m.SQLParams(cmd)...)
+	return err
+}
+
+// Get reads the model for key
+func (ts txStore) Get(key datastore.Key) (interface{}, error) {
+	m, err := ts.model(key)
+	if err != nil {
+		return nil, err
+	}
+	row := ts.tx.QueryRow(m.SQLQuery(sql_datastore.CmdSelectOne), m.SQLParams(sql_datastore.CmdSelectOne)...)
+	v := m.NewSQLModel(key)
+	if err := v.UnmarshalSQL(row); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Has checks if the model for key exists
+func (ts txStore) Has(key datastore.Key) (bool, error) {
+	m, err := ts.model(key)
+	if err != nil {
+		return false, err
+	}
+	return ts.exists(m)
+}
+
+// Delete removes the model for key
+func (ts txStore) Delete(key datastore.Key) error {
+	m, err := ts.model(key)
+	if err != nil {
+		return err
+	}
+	_, err = ts.tx.Exec(m.SQLQuery(sql_datastore.CmdDeleteOne), m.SQLParams(sql_datastore.CmdDeleteOne)...)
+	return err
+}
+
+// Query isn't supported, use store
+func (ts txStore) Query(q query.Query) (query.Results, error) {
+	return nil, fmt.Errorf("txStore doesn't support queries")
+}
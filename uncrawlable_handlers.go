@@ -4,43 +4,22 @@ import (
 	"encoding/json"
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
 	"net/http"
+	"time"
 )
 
-func UncrawlableHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetUncrawlableHandler(w, r)
-	case "PUT":
-		SaveUncrawlableHandler(w, r)
-	case "DELETE":
-		DeleteUncrawlableHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func UncrawlablesHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		ListUncrawlablesHandler(w, r)
-	case "PUT", "POST":
-		SaveUncrawlableHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func GetUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
 	res := &core.Uncrawlable{}
 	args := &UncrawlablesGetParams{
-		Id:  r.URL.Path[len("/uncrawlables/"):],
+		Id:  apiutil.PathParam(r, "id"),
 		Url: r.FormValue("url"),
 	}
 	err := new(Uncrawlables).Get(args, res)
-	if err != nil {
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -48,14 +27,22 @@ func GetUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListUncrawlablesHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, uncrawlablesResource) {
+		return
+	}
 	p := apiutil.PageFromRequest(r)
+	q, err := uncrawlablesResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
 	res := make([]*core.Uncrawlable, p.Size)
 	args := &UncrawlablesListParams{
-		Limit:   p.Limit(),
-		Offset:  p.Offset(),
-		OrderBy: "created",
+		Query:  q,
+		Limit:  p.Limit(),
+		Offset: p.Offset(),
 	}
-	err := new(Uncrawlables).List(args, &res)
+	err = new(Uncrawlables).List(args, &res)
 	if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
@@ -63,30 +50,74 @@ func ListUncrawlablesHandler(w http.ResponseWriter, r *http.Request) {
 	apiutil.WritePageResponse(w, res, r, p)
 }
 
+// uncrawlableBody decodes an uncrawlable from a request. OrgId & SuborgId
+// share the json key orgId so the key never decodes, it's accepted here &
+// ignored instead of failing as an unknown field
+type uncrawlableBody struct {
+	*core.Uncrawlable
+	OrgId json.RawMessage `json:"orgId,omitempty"`
+}
+
 func SaveUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
 	un := &core.Uncrawlable{}
-	if err := json.NewDecoder(r.Body).Decode(un); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+	if !decodeBody(w, r, &uncrawlableBody{Uncrawlable: un}) {
 		return
 	}
-	res := &core.Uncrawlable{}
-	if err := new(Uncrawlables).Save(un, res); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+	// PUT /uncrawlables/{id} takes the id from the path
+	if id := apiutil.PathParam(r, "id"); id != "" {
+		un.Id = id
+	}
+	if !conditionalWrite(w, r, "uncrawlables", un.Id, currentUncrawlable(un.Id), func(ts txStore) (sql_datastore.Model, error) {
+		if err := validateUncrawlable(ts.tx, un); err != nil {
+			return nil, err
+		}
+		return un, un.Save(ts)
+	}) {
 		return
 	}
-	apiutil.WriteResponse(w, res)
+	apiutil.WriteResponse(w, un)
 }
 
-func DeleteUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
-	un := &core.Uncrawlable{}
-	if err := json.NewDecoder(r.Body).Decode(un); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+func PatchUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	m := &core.Uncrawlable{}
+	if !patchResource(w, r, "uncrawlables", id, currentUncrawlable(id), m, func(ts txStore, current interface{}) error {
+		// orgId & suborgId share a json key so they never make it into the
+		// patch document, keep the stored values
+		cur := current.(*core.Uncrawlable)
+		m.OrgId, m.SuborgId = cur.OrgId, cur.SuborgId
+		m.Id = id
+		if err := validateUncrawlable(ts.tx, m); err != nil {
+			return err
+		}
+		return m.Save(ts)
+	}) {
 		return
 	}
-	res := &core.Uncrawlable{}
-	if err := new(Uncrawlables).Save(un, res); err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-		return
+	apiutil.WriteResponse(w, m)
+}
+
+func DeleteUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
+	writeSoftDelete(w, r, uncrawlablesResource, currentUncrawlable(apiutil.PathParam(r, "id")))
+}
+
+func RestoreUncrawlableHandler(w http.ResponseWriter, r *http.Request) {
+	writeRestore(w, r, uncrawlablesResource, currentUncrawlable(apiutil.PathParam(r, "id")))
+}
+
+func BatchGetUncrawlablesHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchGet(w, r, uncrawlablesResource)
+}
+
+func BatchUpsertUncrawlablesHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchUpsert(w, r, "uncrawlables", upsertUncrawlable)
+}
+
+// currentUncrawlable reads an uncrawlable for conditionalWrite
+func currentUncrawlable(id string) readCurrent {
+	return func() (interface{}, time.Time, error) {
+		res := &core.Uncrawlable{}
+		err := new(Uncrawlables).Get(&UncrawlablesGetParams{Id: id}, res)
+		return res, res.Updated, err
 	}
-	apiutil.WriteResponse(w, res)
 }
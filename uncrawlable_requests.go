@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
 )
 
 type Uncrawlables int
@@ -20,23 +22,39 @@ func (u *Uncrawlables) Get(p *UncrawlablesGetParams, res *core.Uncrawlable) (err
 	if err != nil {
 		return err
 	}
+	// core reads uncrawlables whether they're in the trash or not
+	if trashed, err := inTrash(appDB, uncrawlablesResource, url.Id); err != nil {
+		return err
+	} else if trashed {
+		return core.ErrNotFound
+	}
 
 	*res = *url
 	return nil
 }
 
 type UncrawlablesListParams struct {
-	OrderBy string
-	Limit   int
-	Offset  int
+	// Query holds filters & sort order, nil lists everything in the
+	// resource's default order
+	Query  *apiutil.ListQuery
+	Limit  int
+	Offset int
 }
 
 func (u *Uncrawlables) List(p *UncrawlablesListParams, res *[]*core.Uncrawlable) (err error) {
-	urls, err := core.ListUncrawlables(store, p.Limit, p.Offset)
+	list := make([]*core.Uncrawlable, 0, p.Limit)
+	err = queryList(appDB, uncrawlablesResource, p.Query, p.Limit, p.Offset, func(row sqlutil.Scannable) error {
+		m := &core.Uncrawlable{}
+		if err := m.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	*res = urls
+	*res = list
 	return nil
 }
 
@@ -50,8 +68,9 @@ func (u *Uncrawlables) Save(model *core.Uncrawlable, res *core.Uncrawlable) (err
 	return nil
 }
 
+// Delete moves a uncrawlable to the trash, see softDelete
 func (u *Uncrawlables) Delete(model *core.Uncrawlable, res *core.Uncrawlable) (err error) {
-	err = model.Delete(store)
+	err = softDelete(appDB, uncrawlablesResource, model.Id)
 	if err != nil {
 		return err
 	}
@@ -6,30 +6,10 @@ import (
 	"net/http"
 )
 
-func UrlHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetUrlHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func UrlsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		ListUrlsHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func GetUrlHandler(w http.ResponseWriter, r *http.Request) {
 	res := &core.Url{}
 	args := &UrlsGetParams{
-		Id:   r.URL.Path[len("/urls/"):],
+		Id:   apiutil.PathParam(r, "id"),
 		Url:  r.FormValue("url"),
 		Hash: r.FormValue("hash"),
 	}
@@ -42,17 +22,29 @@ func GetUrlHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListUrlsHandler(w http.ResponseWriter, r *http.Request) {
+	if writeExport(w, r, urlsResource) {
+		return
+	}
 	p := apiutil.PageFromRequest(r)
+	q, err := urlsResource.ListQuery(r)
+	if err != nil {
+		writeListQueryErr(w, err)
+		return
+	}
 	res := make([]*core.Url, p.Size)
 	args := &UrlsListParams{
-		Limit:   p.Limit(),
-		Offset:  p.Offset(),
-		OrderBy: "created",
+		Query:  q,
+		Limit:  p.Limit(),
+		Offset: p.Offset(),
 	}
-	err := new(Urls).List(args, &res)
+	err = new(Urls).List(args, &res)
 	if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
 	apiutil.WritePageResponse(w, res, r, p)
 }
+
+func BatchGetUrlsHandler(w http.ResponseWriter, r *http.Request) {
+	writeBatchGet(w, r, urlsResource)
+}
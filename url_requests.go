@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
 )
 
 type Urls int
@@ -28,16 +30,26 @@ func (u *Urls) Get(p *UrlsGetParams, res *core.Url) (err error) {
 }
 
 type UrlsListParams struct {
-	OrderBy string
-	Limit   int
-	Offset  int
+	// Query holds filters & sort order, nil lists everything in the
+	// resource's default order
+	Query  *apiutil.ListQuery
+	Limit  int
+	Offset int
 }
 
 func (u *Urls) List(p *UrlsListParams, res *[]*core.Url) (err error) {
-	urls, err := core.ListUrls(store, p.Limit, p.Offset)
+	list := make([]*core.Url, 0, p.Limit)
+	err = queryList(appDB, urlsResource, p.Query, p.Limit, p.Offset, func(row sqlutil.Scannable) error {
+		m := &core.Url{}
+		if err := m.UnmarshalSQL(row); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	*res = urls
+	*res = list
 	return nil
 }
@@ -3,47 +3,17 @@ package main
 import (
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/identity/user"
-	"net"
 	"net/http"
-	"net/rpc"
 )
 
-func UserHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		GetUserHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
-func UsersHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "OPTIONS":
-		EmptyOkHandler(w, r)
-	case "GET":
-		ListUsersHandler(w, r)
-	default:
-		NotFoundHandler(w, r)
-	}
-}
-
 func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := net.Dial("tcp", cfg.IdentityServiceUrl)
-	if err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-		return
-	}
-	cli := rpc.NewClient(conn)
 	page := apiutil.PageFromRequest(r)
 	p := user.UsersListParams{
 		Limit:  page.Size,
 		Offset: page.Offset(),
 	}
 	reply := []*user.User{}
-	if err := cli.Call("UserRequests.List", p, &reply); err != nil {
+	if err := identityRPC.Call("UserRequests.List", p, &reply); err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -51,19 +21,13 @@ func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := net.Dial("tcp", cfg.IdentityServiceUrl)
-	if err != nil {
-		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-		return
-	}
-	cli := rpc.NewClient(conn)
 	p := user.UsersGetParams{
 		Subject: &user.User{
-			Id: r.FormValue("id"),
+			Id: apiutil.PathParam(r, "id"),
 		},
 	}
 	reply := &user.User{}
-	if err := cli.Call("UserRequests.Get", p, reply); err != nil {
+	if err := identityRPC.Call("UserRequests.Get", p, reply); err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
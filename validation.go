@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+)
+
+// maxBodySize caps the size of request bodies, in bytes
+const maxBodySize = 1 << 20
+
+// length caps for string fields
+const (
+	maxURLLength   = 2048
+	maxTitleLength = 256
+	maxNameLength  = 256
+	maxEmailLength = 320
+	maxTextLength  = 10000
+)
+
+// decodeBody strictly decodes a request body into v, see
+// apiutil.DecodeBody. it writes an error response & returns false if the body
+// can't be decoded
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := apiutil.DecodeBody(w, r, v, maxBodySize); err != nil {
+		writeBodyErr(w, err)
+		return false
+	}
+	return true
+}
+
+// writeBodyErr responds to a request body that couldn't be decoded or
+// didn't validate
+func writeBodyErr(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *apiutil.ValidationError:
+		apiutil.WriteValidationErrResponse(w, e)
+	default:
+		if err == apiutil.ErrBodyTooLarge {
+			apiutil.WriteErrResponse(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+// primerExists checks a primer reference, adding a not_found error if it
+// doesn't resolve
+func primerExists(db sqlutil.Queryable, v *apiutil.Validator, field, id string) error {
+	if !v.UUID(field, id) {
+		return nil
+	}
+	exists := false
+	if err := db.QueryRow(qPrimerExists, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		v.Add(field, apiutil.CodeNotFound, "primer doesn't exist")
+	}
+	return nil
+}
+
+func validateUncrawlable(db sqlutil.Queryable, m *core.Uncrawlable) error {
+	v := &apiutil.Validator{}
+	if v.Required("url", m.Url) {
+		v.AbsoluteURL("url", m.Url)
+		v.MaxLength("url", m.Url, maxURLLength)
+	}
+	v.Email("email", m.Email)
+	v.MaxLength("email", m.Email, maxEmailLength)
+	v.MaxLength("name", m.Name, maxNameLength)
+	v.MaxLength("eventName", m.EventName, maxNameLength)
+	v.MaxLength("agency", m.Agency, maxNameLength)
+	v.MaxLength("comments", m.Comments, maxTextLength)
+	return v.Err()
+}
+
+func validateCustomCrawl(db sqlutil.Queryable, m *core.CustomCrawl) error {
+	v := &apiutil.Validator{}
+	if v.Required("originalUrl", m.OriginalUrl) {
+		v.AbsoluteURL("originalUrl", m.OriginalUrl)
+		v.MaxLength("originalUrl", m.OriginalUrl, maxURLLength)
+	}
+	v.AbsoluteURL("githubRepo", m.GithubRepo)
+	v.MaxLength("githubRepo", m.GithubRepo, maxURLLength)
+	v.MaxLength("morphRunId", m.MorphRunId, maxNameLength)
+	v.MaxLength("sqliteChecksum", m.SqliteChecksum, maxNameLength)
+	return v.Err()
+}
+
+func validateCollection(db sqlutil.Queryable, m *core.Collection) error {
+	v := &apiutil.Validator{}
+	if v.Required("title", m.Title) {
+		v.MaxLength("title", m.Title, maxTitleLength)
+	}
+	v.MaxLength("description", m.Description, maxTextLength)
+	v.AbsoluteURL("url", m.Url)
+	v.MaxLength("url", m.Url, maxURLLength)
+	return v.Err()
+}
+
+// validatePrimer checks a primer before it's saved in transaction db. a
+// primer can't be moved under itself or one of its own sub-primers. db
+// must hold the primers kind lock, see lockKind, so concurrent moves can't
+// each pass the check & close a cycle between them
+func validatePrimer(db sqlutil.Queryable, m *core.Primer) error {
+	v := &apiutil.Validator{}
+	if v.Required("title", m.Title) {
+		v.MaxLength("title", m.Title, maxTitleLength)
+	}
+	v.MaxLength("shortTitle", m.ShortTitle, maxTitleLength)
+	v.MaxLength("description", m.Description, maxTextLength)
+	if m.Parent != nil && m.Parent.Id != "" {
+		if m.Parent.Id == m.Id {
+			v.Add("parent.id", apiutil.CodeInvalid, "a primer can't be its own parent")
+		} else if err := primerExists(db, v, "parent.id", m.Parent.Id); err != nil {
+			return err
+		} else if m.Id != "" {
+			cycle := false
+			if err := db.QueryRow(qPrimerIsAncestor, m.Parent.Id, m.Id).Scan(&cycle); err != nil {
+				return err
+			}
+			if cycle {
+				v.Add("parent.id", apiutil.CodeInvalid, "a primer can't be moved under one of its own sub-primers")
+			}
+		}
+	}
+	return v.Err()
+}
+
+func validateSource(db sqlutil.Queryable, m *core.Source) error {
+	v := &apiutil.Validator{}
+	if v.Required("url", m.Url) {
+		v.AbsoluteURL("url", m.Url)
+		v.MaxLength("url", m.Url, maxURLLength)
+	}
+	v.MaxLength("title", m.Title, maxTitleLength)
+	v.MaxLength("description", m.Description, maxTextLength)
+	primerId := ""
+	if m.Primer != nil {
+		primerId = m.Primer.Id
+	}
+	if v.Required("primer.id", primerId) {
+		if err := primerExists(db, v, "primer.id", primerId); err != nil {
+			return err
+		}
+	}
+	return v.Err()
+}
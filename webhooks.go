@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+	"github.com/pborman/uuid"
+)
+
+// webhook delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried before it's
+	// marked failed
+	webhookMaxAttempts = 8
+	// webhookRetryDelay is the wait before the first retry, doubling after
+	// each failed attempt up to webhookMaxRetryDelay
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = 6 * time.Hour
+	// webhookTimeout caps how long a receiver has to respond
+	webhookTimeout = 10 * time.Second
+	// webhookClaimBatch is how many due deliveries are sent at once
+	webhookClaimBatch = 20
+	// minWebhookSecretLength is the shortest secret clients can choose
+	minWebhookSecretLength = 16
+)
+
+// webhookEvents are the event types webhooks can subscribe to
+var webhookEvents = []string{
+	"uncrawlable.created",
+	"uncrawlable.updated",
+	"uncrawlable.deleted",
+	"customcrawl.created",
+	"customcrawl.completed",
+	"alert.created",
+}
+
+var (
+	errWebhookOwner   = fmt.Errorf("only admins & whoever registered a webhook can see or change it")
+	errWebhookPrivate = fmt.Errorf("webhooks can't be delivered to private, loopback or link-local addresses")
+)
+
+// webhookClient sends webhook deliveries. anyone signed in can register a
+// webhook, so it won't connect to addresses inside our network, see
+// webhookDial, & doesn't follow redirects that could lead there
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext:         webhookDial,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookDial connects to a webhook receiver, refusing the hosts of the
+// services the api calls & any address that resolves somewhere private.
+// the address is checked after it's resolved, so a name can't be pointed
+// somewhere private after the webhook is registered
+func webhookDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !cfg.WebhookAllowPrivate {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if isServiceHost(host) {
+			return nil, errWebhookPrivate
+		}
+	}
+	d := &net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}
+	return d.DialContext(ctx, network, addr)
+}
+
+// webhookDialControl checks each resolved address before connecting
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	if cfg.WebhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errWebhookPrivate
+	}
+	return nil
+}
+
+// sharedAddressSpace is carrier-grade NAT space, RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPrivateIP checks if ip isn't a public unicast address
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// isServiceHost checks if host is one of the services the api talks to
+func isServiceHost(host string) bool {
+	for _, s := range []string{cfg.IdentityServiceUrl, cfg.CoverageServiceUrl} {
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "//" + s
+		}
+		if u, err := url.Parse(s); err == nil && strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return strings.EqualFold(host, "localhost")
+}
+
+// Webhook is a subscription to deliver events to a url
+type Webhook struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Url deliveries are POSTed to
+	Url string `json:"url"`
+	// Events lists the event types to deliver
+	Events []string `json:"events"`
+	// AgencyId, if set, limits uncrawlable events to uncrawlables for
+	// this agency
+	AgencyId string `json:"agencyId"`
+	// CreatedBy is the username of whoever registered the webhook
+	CreatedBy string `json:"createdBy"`
+	// Secret signs deliveries. generated if it isn't set when the webhook
+	// is created, & only ever included in that response
+	Secret string `json:"secret,omitempty"`
+}
+
+// UnmarshalSQL reads a webhook from a row of webhookColumns
+func (wh *Webhook) UnmarshalSQL(row sqlutil.Scannable) error {
+	return row.Scan(&wh.Id, &wh.Created, &wh.Updated, &wh.Url, pq.Array(&wh.Events), &wh.AgencyId, &wh.CreatedBy)
+}
+
+// WebhookDelivery is a queued or attempted delivery of an event to a webhook
+type WebhookDelivery struct {
+	Id        int64     `json:"id"`
+	Created   time.Time `json:"created"`
+	WebhookId string    `json:"webhookId"`
+	Event     string    `json:"event"`
+	// Payload is the body POSTed to the webhook's url
+	Payload json.RawMessage `json:"payload"`
+	// Status is one of pending, delivered or failed
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `json:"nextAttempt"`
+	LastAttempt *time.Time `json:"lastAttempt"`
+	// ResponseCode is the status code of the last attempt, 0 if the
+	// receiver couldn't be reached
+	ResponseCode int    `json:"responseCode"`
+	Error        string `json:"error"`
+}
+
+// UnmarshalSQL reads a delivery from a row of webhookDeliveryColumns
+func (d *WebhookDelivery) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		payload     []byte
+		next        time.Time
+		lastAttempt pq.NullTime
+	)
+	if err := row.Scan(&d.Id, &d.Created, &d.WebhookId, &d.Event, &payload, &d.Status, &d.Attempts,
+		&next, &lastAttempt, &d.ResponseCode, &d.Error); err != nil {
+		return err
+	}
+	d.Payload = json.RawMessage(payload)
+	if d.Status == deliveryPending {
+		d.NextAttempt = &next
+	}
+	if lastAttempt.Valid {
+		d.LastAttempt = &lastAttempt.Time
+	}
+	return nil
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+func validateWebhook(wh *Webhook) error {
+	v := &apiutil.Validator{}
+	if v.Required("url", wh.Url) {
+		v.AbsoluteURL("url", wh.Url)
+		v.MaxLength("url", wh.Url, maxURLLength)
+		// names are checked again when they're resolved, see webhookDial
+		if u, err := url.Parse(wh.Url); err == nil && !cfg.WebhookAllowPrivate {
+			ip := net.ParseIP(u.Hostname())
+			if (ip != nil && isPrivateIP(ip)) || isServiceHost(u.Hostname()) {
+				v.Add("url", apiutil.CodeInvalidURL, "must not point at a private, loopback or link-local address")
+			}
+		}
+	}
+	if len(wh.Events) == 0 {
+		v.Add("events", apiutil.CodeRequired, "is required")
+	}
+	for i, e := range wh.Events {
+		if !isWebhookEvent(e) {
+			v.Add(fmt.Sprintf("events[%d]", i), apiutil.CodeInvalid, "must be one of: "+strings.Join(webhookEvents, ", "))
+		}
+	}
+	v.MaxLength("agencyId", wh.AgencyId, maxNameLength)
+	if wh.Secret != "" && len(wh.Secret) < minWebhookSecretLength {
+		v.Add("secret", apiutil.CodeInvalid, fmt.Sprintf("must be at least %d characters", minWebhookSecretLength))
+	}
+	v.MaxLength("secret", wh.Secret, maxNameLength)
+	return v.Err()
+}
+
+func isWebhookEvent(name string) bool {
+	for _, e := range webhookEvents {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebhookSecret generates a random signing secret
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signWebhook signs a delivery's timestamp & body with a webhook's secret.
+// receivers check the X-Webhook-Signature header against it
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhooks queues deliveries of the events a write to a resource
+// causes inside tx, so they're only sent if the write is committed. before
+// & after are snapshots of the resource, see auditSnapshot
+func queueWebhooks(tx sqlutil.Execable, action, kind string, before, after interface{}) error {
+	var (
+		events []string
+		data   = after
+		agency interface{}
+	)
+	if data == nil {
+		data = before
+	}
+
+	switch kind {
+	case "uncrawlables":
+		switch action {
+		case auditCreate:
+			events = append(events, "uncrawlable.created")
+		case auditUpdate:
+			events = append(events, "uncrawlable.updated")
+		case auditDelete:
+			events = append(events, "uncrawlable.deleted")
+		}
+		if un, ok := data.(*core.Uncrawlable); ok {
+			agency = un.AgencyId
+		}
+	case "customcrawls":
+		if action == auditCreate {
+			events = append(events, "customcrawl.created")
+		}
+		if customCrawlCompleted(before, after) {
+			events = append(events, "customcrawl.completed")
+		}
+	}
+
+	for _, e := range events {
+		payload, err := json.Marshal(&webhookPayload{Event: e, Created: time.Now().UTC(), Data: data})
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(qWebhookDeliveriesQueue, e, string(payload), agency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// customCrawlCompleted checks if a write set a custom crawl's completion
+// date
+func customCrawlCompleted(before, after interface{}) bool {
+	a, ok := after.(*core.CustomCrawl)
+	if !ok || a.DateCompleted.IsZero() {
+		return false
+	}
+	b, ok := before.(*core.CustomCrawl)
+	return !ok || !b.DateCompleted.Equal(a.DateCompleted)
+}
+
+// deliverWebhooks sends due deliveries every interval until ctx is done
+func deliverWebhooks(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isDBReady() {
+			continue
+		}
+		for {
+			n, err := deliverDueWebhooks(webhookClient)
+			if err != nil {
+				log.Infof("error delivering webhooks: %s", err)
+			}
+			// keep going while there's a backlog
+			if err != nil || n < webhookClaimBatch || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+// deliverDueWebhooks claims a batch of due deliveries & sends them,
+// returning how many were claimed
+func deliverDueWebhooks(client *http.Client) (int, error) {
+	type claimed struct {
+		id          int64
+		event       string
+		payload     []byte
+		attempts    int
+		url, secret string
+	}
+
+	// deliveries are claimed for long enough to send them all, so a crashed
+	// instance's deliveries are retried by another
+	lease := webhookTimeout * (webhookClaimBatch + 1)
+	rows, err := appDB.Query(qWebhookDeliveriesClaim, webhookClaimBatch, lease.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var due []*claimed
+	for rows.Next() {
+		c := &claimed{}
+		if err := rows.Scan(&c.id, &c.event, &c.payload, &c.attempts, &c.url, &c.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, c := range due {
+		code, err := sendWebhook(client, c.url, c.secret, c.id, c.event, c.payload)
+		now := time.Now().UTC()
+		status, next, msg := deliveryDelivered, now, ""
+		if err != nil {
+			msg = err.Error()
+			status, next = deliveryPending, now.Add(webhookBackoff(c.attempts))
+			if c.attempts >= webhookMaxAttempts {
+				status = deliveryFailed
+			}
+		}
+		if _, err := appDB.Exec(qWebhookDeliveryResult, c.id, status, code, msg, now, next); err != nil {
+			return len(due), err
+		}
+	}
+	return len(due), nil
+}
+
+// sendWebhook POSTs a delivery, returning the response status code. non-2xx
+// responses are an error
+func sendWebhook(client *http.Client, url, secret string, id int64, event string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(string(payload)))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "datatogether-api-webhooks")
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(id, 10))
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// webhookBackoff is the wait before retrying a delivery that has failed
+// attempts times
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookRetryDelay
+	for i := 1; i < attempts && d < webhookMaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > webhookMaxRetryDelay {
+		d = webhookMaxRetryDelay
+	}
+	return d
+}
+
+// readWebhook reads a webhook by id, returning core.ErrNotFound if it
+// doesn't exist
+func readWebhook(db sqlutil.Queryable, id string) (*Webhook, error) {
+	wh := &Webhook{}
+	if err := wh.UnmarshalSQL(db.QueryRow(qWebhookRead, id)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, core.ErrNotFound
+		}
+		return nil, err
+	}
+	return wh, nil
+}
+
+// readOwnWebhook reads the webhook with id for the user who registered it
+// or an admin, responding with an error & returning nil if it can't
+func readOwnWebhook(w http.ResponseWriter, r *http.Request, id string) *Webhook {
+	wh, err := readWebhook(appDB, id)
+	if isNotFound(err) {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return nil
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if u := requestUser(r); wh.CreatedBy != u.Username && !isAdmin(u) {
+		apiutil.WriteErrResponse(w, http.StatusForbidden, errWebhookOwner)
+		return nil
+	}
+	return wh
+}
+
+// ListWebhooksHandler lists the webhooks the user registered, newest
+// first. admins get every webhook
+func ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+	createdBy := u.Username
+	if isAdmin(u) {
+		createdBy = ""
+	}
+	rows, err := appDB.Query(qWebhooksList, createdBy)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		wh := &Webhook{}
+		if err := wh.UnmarshalSQL(rows); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		hooks = append(hooks, wh)
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, hooks)
+}
+
+// CreateWebhookHandler registers a webhook for the signed in user,
+// responding with it & its secret
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh := &Webhook{}
+	if !decodeBody(w, r, wh) {
+		return
+	}
+	if err := validateWebhook(wh); err != nil {
+		writeBodyErr(w, err)
+		return
+	}
+	if wh.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		wh.Secret = secret
+	}
+	wh.Id = uuid.New()
+	wh.CreatedBy = requestUser(r).Username
+	wh.Created = time.Now().UTC().Round(time.Second)
+	wh.Updated = wh.Created
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(qWebhookInsert, wh.Id, wh.Created, wh.Updated, wh.Url, pq.Array(wh.Events), wh.AgencyId, wh.CreatedBy, wh.Secret); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	// the secret stays out of the audit log
+	logged := *wh
+	logged.Secret = ""
+	if err := recordAudit(tx, r, auditCreate, "webhooks", wh.Id, nil, &logged); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, wh)
+}
+
+// GetWebhookHandler gets a webhook. admins & whoever registered it only
+func GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if wh := readOwnWebhook(w, r, apiutil.PathParam(r, "id")); wh != nil {
+		apiutil.WriteResponse(w, wh)
+	}
+}
+
+// DeleteWebhookHandler removes a webhook & its delivery log, responding
+// with the webhook. admins & whoever registered it only
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	if readOwnWebhook(w, r, id) == nil {
+		return
+	}
+	var current *Webhook
+	read := func() (interface{}, time.Time, error) {
+		wh, err := readWebhook(appDB, id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		current = wh
+		return wh, wh.Updated, nil
+	}
+	if !conditionalWrite(w, r, "webhooks", id, read, func(ts txStore) (sql_datastore.Model, error) {
+		_, err := ts.tx.Exec(qWebhookDelete, id)
+		return nil, err
+	}) {
+		return
+	}
+	apiutil.WriteResponse(w, current)
+}
+
+// ListWebhookDeliveriesHandler lists a page of a webhook's deliveries,
+// newest first. admins & whoever registered the webhook only
+func ListWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := apiutil.PathParam(r, "id")
+	if readOwnWebhook(w, r, id) == nil {
+		return
+	}
+	p := apiutil.PageFromRequest(r)
+	rows, err := appDB.Query(qWebhookDeliveriesList, id, p.Limit(), p.Offset())
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := make([]*WebhookDelivery, 0, p.Size)
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		if err := d.UnmarshalSQL(rows); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, deliveries, r, p)
+}
+
+// RedeliverWebhookHandler queues a new delivery of a past delivery's event,
+// responding with the new delivery. admins & whoever registered the
+// webhook only
+func RedeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	deliveryId, err := strconv.ParseInt(apiutil.PathParam(r, "deliveryId"), 10, 64)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if readOwnWebhook(w, r, apiutil.PathParam(r, "id")) == nil {
+		return
+	}
+	d := &WebhookDelivery{}
+	err = d.UnmarshalSQL(appDB.QueryRow(qWebhookDeliveryRedeliver, apiutil.PathParam(r, "id"), deliveryId))
+	if err == sql.ErrNoRows {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, core.ErrNotFound)
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, d)
+}